@@ -9,6 +9,7 @@ import (
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/exchange"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/transport"
 )
 
 func main() {
@@ -18,22 +19,67 @@ func main() {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
+	// proxy, CA and header settings shared by every connection. The file is
+	// optional but must be valid if present
+	transportConfig, err := transport.LoadConfig("./transport.json")
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("invalid transport config:", err)
+		return
+	}
+	if err == nil {
+		if err := transport.Configure(transportConfig); err != nil {
+			fmt.Println("invalid transport config:", err)
+			return
+		}
+	}
+
+	// REST and websocket limits per venue, kept well inside each venue's
+	// published limits. The file is optional but must be valid if present
+	limits, err := exchange.LoadRateLimits("./pkg/exchange/ratelimits.json")
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("invalid rate limit config:", err)
+		return
+	}
+	if err == nil {
+		if err := exchange.SetRateLimits(limits); err != nil {
+			fmt.Println("invalid rate limit config:", err)
+			return
+		}
+	}
+
 	symbolManager, err := symbol.LoadJsonSymbolData()
 	if err != nil {
 		return
 	}
 
-	pair := symbolManager.GetCurrencyPair("BTC", "USDT")
+	base, quote := "BTC", "USDT"
+	pair := symbolManager.GetCurrencyPair(base, quote)
 	fmt.Println(pair.BinanceUS)
 
-	agg := aggregator.New(
+	exchanges := []exchange.Exchange{
 		exchange.NewBinanceUS(pair),
+		exchange.NewBitfinex(pair),
 		exchange.NewBitstamp(pair),
+		exchange.NewBybit(pair),
 		exchange.NewCoinbase(pair),
 		exchange.NewCryptoCom(pair),
 		exchange.NewGemini(pair),
 		exchange.NewKucoin(pair),
-	)
+		exchange.NewOKX(pair),
+	}
+
+	// venues polled over REST, configured without code changes. The file is
+	// optional but must be valid if present
+	configs, err := exchange.LoadPollerConfigs("./pkg/exchange/pollers.json")
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("invalid poller config:", err)
+		return
+	}
+	for _, config := range configs {
+		exchanges = append(exchanges, exchange.NewPoller(config, config.Symbol(base, quote)))
+	}
+
+	agg := aggregator.New(exchanges...)
 
 	go agg.Recv()
 	for {
@@ -3,6 +3,10 @@
 package aggregator
 
 import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/exchange"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
 )
@@ -14,21 +18,47 @@ type BestPrice struct {
 	Ask         string
 	AskSize     string
 	AskPlatform string
+
+	// route of the winning quote if it is synthetic, empty otherwise
+	BidPath string
+	AskPath string
+
+	// conversion rate applied to the winning quote if it was normalized
+	// from another quote currency, empty otherwise
+	BidRate string
+	AskRate string
+
+	// set if the winning quote was polled while the venue's websocket was down
+	BidDegraded bool
+	AskDegraded bool
 }
 
 type Aggregator struct {
-	updates   chan BestPrice
-	exchanges []exchange.Exchange
-	logger    *logger.Logger
+	updates        chan BestPrice
+	exchanges      []exchange.Exchange
+	normalizations []normalization
+	taps           []*tap
+	tapDrops       *atomic.Int64
+	filter         *Filter
+	rejections     chan Rejection
+	quoteCurrency  map[string]string
+	rates          map[string]ConversionRate
+	mux            *sync.Mutex
+	logger         *logger.Logger
 }
 
 // Create a new aggregator struct
 func New(exchanges ...exchange.Exchange) Aggregator {
 	c := make(chan BestPrice, 100)
 	return Aggregator{
-		updates:   c,
-		exchanges: exchanges,
-		logger:    logger.Named("Aggregator"),
+		updates:       c,
+		exchanges:     exchanges,
+		quoteCurrency: make(map[string]string),
+		rates:         make(map[string]ConversionRate),
+		rejections:    make(chan Rejection, 100),
+		tapDrops:      &atomic.Int64{},
+		mux:           &sync.Mutex{},
+		logger:        logger.Named("Aggregator"),
 	}
 }
 
@@ -68,21 +98,77 @@ func (a *Aggregator) Recv() {
 		return
 	}
 
-	for msg := range agg {
-		topOfBook[msg.Name] = msg
+	// quotes as received, before conversion into the target currency
+	rawBook := make(map[string]exchange.MarketUpdate)
+	rates := a.recvRates()
 
-		if msg.Name == price.AskPlatform || msg.Name == price.BidPlatform {
-			// if there is an update to the top of book for current best bid or best ask
-			// must iterate through top of all exchanges in case there was a match
-			price = BestPrice{}
-			for _, data := range topOfBook {
-				compare(&price, data)
+	for {
+		select {
+		case msg := <-agg:
+			if msg.Bid == "" && msg.Ask == "" {
+				// the venue has no quote, e.g. while it reconnects
+				a.remove(msg.Name, rawBook, topOfBook)
+				if msg.Name == price.AskPlatform || msg.Name == price.BidPlatform {
+					price = best(topOfBook)
+				}
+				break
 			}
-		} else {
-			// else, simply compare the best bid and best ask with this most recent update
-			compare(&price, msg)
+
+			rawBook[msg.Name] = msg
+			update, ok := a.convert(msg)
+			if !ok {
+				// no conversion rate yet
+				continue
+			}
+
+			if reason := a.check(update, topOfBook); reason != "" {
+				a.reject(update, reason)
+				a.remove(msg.Name, rawBook, topOfBook)
+				if msg.Name == price.AskPlatform || msg.Name == price.BidPlatform {
+					price = best(topOfBook)
+				}
+				break
+			}
+
+			topOfBook[msg.Name] = update
+			a.publish(update)
+
+			if msg.Name == price.AskPlatform || msg.Name == price.BidPlatform {
+				// if there is an update to the top of book for current best bid or best ask
+				// must iterate through top of all exchanges in case there was a match
+				price = best(topOfBook)
+			} else {
+				// else, simply compare the best bid and best ask with this most recent update
+				compare(&price, update)
+			}
+		case r := <-rates:
+			a.setRate(r)
+
+			// reconvert every quote in this currency, filter it again and
+			// recompute the best price
+			for name, raw := range rawBook {
+				if a.quoteCurrency[name] != r.currency {
+					continue
+				}
+
+				update, ok := a.convert(raw)
+				if !ok {
+					continue
+				}
+				if reason := a.check(update, topOfBook); reason != "" {
+					a.reject(update, reason)
+					a.remove(name, rawBook, topOfBook)
+					continue
+				}
+
+				topOfBook[name] = update
+				a.publish(update)
+			}
+
+			price = best(topOfBook)
 		}
 
+		a.annotateRates(&price)
 		if price != lastPrice {
 			a.updates <- price
 			lastPrice = price
@@ -95,16 +181,122 @@ func (a *Aggregator) Updates() chan BestPrice {
 	return a.updates
 }
 
+// a channel of venue updates and the venue removals that did not fit in it
+type tap struct {
+	c       chan exchange.MarketUpdate
+	removed map[string]bool
+}
+
+// Create a channel that receives every venue's top of book as it is used by the
+// aggregator, e.g. to feed an index calculator. Quotes are dropped rather than
+// blocking aggregation if the channel is not drained. Removals, empty quotes
+// for a venue, are not dropped but retried with the next update. Must be called
+// before Recv
+func (a *Aggregator) Tap() chan exchange.MarketUpdate {
+	t := &tap{
+		c:       make(chan exchange.MarketUpdate, 100),
+		removed: make(map[string]bool),
+	}
+	a.taps = append(a.taps, t)
+	return t.c
+}
+
+// Number of updates dropped because a tap was full
+func (a *Aggregator) TapDrops() int64 {
+	return a.tapDrops.Load()
+}
+
+// send an update to every tap without waiting on slow consumers
+func (a *Aggregator) publish(update exchange.MarketUpdate) {
+	removal := update.Bid == "" && update.Ask == ""
+	for _, t := range a.taps {
+		t.flush()
+
+		if removal {
+			t.removed[update.Name] = true
+			t.flush()
+			continue
+		}
+
+		select {
+		case t.c <- update:
+			// the quote replaces a removal that is still pending
+			delete(t.removed, update.Name)
+		default:
+			if a.tapDrops.Add(1)%100 == 1 {
+				a.logger.Warn("tap full, dropping updates")
+			}
+		}
+	}
+}
+
+// send pending removals while there is room
+func (t *tap) flush() {
+	for name := range t.removed {
+		select {
+		case t.c <- exchange.MarketUpdate{Name: name}:
+			delete(t.removed, name)
+		default:
+			return
+		}
+	}
+}
+
+// drop a venue's quote, an empty quote removes the venue downstream
+func (a *Aggregator) remove(name string, rawBook map[string]exchange.MarketUpdate, topOfBook map[string]exchange.MarketUpdate) {
+	delete(rawBook, name)
+	delete(topOfBook, name)
+	a.publish(exchange.MarketUpdate{Name: name})
+}
+
+// best bid and ask across the top of book of every exchange
+func best(topOfBook map[string]exchange.MarketUpdate) BestPrice {
+	price := BestPrice{}
+	for _, data := range topOfBook {
+		compare(&price, data)
+	}
+	return price
+}
+
+// replace the best bid or ask with the update's if it is better, prices are
+// compared as numbers since string order is wrong across digit counts
 func compare(price *BestPrice, update exchange.MarketUpdate) {
-	if price.Bid == "" || price.Bid < update.Bid || (price.Bid == update.Bid && price.BidSize < update.BidSize) {
-		price.Bid = update.Bid
-		price.BidSize = update.BidSize
-		price.BidPlatform = update.Name
+	if bid, ok := parseDecimal(update.Bid); ok {
+		current, hasCurrent := parseDecimal(price.Bid)
+		if !hasCurrent || bid > current || (bid == current && largerSize(update.BidSize, price.BidSize)) {
+			price.Bid = update.Bid
+			price.BidSize = update.BidSize
+			price.BidPlatform = update.Name
+			price.BidPath = update.Path
+			price.BidDegraded = update.Degraded
+		}
+	}
+
+	if ask, ok := parseDecimal(update.Ask); ok {
+		current, hasCurrent := parseDecimal(price.Ask)
+		if !hasCurrent || ask < current || (ask == current && largerSize(update.AskSize, price.AskSize)) {
+			price.Ask = update.Ask
+			price.AskSize = update.AskSize
+			price.AskPlatform = update.Name
+			price.AskPath = update.Path
+			price.AskDegraded = update.Degraded
+		}
 	}
+}
 
-	if update.Ask != "" && (price.Ask == "" || price.Ask > update.Ask || (price.Ask == update.Ask && price.AskSize < update.AskSize)) {
-		price.Ask = update.Ask
-		price.AskSize = update.AskSize
-		price.AskPlatform = update.Name
+// parse a decimal string, false if it is empty or invalid
+func parseDecimal(s string) (float64, bool) {
+	if s == "" {
+		return 0, false
 	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// whether size a is larger than size b, missing sizes count as zero
+func largerSize(a string, b string) bool {
+	sizeA, _ := parseDecimal(a)
+	sizeB, _ := parseDecimal(b)
+	return sizeA > sizeB
 }
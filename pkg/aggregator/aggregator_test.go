@@ -0,0 +1,207 @@
+package aggregator
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/exchange"
+)
+
+func TestCompareAcrossDigitCounts(t *testing.T) {
+	price := best(map[string]exchange.MarketUpdate{
+		"a": {Name: "a", Bid: "9.99", BidSize: "1", Ask: "10.5", AskSize: "1"},
+		"b": {Name: "b", Bid: "10.01", BidSize: "1", Ask: "9.995", AskSize: "1"},
+	})
+
+	if price.BidPlatform != "b" || price.Bid != "10.01" {
+		t.Errorf("best bid %s from %s, expected 10.01 from b", price.Bid, price.BidPlatform)
+	}
+	if price.AskPlatform != "b" || price.Ask != "9.995" {
+		t.Errorf("best ask %s from %s, expected 9.995 from b", price.Ask, price.AskPlatform)
+	}
+}
+
+func TestCompareTieBreaksOnSize(t *testing.T) {
+	price := BestPrice{}
+	compare(&price, exchange.MarketUpdate{Name: "a", Bid: "100", BidSize: "9", Ask: "101", AskSize: "9"})
+	compare(&price, exchange.MarketUpdate{Name: "b", Bid: "100.0", BidSize: "10", Ask: "101.00", AskSize: "10"})
+
+	if price.BidPlatform != "b" || price.AskPlatform != "b" {
+		t.Errorf("ties won by %s and %s, expected the larger size from b", price.BidPlatform, price.AskPlatform)
+	}
+}
+
+func TestCompareSkipsMissingSides(t *testing.T) {
+	price := BestPrice{}
+	compare(&price, exchange.MarketUpdate{Name: "a", Bid: "100", BidSize: "1"})
+	compare(&price, exchange.MarketUpdate{Name: "b", Ask: "101", AskSize: "1"})
+
+	if price.Bid != "100" || price.Ask != "101" {
+		t.Errorf("got bid %q ask %q, expected 100 and 101", price.Bid, price.Ask)
+	}
+}
+
+// exchange that sends the updates it is given
+type fakeExchange struct {
+	name    string
+	updates chan exchange.MarketUpdate
+}
+
+func newFakeExchange(name string) *fakeExchange {
+	return &fakeExchange{name: name, updates: make(chan exchange.MarketUpdate, 100)}
+}
+
+func (e *fakeExchange) Recv()                               {}
+func (e *fakeExchange) Updates() chan exchange.MarketUpdate { return e.updates }
+func (e *fakeExchange) Valid() bool                         { return true }
+func (e *fakeExchange) Name() string                        { return e.name }
+
+func TestUndrainedTapDoesNotBlock(t *testing.T) {
+	venue := newFakeExchange("a")
+	a := New(venue)
+	a.Tap()
+	go a.Recv()
+
+	go func() {
+		for i := 1; i <= 300; i++ {
+			venue.updates <- exchange.MarketUpdate{
+				Name: "a", Bid: fmt.Sprint(i), BidSize: "1", Ask: fmt.Sprint(i + 1), AskSize: "1",
+			}
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case price := <-a.Updates():
+			if price.Bid == "300" {
+				if a.TapDrops() == 0 {
+					t.Error("expected updates to be dropped for the full tap")
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("aggregator blocked on an undrained tap")
+		}
+	}
+}
+
+func TestRateChangeFiltersReconvertedQuotes(t *testing.T) {
+	a1, a2, c := newFakeExchange("a1"), newFakeExchange("a2"), newFakeExchange("c")
+	rate := newFakeExchange("USDT/USD")
+
+	a := New(a1, a2)
+	a.Normalize("USDT", exchange.Leg{Exchange: rate}, c)
+	a.SetFilter(Filter{MaxDeviation: 0.05})
+	go a.Recv()
+
+	quote := func(name string) exchange.MarketUpdate {
+		return exchange.MarketUpdate{Name: name, Bid: "100", BidSize: "1", Ask: "101", AskSize: "1"}
+	}
+	a1.updates <- quote("a1")
+	a2.updates <- quote("a2")
+	rate.updates <- exchange.MarketUpdate{Bid: "1", Ask: "1"}
+	c.updates <- quote("c")
+
+	// c is converted at par, then the rate doubles its quote
+	for len(a.ConversionRates()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	rate.updates <- exchange.MarketUpdate{Bid: "2", Ask: "2"}
+
+	select {
+	case r := <-a.Rejections():
+		if r.Update.Name != "c" {
+			t.Fatalf("rejected %s, expected c", r.Update.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconverted outlier was not rejected")
+	}
+
+	a1.updates <- exchange.MarketUpdate{Name: "a1", Bid: "100.5", BidSize: "1", Ask: "101", AskSize: "1"}
+	price := waitFor(t, a.Updates(), func(p BestPrice) bool { return p.Bid != "100" })
+	if price.BidPlatform != "a1" {
+		t.Errorf("best bid %s from %s, expected 100.5 from a1", price.Bid, price.BidPlatform)
+	}
+}
+
+// wait for a price matching ok
+func waitFor(t *testing.T, c chan BestPrice, ok func(BestPrice) bool) BestPrice {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-c:
+			if ok(p) {
+				return p
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a price")
+		}
+	}
+}
+
+func TestFullTapReceivesRemovals(t *testing.T) {
+	a1, b := newFakeExchange("a"), newFakeExchange("b")
+	a := New(a1, b)
+	tap := a.Tap()
+	go a.Recv()
+
+	// fill the tap, then withdraw the venue
+	for i := 1; i <= 150; i++ {
+		a1.updates <- exchange.MarketUpdate{
+			Name: "a", Bid: fmt.Sprint(i), BidSize: "1", Ask: fmt.Sprint(i + 1), AskSize: "1",
+		}
+	}
+	a1.updates <- exchange.MarketUpdate{Name: "a"}
+	waitFor(t, a.Updates(), func(p BestPrice) bool { return p.Bid == "" })
+
+	for len(tap) > 0 {
+		if update := <-tap; update.Bid == "" {
+			t.Fatal("removal delivered to a full tap")
+		}
+	}
+
+	// the removal is delivered with the next update
+	b.updates <- exchange.MarketUpdate{Name: "b", Bid: "100", BidSize: "1", Ask: "101", AskSize: "1"}
+	for _, want := range []string{"a", "b"} {
+		select {
+		case update := <-tap:
+			if update.Name != want {
+				t.Errorf("received %+v, expected an update from %s", update, want)
+			}
+			if want == "a" && update.Bid != "" {
+				t.Errorf("received %+v, expected a's removal", update)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no update from %s", want)
+		}
+	}
+}
+
+func TestStdDevFloor(t *testing.T) {
+	a := New()
+	a.SetFilter(Filter{MaxStdDev: 3})
+
+	// the other venues are a cent apart, a standard deviation of half a cent
+	topOfBook := map[string]exchange.MarketUpdate{
+		"a": {Name: "a", Bid: "26999.99", BidSize: "1", Ask: "27000.01", AskSize: "1"},
+		"b": {Name: "b", Bid: "27000.00", BidSize: "1", Ask: "27000.02", AskSize: "1"},
+	}
+
+	tests := []struct {
+		bid, ask string
+		rejected bool
+	}{
+		{bid: "27000.04", ask: "27000.06", rejected: false},
+		{bid: "26990.00", ask: "26990.10", rejected: false},
+		{bid: "27100.00", ask: "27100.10", rejected: true},
+	}
+	for _, tt := range tests {
+		update := exchange.MarketUpdate{Name: "c", Bid: tt.bid, BidSize: "1", Ask: tt.ask, AskSize: "1"}
+		if reason := a.check(update, topOfBook); (reason != "") != tt.rejected {
+			t.Errorf("%s/%s: rejected %v (%s), expected %v", tt.bid, tt.ask, reason != "", reason, tt.rejected)
+		}
+	}
+}
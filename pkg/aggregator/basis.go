@@ -0,0 +1,109 @@
+// Basis of perpetual futures against the aggregated spot price, for hedging
+// spot positions with perps
+
+package aggregator
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/exchange"
+)
+
+// Basis of a perpetual against spot. Prices are perp minus spot in the quote
+// currency, Bps fields are relative to the spot mid in basis points
+type Basis struct {
+	Name string
+
+	// perp mid minus spot mid
+	Mid    string
+	MidBps string
+
+	// perp mark price minus spot mid, empty without a mark price
+	Mark    string
+	MarkBps string
+
+	// executable basis of a cash and carry trade, selling the perp bid and
+	// buying the spot ask, and of the reverse, buying the perp ask and
+	// selling the spot bid
+	Carry   string
+	Reverse string
+
+	FundingRate string
+}
+
+// Compute the basis of a perpetual against the best spot price. Both quotes
+// need a bid and an ask
+func ComputeBasis(spot BestPrice, perp exchange.PerpUpdate) (Basis, error) {
+	var prices [4]float64
+	for i, s := range []string{spot.Bid, spot.Ask, perp.Bid, perp.Ask} {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return Basis{}, err
+		}
+		prices[i] = f
+	}
+	spotBid, spotAsk, perpBid, perpAsk := prices[0], prices[1], prices[2], prices[3]
+
+	spotMid := (spotBid + spotAsk) / 2
+	if spotMid <= 0 {
+		return Basis{}, errors.New("non-positive spot price")
+	}
+	perpMid := (perpBid + perpAsk) / 2
+
+	basis := Basis{
+		Name:        perp.Name,
+		Mid:         formatBasis(perpMid - spotMid),
+		MidBps:      formatBasis((perpMid - spotMid) / spotMid * 1e4),
+		Carry:       formatBasis(perpBid - spotAsk),
+		Reverse:     formatBasis(spotBid - perpAsk),
+		FundingRate: perp.FundingRate,
+	}
+
+	if mark, err := strconv.ParseFloat(perp.MarkPrice, 64); err == nil {
+		basis.Mark = formatBasis(mark - spotMid)
+		basis.MarkBps = formatBasis((mark - spotMid) / spotMid * 1e4)
+	}
+
+	return basis, nil
+}
+
+// Compute the basis of every perpetual update against the latest spot price,
+// sending each over the returned channel. Perp updates received before the
+// first spot price are dropped
+func RecvBasis(spot chan BestPrice, perps chan exchange.PerpUpdate) chan Basis {
+	c := make(chan Basis, 100)
+
+	go func() {
+		defer close(c)
+
+		var latest BestPrice
+		var ok bool
+		for {
+			select {
+			case price, open := <-spot:
+				if !open {
+					return
+				}
+				latest, ok = price, true
+			case perp, open := <-perps:
+				if !open {
+					return
+				}
+				if !ok {
+					continue
+				}
+
+				if basis, err := ComputeBasis(latest, perp); err == nil {
+					c <- basis
+				}
+			}
+		}
+	}()
+
+	return c
+}
+
+func formatBasis(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,113 @@
+package aggregator
+
+import (
+	"testing"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/exchange"
+)
+
+func TestComputeBasis(t *testing.T) {
+	perp := func(bid, ask, mark string) exchange.PerpUpdate {
+		return exchange.PerpUpdate{
+			MarketUpdate: exchange.MarketUpdate{Name: "OKX Swap BTC-USDT", Bid: bid, Ask: ask},
+			MarkPrice:    mark,
+			FundingRate:  "0.0001",
+		}
+	}
+
+	tests := []struct {
+		name  string
+		spot  BestPrice
+		perp  exchange.PerpUpdate
+		basis Basis
+		err   bool
+	}{
+		{
+			name: "contango",
+			spot: BestPrice{Bid: "99", Ask: "101"},
+			perp: perp("101", "103", "104"),
+			basis: Basis{
+				Name: "OKX Swap BTC-USDT", Mid: "2", MidBps: "200",
+				Mark: "4", MarkBps: "400",
+				Carry: "0", Reverse: "-4", FundingRate: "0.0001",
+			},
+		},
+		{
+			name: "backwardation",
+			spot: BestPrice{Bid: "199", Ask: "201"},
+			perp: perp("195", "197", "196"),
+			basis: Basis{
+				Name: "OKX Swap BTC-USDT", Mid: "-4", MidBps: "-200",
+				Mark: "-4", MarkBps: "-200",
+				Carry: "-6", Reverse: "2", FundingRate: "0.0001",
+			},
+		},
+		{
+			name: "no mark price",
+			spot: BestPrice{Bid: "99", Ask: "101"},
+			perp: perp("100", "100", ""),
+			basis: Basis{
+				Name: "OKX Swap BTC-USDT", Mid: "0", MidBps: "0",
+				Carry: "-1", Reverse: "-1", FundingRate: "0.0001",
+			},
+		},
+		{
+			name: "missing spot side",
+			spot: BestPrice{Bid: "99"},
+			perp: perp("101", "103", "104"),
+			err:  true,
+		},
+		{
+			name: "missing perp side",
+			spot: BestPrice{Bid: "99", Ask: "101"},
+			perp: perp("", "103", "104"),
+			err:  true,
+		},
+		{
+			name: "zero spot price",
+			spot: BestPrice{Bid: "0", Ask: "0"},
+			perp: perp("101", "103", "104"),
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			basis, err := ComputeBasis(tt.spot, tt.perp)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("computed %+v, expected an error", basis)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if basis != tt.basis {
+				t.Errorf("computed %+v, expected %+v", basis, tt.basis)
+			}
+		})
+	}
+}
+
+func TestRecvBasisWaitsForSpot(t *testing.T) {
+	spot := make(chan BestPrice)
+	perps := make(chan exchange.PerpUpdate)
+	c := RecvBasis(spot, perps)
+
+	update := exchange.PerpUpdate{MarketUpdate: exchange.MarketUpdate{Name: "Bybit Linear BTCUSDT", Bid: "101", Ask: "103"}}
+
+	// dropped, there is no spot price yet
+	perps <- update
+	spot <- BestPrice{Bid: "99", Ask: "101"}
+	perps <- update
+	close(perps)
+
+	var received []Basis
+	for basis := range c {
+		received = append(received, basis)
+	}
+	if len(received) != 1 || received[0].Mid != "2" {
+		t.Errorf("received %+v, expected one basis of 2", received)
+	}
+}
@@ -0,0 +1,188 @@
+// Filter out bad quotes before they can win the best bid or ask: self-crossed books,
+// zero prices and sizes, and quotes far away from the rest of the market
+
+package aggregator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/exchange"
+)
+
+type Filter struct {
+	// reject quotes whose mid deviates from the cross-venue median by more
+	// than this fraction, e.g. 0.05 for 5%. Zero disables the check
+	MaxDeviation float64
+	// reject quotes whose mid is more than this many standard deviations
+	// away from the cross-venue median. Zero disables the check
+	MaxStdDev float64
+	// smallest standard deviation used by MaxStdDev, as a fraction of the
+	// median, so venues quoting almost the same price do not turn a few cents
+	// into many deviations. Defaults to 0.0005 (5 basis points)
+	MinStdDev float64
+	// minimum number of other venues required for the deviation checks, defaults to 2
+	MinVenues int
+	// accept quotes that do not report a size, e.g. some REST tickers
+	AllowMissingSize bool
+}
+
+const defaultMinStdDev = 0.0005
+
+// An update dropped by the filter and the reason it was dropped
+type Rejection struct {
+	Update exchange.MarketUpdate
+	Reason string
+}
+
+// Enable filtering of bad quotes. Must be called before Recv
+func (a *Aggregator) SetFilter(f Filter) {
+	if f.MinVenues < 1 {
+		f.MinVenues = 2
+	}
+	if f.MinStdDev <= 0 {
+		f.MinStdDev = defaultMinStdDev
+	}
+	a.filter = &f
+}
+
+// Access the rejections channel. Rejections are diagnostics and are dropped
+// rather than blocking aggregation if the channel is not drained
+func (a *Aggregator) Rejections() chan Rejection {
+	return a.rejections
+}
+
+func (a *Aggregator) reject(update exchange.MarketUpdate, reason string) {
+	a.logger.Info(update.Name, " quote rejected: ", reason)
+	select {
+	case a.rejections <- Rejection{Update: update, Reason: reason}:
+	default:
+	}
+}
+
+// check an update against the filter and the current top of book of the other
+// venues, returns the reason for rejecting it or an empty string
+func (a *Aggregator) check(update exchange.MarketUpdate, topOfBook map[string]exchange.MarketUpdate) string {
+	if a.filter == nil {
+		return ""
+	}
+
+	bid, hasBid, reason := a.checkSide("bid", update.Bid, update.BidSize)
+	if reason != "" {
+		return reason
+	}
+
+	ask, hasAsk, reason := a.checkSide("ask", update.Ask, update.AskSize)
+	if reason != "" {
+		return reason
+	}
+
+	if !hasBid && !hasAsk {
+		return "empty quote"
+	}
+
+	if hasBid && hasAsk && bid > ask {
+		return fmt.Sprintf("crossed quote: bid %s > ask %s", update.Bid, update.Ask)
+	}
+
+	var mids []float64
+	for name, other := range topOfBook {
+		if name == update.Name {
+			continue
+		}
+		if m, ok := mid(other); ok {
+			mids = append(mids, m)
+		}
+	}
+
+	if len(mids) < a.filter.MinVenues {
+		return ""
+	}
+
+	m, _ := mid(update)
+	sort.Float64s(mids)
+	med := mids[len(mids)/2]
+	if len(mids)%2 == 0 {
+		med = (mids[len(mids)/2-1] + mids[len(mids)/2]) / 2
+	}
+
+	deviation := math.Abs(m - med)
+	if a.filter.MaxDeviation > 0 && deviation > a.filter.MaxDeviation*med {
+		return fmt.Sprintf("deviates %.2f%% from median %f", 100*deviation/med, med)
+	}
+
+	if a.filter.MaxStdDev > 0 {
+		std := math.Max(stdDev(mids), a.filter.MinStdDev*med)
+		if std > 0 && deviation > a.filter.MaxStdDev*std {
+			return fmt.Sprintf("deviates %.2f standard deviations from median %f", deviation/std, med)
+		}
+	}
+
+	return ""
+}
+
+// validate one side of a quote, an empty price means the side is missing
+func (a *Aggregator) checkSide(side string, price string, size string) (float64, bool, string) {
+	if price == "" {
+		return 0, false, ""
+	}
+
+	p, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		return 0, false, fmt.Sprintf("invalid %s price %q", side, price)
+	}
+	if p <= 0 {
+		return 0, false, fmt.Sprintf("non-positive %s price %s", side, price)
+	}
+
+	if size == "" {
+		if a.filter.AllowMissingSize {
+			return p, true, ""
+		}
+		return 0, false, fmt.Sprintf("empty %s size", side)
+	}
+
+	s, err := strconv.ParseFloat(size, 64)
+	if err != nil {
+		return 0, false, fmt.Sprintf("invalid %s size %q", side, size)
+	}
+	if s <= 0 {
+		return 0, false, fmt.Sprintf("non-positive %s size %s", side, size)
+	}
+
+	return p, true, ""
+}
+
+// mid price of a quote, or the price of its only side
+func mid(u exchange.MarketUpdate) (float64, bool) {
+	bid, bidErr := strconv.ParseFloat(u.Bid, 64)
+	ask, askErr := strconv.ParseFloat(u.Ask, 64)
+
+	switch {
+	case bidErr == nil && askErr == nil:
+		return (bid + ask) / 2, true
+	case bidErr == nil:
+		return bid, true
+	case askErr == nil:
+		return ask, true
+	}
+
+	return 0, false
+}
+
+func stdDev(values []float64) float64 {
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+
+	return math.Sqrt(variance / float64(len(values)))
+}
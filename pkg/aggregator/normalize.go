@@ -0,0 +1,130 @@
+// Normalize quotes in stablecoins (USDT, USDC, BUSD, ...) into a single target
+// currency so that liquidity split across quote currencies competes in one BestPrice
+
+package aggregator
+
+import (
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/exchange"
+)
+
+// Live rate used to convert quotes in Currency into the target currency
+type ConversionRate struct {
+	Currency string
+	Bid      string
+	Ask      string
+}
+
+type normalization struct {
+	currency string
+	rate     exchange.Leg
+}
+
+type rateUpdate struct {
+	currency string
+	update   exchange.MarketUpdate
+}
+
+// Add exchanges quoted in currency, whose quotes are converted into the target
+// currency using the live currency/target rate feed before being aggregated.
+// Must be called before Recv
+func (a *Aggregator) Normalize(currency string, rate exchange.Leg, exchanges ...exchange.Exchange) {
+	a.normalizations = append(a.normalizations, normalization{
+		currency: currency,
+		rate:     rate,
+	})
+
+	for _, exch := range exchanges {
+		a.quoteCurrency[exch.Name()] = currency
+	}
+	a.exchanges = append(a.exchanges, exchanges...)
+}
+
+// Snapshot of the conversion rates currently in use, keyed by currency
+func (a *Aggregator) ConversionRates() map[string]ConversionRate {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	rates := make(map[string]ConversionRate, len(a.rates))
+	for currency, rate := range a.rates {
+		rates[currency] = rate
+	}
+
+	return rates
+}
+
+// start the rate feeds, sending their updates over the returned channel
+func (a *Aggregator) recvRates() chan rateUpdate {
+	c := make(chan rateUpdate, 100)
+	for _, n := range a.normalizations {
+		if !n.rate.Exchange.Valid() {
+			a.logger.Info(n.rate.Exchange.Name(), "not valid, cannot convert ", n.currency)
+			continue
+		}
+
+		go n.rate.Exchange.Recv()
+		go func(n normalization) {
+			for msg := range n.rate.Exchange.Updates() {
+				if n.rate.Inverted {
+					msg = exchange.Invert(msg)
+				}
+				c <- rateUpdate{currency: n.currency, update: msg}
+			}
+		}(n)
+	}
+
+	return c
+}
+
+func (a *Aggregator) setRate(r rateUpdate) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.rates[r.currency] = ConversionRate{
+		Currency: r.currency,
+		Bid:      r.update.Bid,
+		Ask:      r.update.Ask,
+	}
+}
+
+func (a *Aggregator) getRate(currency string) (ConversionRate, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	rate, ok := a.rates[currency]
+	return rate, ok
+}
+
+// convert an update into the target currency, returns false if the update
+// is quoted in a currency that does not have a rate yet
+func (a *Aggregator) convert(update exchange.MarketUpdate) (exchange.MarketUpdate, bool) {
+	currency, ok := a.quoteCurrency[update.Name]
+	if !ok {
+		return update, true
+	}
+
+	rate, ok := a.getRate(currency)
+	if !ok {
+		return update, false
+	}
+
+	converted := exchange.Chain(update, exchange.MarketUpdate{Bid: rate.Bid, Ask: rate.Ask})
+	converted.Name = update.Name
+	converted.Synthetic = update.Synthetic
+	converted.Path = update.Path
+
+	return converted, true
+}
+
+// record the rates applied to the winning bid and ask
+func (a *Aggregator) annotateRates(price *BestPrice) {
+	price.BidRate = ""
+	price.AskRate = ""
+
+	if currency, ok := a.quoteCurrency[price.BidPlatform]; ok {
+		rate, _ := a.getRate(currency)
+		price.BidRate = rate.Bid
+	}
+
+	if currency, ok := a.quoteCurrency[price.AskPlatform]; ok {
+		rate, _ := a.getRate(currency)
+		price.AskRate = rate.Ask
+	}
+}
@@ -0,0 +1,122 @@
+// Merge the public trades of several exchanges into a single cross-venue tape,
+// tracking the volume weighted average price and volume over a rolling window
+
+package aggregator
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/exchange"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+)
+
+// A trade on the tape along with the tape's statistics after including it
+type TapeEntry struct {
+	exchange.Trade
+	VWAP   string
+	Volume string
+}
+
+type Tape struct {
+	updates chan TapeEntry
+	sources []exchange.TradeSource
+	window  time.Duration
+	logger  *logger.Logger
+}
+
+// notional and volume of the trades received within a rolling window, or of
+// every trade if window is zero
+type tapeWindow struct {
+	window   time.Duration
+	trades   []tapeTrade
+	notional float64
+	volume   float64
+}
+
+type tapeTrade struct {
+	time     time.Time
+	notional float64
+	size     float64
+}
+
+// Create a tape over the trades of the given sources, with statistics computed over
+// a rolling window, or since the tape started if window is zero.
+// Must be created before the sources' Recv is called so that their trade feeds are subscribed
+func NewTape(window time.Duration, sources ...exchange.TradeSource) *Tape {
+	for _, source := range sources {
+		source.Trades()
+	}
+
+	return &Tape{
+		updates: make(chan TapeEntry, 100),
+		sources: sources,
+		window:  window,
+		logger:  logger.Named("Tape"),
+	}
+}
+
+// Receive trades from every source and send them over the updates channel.
+// The sources themselves must be started separately, e.g. by an Aggregator
+func (t *Tape) Recv() {
+	agg := make(chan exchange.Trade, 100)
+	for _, source := range t.sources {
+		go func(c chan exchange.Trade) {
+			for trade := range c {
+				agg <- trade
+			}
+		}(source.Trades())
+	}
+
+	w := &tapeWindow{window: t.window}
+	for trade := range agg {
+		price, err := strconv.ParseFloat(trade.Price, 64)
+		if err != nil {
+			t.logger.Info(trade.Name, " invalid trade price ", trade.Price)
+			continue
+		}
+		size, err := strconv.ParseFloat(trade.Size, 64)
+		if err != nil {
+			t.logger.Info(trade.Name, " invalid trade size ", trade.Size)
+			continue
+		}
+
+		w.add(price, size, time.Now())
+		entry := TapeEntry{Trade: trade}
+		entry.VWAP, entry.Volume = w.stats()
+		t.updates <- entry
+	}
+}
+
+// add a trade received at now, evicting the trades that left the window
+func (w *tapeWindow) add(price float64, size float64, now time.Time) {
+	w.notional += price * size
+	w.volume += size
+	if w.window <= 0 {
+		return
+	}
+
+	w.trades = append(w.trades, tapeTrade{time: now, notional: price * size, size: size})
+	expired := 0
+	for expired < len(w.trades) && now.Sub(w.trades[expired].time) > w.window {
+		w.notional -= w.trades[expired].notional
+		w.volume -= w.trades[expired].size
+		expired++
+	}
+	w.trades = w.trades[expired:]
+}
+
+// VWAP and volume of the window, the VWAP is empty without volume
+func (w *tapeWindow) stats() (string, string) {
+	vwap := ""
+	if w.volume > 0 {
+		vwap = strconv.FormatFloat(w.notional/w.volume, 'f', -1, 64)
+	}
+
+	return vwap, strconv.FormatFloat(w.volume, 'f', -1, 64)
+}
+
+// Access the updates channel
+func (t *Tape) Updates() chan TapeEntry {
+	return t.updates
+}
@@ -0,0 +1,66 @@
+package aggregator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTapeWindow(t *testing.T) {
+	type trade struct {
+		price  float64
+		size   float64
+		offset time.Duration
+		vwap   string
+		volume string
+	}
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		trades []trade
+	}{
+		{
+			name: "since the tape started",
+			trades: []trade{
+				{price: 100, size: 1, offset: 0, vwap: "100", volume: "1"},
+				{price: 110, size: 3, offset: time.Minute, vwap: "107.5", volume: "4"},
+				{price: 90, size: 4, offset: time.Hour, vwap: "98.75", volume: "8"},
+			},
+		},
+		{
+			name:   "rolling window",
+			window: 10 * time.Second,
+			trades: []trade{
+				{price: 100, size: 1, offset: 0, vwap: "100", volume: "1"},
+				{price: 110, size: 3, offset: 5 * time.Second, vwap: "107.5", volume: "4"},
+				// a trade exactly one window old is kept
+				{price: 120, size: 1, offset: 10 * time.Second, vwap: "110", volume: "5"},
+				// the first trade expires
+				{price: 90, size: 4, offset: 12 * time.Second, vwap: "101.25", volume: "8"},
+				// every earlier trade expires
+				{price: 95, size: 2, offset: time.Minute, vwap: "95", volume: "2"},
+			},
+		},
+		{
+			name:   "zero sizes",
+			window: 10 * time.Second,
+			trades: []trade{
+				{price: 100, size: 0, offset: 0, vwap: "", volume: "0"},
+				{price: 110, size: 2, offset: time.Second, vwap: "110", volume: "2"},
+			},
+		},
+	}
+
+	start := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &tapeWindow{window: tt.window}
+			for i, trade := range tt.trades {
+				w.add(trade.price, trade.size, start.Add(trade.offset))
+				if vwap, volume := w.stats(); vwap != trade.vwap || volume != trade.volume {
+					t.Errorf("trade %d: VWAP %s volume %s, expected %s and %s", i, vwap, volume, trade.vwap, trade.volume)
+				}
+			}
+		})
+	}
+}
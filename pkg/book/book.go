@@ -0,0 +1,158 @@
+// A local price level order book maintained from exchange depth feeds, and a
+// consolidated view of the books of several exchanges
+
+package book
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+type Side int
+
+const (
+	Bid Side = iota
+	Ask
+)
+
+type Level struct {
+	Price string
+	Size  string
+}
+
+// The top levels of an exchange's book at a point in time
+type Snapshot struct {
+	Name string
+	Bids []Level
+	Asks []Level
+}
+
+// levels are keyed by their parsed price, so the same price written as
+// "27000.1" and "27000.10" is one level
+type Book struct {
+	bids map[float64]level
+	asks map[float64]level
+}
+
+// price as last written by the exchange
+type level struct {
+	price string
+	size  string
+}
+
+// Create an empty book
+func New() *Book {
+	return &Book{
+		bids: make(map[float64]level),
+		asks: make(map[float64]level),
+	}
+}
+
+// Set the size of a price level, a zero size removes the level. Prices are
+// compared by value, not by how they are written
+func (b *Book) Set(side Side, price string, size string) error {
+	p, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		return fmt.Errorf("invalid price %q: %w", price, err)
+	}
+	if math.IsNaN(p) || math.IsInf(p, 0) {
+		return fmt.Errorf("invalid price %q", price)
+	}
+
+	s, err := strconv.ParseFloat(size, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q: %w", size, err)
+	}
+	if math.IsNaN(s) || math.IsInf(s, 0) {
+		return fmt.Errorf("invalid size %q", size)
+	}
+
+	levels := b.side(side)
+	if s == 0 {
+		delete(levels, p)
+		return nil
+	}
+	if p <= 0 || s < 0 {
+		return errors.New(fmt.Sprint("invalid level ", price, " ", size))
+	}
+
+	levels[p] = level{price: price, size: size}
+	return nil
+}
+
+// Remove every level from the book
+func (b *Book) Clear() {
+	b.bids = make(map[float64]level)
+	b.asks = make(map[float64]level)
+}
+
+// Best bid and ask, a side is empty if there are no levels on it
+func (b *Book) Top() (Level, Level) {
+	var bid, ask Level
+	var bestBid, bestAsk float64
+	for price, l := range b.bids {
+		if bid.Price == "" || price > bestBid {
+			bid = Level{Price: l.price, Size: l.size}
+			bestBid = price
+		}
+	}
+
+	for price, l := range b.asks {
+		if ask.Price == "" || price < bestAsk {
+			ask = Level{Price: l.price, Size: l.size}
+			bestAsk = price
+		}
+	}
+
+	return bid, ask
+}
+
+// The best n bids, highest first. n <= 0 returns every level
+func (b *Book) Bids(n int) []Level {
+	return sorted(b.bids, n, func(i, j float64) bool { return i > j })
+}
+
+// The best n asks, lowest first. n <= 0 returns every level
+func (b *Book) Asks(n int) []Level {
+	return sorted(b.asks, n, func(i, j float64) bool { return i < j })
+}
+
+// Snapshot of the top n levels of each side
+func (b *Book) Snapshot(name string, n int) Snapshot {
+	return Snapshot{
+		Name: name,
+		Bids: b.Bids(n),
+		Asks: b.Asks(n),
+	}
+}
+
+func (b *Book) side(side Side) map[float64]level {
+	if side == Bid {
+		return b.bids
+	}
+	return b.asks
+}
+
+func sorted(levels map[float64]level, n int, better func(float64, float64) bool) []Level {
+	keys := make([]float64, 0, len(levels))
+	for price := range levels {
+		keys = append(keys, price)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return better(keys[i], keys[j])
+	})
+
+	if n > 0 && n < len(keys) {
+		keys = keys[:n]
+	}
+
+	res := make([]Level, len(keys))
+	for i, price := range keys {
+		res[i] = Level{Price: levels[price].price, Size: levels[price].size}
+	}
+
+	return res
+}
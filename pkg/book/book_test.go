@@ -0,0 +1,88 @@
+package book
+
+import "testing"
+
+func TestSetComparesPricesByValue(t *testing.T) {
+	b := New()
+	for _, l := range []struct {
+		side  Side
+		price string
+		size  string
+	}{
+		{Bid, "27000.1", "1"},
+		{Bid, "26999.5", "2"},
+		{Ask, "27001", "3"},
+		// the same prices written differently
+		{Bid, "27000.10", "4"},
+		{Ask, "27001.00", "5"},
+	} {
+		if err := b.Set(l.side, l.price, l.size); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if bids := b.Bids(0); len(bids) != 2 || bids[0] != (Level{Price: "27000.10", Size: "4"}) {
+		t.Errorf("bids %v, expected 27000.10 replaced 27000.1", bids)
+	}
+	if asks := b.Asks(0); len(asks) != 1 || asks[0] != (Level{Price: "27001.00", Size: "5"}) {
+		t.Errorf("asks %v, expected 27001.00 replaced 27001", asks)
+	}
+
+	// deletes written in another format leave no phantom level
+	if err := b.Set(Bid, "27000.100", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(Ask, "2.7001e4", "0.000"); err != nil {
+		t.Fatal(err)
+	}
+
+	bid, ask := b.Top()
+	if bid != (Level{Price: "26999.5", Size: "2"}) {
+		t.Errorf("best bid %v, expected 26999.5", bid)
+	}
+	if ask != (Level{}) {
+		t.Errorf("best ask %v, expected none", ask)
+	}
+}
+
+func TestSortedLevels(t *testing.T) {
+	b := New()
+	for _, price := range []string{"9.5", "10", "100", "9.75"} {
+		if err := b.Set(Bid, price, "1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Set(Ask, price, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bids, asks := b.Bids(3), b.Asks(3)
+	for i, want := range []string{"100", "10", "9.75"} {
+		if bids[i].Price != want {
+			t.Errorf("bid %d at %s, expected %s", i, bids[i].Price, want)
+		}
+	}
+	for i, want := range []string{"9.5", "9.75", "10"} {
+		if asks[i].Price != want {
+			t.Errorf("ask %d at %s, expected %s", i, asks[i].Price, want)
+		}
+	}
+}
+
+func TestSetRejectsNonFinitePrices(t *testing.T) {
+	b := New()
+	for _, price := range []string{"NaN", "Inf", "-Inf"} {
+		if err := b.Set(Bid, price, "1"); err == nil {
+			t.Errorf("level at %s accepted", price)
+		}
+	}
+}
+
+func TestSetRejectsNonFiniteSizes(t *testing.T) {
+	b := New()
+	for _, size := range []string{"NaN", "Inf"} {
+		if err := b.Set(Bid, "10", size); err == nil {
+			t.Errorf("level of size %s accepted", size)
+		}
+	}
+}
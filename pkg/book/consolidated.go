@@ -0,0 +1,97 @@
+package book
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// A price level of a consolidated book, attributed to the exchange it is on
+type VenueLevel struct {
+	Level
+	Name string
+}
+
+// Consolidated view of the depth of several exchanges, safe for concurrent use
+type Consolidated struct {
+	venues map[string]Snapshot
+	mux    *sync.Mutex
+}
+
+// Create an empty consolidated book
+func NewConsolidated() *Consolidated {
+	return &Consolidated{
+		venues: make(map[string]Snapshot),
+		mux:    &sync.Mutex{},
+	}
+}
+
+// Receive snapshots from an exchange's depth channel until it is closed
+func (c *Consolidated) Recv(snapshots chan Snapshot) {
+	for s := range snapshots {
+		c.Update(s)
+	}
+}
+
+// Replace the depth of an exchange
+func (c *Consolidated) Update(s Snapshot) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.venues[s.Name] = s
+}
+
+// Remove an exchange from the view, e.g. when its feed goes down
+func (c *Consolidated) Remove(name string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.venues, name)
+}
+
+// The best n bids across every exchange, highest first. n <= 0 returns every level
+func (c *Consolidated) Bids(n int) []VenueLevel {
+	return c.merge(n, func(s Snapshot) []Level { return s.Bids }, func(i, j float64) bool { return i > j })
+}
+
+// The best n asks across every exchange, lowest first. n <= 0 returns every level
+func (c *Consolidated) Asks(n int) []VenueLevel {
+	return c.merge(n, func(s Snapshot) []Level { return s.Asks }, func(i, j float64) bool { return i < j })
+}
+
+func (c *Consolidated) merge(n int, side func(Snapshot) []Level, better func(float64, float64) bool) []VenueLevel {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	type pricedLevel struct {
+		VenueLevel
+		price float64
+	}
+
+	var levels []pricedLevel
+	for name, s := range c.venues {
+		for _, l := range side(s) {
+			p, err := strconv.ParseFloat(l.Price, 64)
+			if err != nil {
+				continue
+			}
+			levels = append(levels, pricedLevel{VenueLevel: VenueLevel{Level: l, Name: name}, price: p})
+		}
+	}
+
+	sort.SliceStable(levels, func(i, j int) bool {
+		if levels[i].price == levels[j].price {
+			return levels[i].Name < levels[j].Name
+		}
+		return better(levels[i].price, levels[j].price)
+	})
+
+	if n > 0 && n < len(levels) {
+		levels = levels[:n]
+	}
+
+	res := make([]VenueLevel, len(levels))
+	for i, l := range levels {
+		res[i] = l.VenueLevel
+	}
+
+	return res
+}
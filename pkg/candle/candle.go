@@ -0,0 +1,278 @@
+// Build OHLCV candles over fixed intervals from the aggregated best bid and ask,
+// and from trades where a trade feed is available
+
+package candle
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/aggregator"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+)
+
+// The price series a candle is built from
+type Source string
+
+const (
+	Mid   Source = "mid"
+	Bid   Source = "bid"
+	Ask   Source = "ask"
+	Trade Source = "trade"
+)
+
+type Candle struct {
+	Source   Source
+	Interval time.Duration
+	Start    time.Time
+	Open     string
+	High     string
+	Low      string
+	Close    string
+	// traded volume, only set for trade candles
+	Volume string
+}
+
+type Builder struct {
+	updates   chan Candle
+	intervals []time.Duration
+	history   int
+	bars      map[series]*bar
+	closed    map[series][]Candle
+	// start of the most recently closed candle of every series
+	lastClosed map[series]time.Time
+	mux        *sync.Mutex
+	logger     *logger.Logger
+}
+
+type series struct {
+	source   Source
+	interval time.Duration
+}
+
+// candle under construction
+type bar struct {
+	start  time.Time
+	open   float64
+	high   float64
+	low    float64
+	close  float64
+	volume float64
+}
+
+// Create a candle builder for the given intervals, e.g. time.Second and time.Minute,
+// keeping the most recent history closed candles of every series
+func New(history int, intervals ...time.Duration) *Builder {
+	sorted := append([]time.Duration(nil), intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return &Builder{
+		updates:    make(chan Candle, 100),
+		intervals:  sorted,
+		history:    history,
+		bars:       make(map[series]*bar),
+		closed:     make(map[series][]Candle),
+		lastClosed: make(map[series]time.Time),
+		mux:        &sync.Mutex{},
+		logger:     logger.Named("Candle Builder"),
+	}
+}
+
+// Receive best prices from the aggregator and build mid, bid and ask candles.
+// Candles are sent over the updates channel as they close
+func (b *Builder) Recv(prices chan aggregator.BestPrice) {
+	if len(b.intervals) == 0 {
+		b.logger.Warn("no intervals configured, RETURNING")
+		return
+	}
+
+	// close candles on time even when no price arrives
+	ticker := time.NewTicker(b.intervals[0])
+	defer ticker.Stop()
+
+	for {
+		select {
+		case price, ok := <-prices:
+			if !ok {
+				b.emit(b.closeAll())
+				close(b.updates)
+				return
+			}
+
+			now := time.Now()
+			bid, bidErr := strconv.ParseFloat(price.Bid, 64)
+			ask, askErr := strconv.ParseFloat(price.Ask, 64)
+
+			var closed []Candle
+			if bidErr == nil {
+				closed = append(closed, b.add(Bid, bid, 0, now)...)
+			}
+			if askErr == nil {
+				closed = append(closed, b.add(Ask, ask, 0, now)...)
+			}
+			if bidErr == nil && askErr == nil {
+				closed = append(closed, b.add(Mid, (bid+ask)/2, 0, now)...)
+			}
+			b.emit(closed)
+		case now := <-ticker.C:
+			b.emit(b.closeBefore(now))
+		}
+	}
+}
+
+// Add a trade to the trade candles, safe to call concurrently with Recv
+func (b *Builder) AddTrade(price string, size string, t time.Time) {
+	p, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		b.logger.Debug("invalid trade price ", price)
+		return
+	}
+	s, _ := strconv.ParseFloat(size, 64)
+
+	b.emit(b.add(Trade, p, s, t))
+}
+
+// Receive trades from a cross-venue tape and build trade candles with volume
+func (b *Builder) RecvTrades(tape chan aggregator.TapeEntry) {
+	for entry := range tape {
+		t := entry.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		b.AddTrade(entry.Price, entry.Size, t)
+	}
+}
+
+// Access the updates channel, which receives candles as they close
+func (b *Builder) Updates() chan Candle {
+	return b.updates
+}
+
+// Get up to the n most recent closed candles of a series, oldest first
+func (b *Builder) History(source Source, interval time.Duration, n int) []Candle {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	closed := b.closed[series{source: source, interval: interval}]
+	if n > len(closed) {
+		n = len(closed)
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	res := make([]Candle, n)
+	copy(res, closed[len(closed)-n:])
+	return res
+}
+
+// add a price to every interval of a source, returns the candles closed by it
+func (b *Builder) add(source Source, price float64, volume float64, t time.Time) []Candle {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	var closed []Candle
+	for _, interval := range b.intervals {
+		s := series{source: source, interval: interval}
+		start := t.Truncate(interval)
+
+		if last, ok := b.lastClosed[s]; ok && !start.After(last) {
+			// late trade for a candle that already closed
+			continue
+		}
+
+		current, ok := b.bars[s]
+		if ok && start.Before(current.start) {
+			// late trade for a period that had no candle
+			continue
+		}
+
+		if ok && current.start.Before(start) {
+			closed = append(closed, b.closeBar(s, current))
+			ok = false
+		}
+
+		if !ok {
+			b.bars[s] = &bar{start: start, open: price, high: price, low: price, close: price, volume: volume}
+			continue
+		}
+
+		if price > current.high {
+			current.high = price
+		}
+		if price < current.low {
+			current.low = price
+		}
+		current.close = price
+		current.volume += volume
+	}
+
+	return closed
+}
+
+// close every candle whose interval has ended by now
+func (b *Builder) closeBefore(now time.Time) []Candle {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	var closed []Candle
+	for s, current := range b.bars {
+		if !current.start.Add(s.interval).After(now) {
+			closed = append(closed, b.closeBar(s, current))
+		}
+	}
+
+	return closed
+}
+
+func (b *Builder) closeAll() []Candle {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	var closed []Candle
+	for s, current := range b.bars {
+		closed = append(closed, b.closeBar(s, current))
+	}
+
+	return closed
+}
+
+// must be called with the lock held
+func (b *Builder) closeBar(s series, current *bar) Candle {
+	delete(b.bars, s)
+	b.lastClosed[s] = current.start
+
+	c := Candle{
+		Source:   s.source,
+		Interval: s.interval,
+		Start:    current.start,
+		Open:     formatFloat(current.open),
+		High:     formatFloat(current.high),
+		Low:      formatFloat(current.low),
+		Close:    formatFloat(current.close),
+	}
+	if s.source == Trade {
+		c.Volume = formatFloat(current.volume)
+	}
+
+	history := append(b.closed[s], c)
+	if len(history) > b.history {
+		history = history[len(history)-b.history:]
+	}
+	b.closed[s] = history
+
+	return c
+}
+
+func (b *Builder) emit(candles []Candle) {
+	sort.Slice(candles, func(i, j int) bool { return candles[i].Start.Before(candles[j].Start) })
+	for _, c := range candles {
+		b.updates <- c
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,121 @@
+package candle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLateTradeAfterCloseIsDropped(t *testing.T) {
+	b := New(10, time.Minute)
+	start := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	b.add(Trade, 100, 1, start.Add(10*time.Second))
+	closed := b.closeBefore(start.Add(time.Minute))
+	if len(closed) != 1 {
+		t.Fatalf("closed %d candles, expected 1", len(closed))
+	}
+
+	// late trade for the period that just closed
+	b.add(Trade, 101, 1, start.Add(50*time.Second))
+	if closed := b.closeAll(); len(closed) != 0 {
+		t.Errorf("late trade reopened a closed candle: %v", closed)
+	}
+
+	if history := b.History(Trade, time.Minute, 10); len(history) != 1 {
+		t.Errorf("history has %d candles, expected 1", len(history))
+	}
+}
+
+func TestNewDoesNotReorderIntervals(t *testing.T) {
+	intervals := []time.Duration{time.Minute, time.Second}
+	b := New(10, intervals...)
+
+	if intervals[0] != time.Minute || intervals[1] != time.Second {
+		t.Errorf("caller's intervals reordered to %v", intervals)
+	}
+	if b.intervals[0] != time.Second {
+		t.Errorf("builder intervals %v not sorted", b.intervals)
+	}
+}
+
+func TestTradeCandles(t *testing.T) {
+	b := New(10, time.Minute)
+	start := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	trades := []struct {
+		price  float64
+		volume float64
+		offset time.Duration
+	}{
+		{100, 1, 5 * time.Second},
+		{104, 0.5, 20 * time.Second},
+		{98, 2, 40 * time.Second},
+		{101, 0.25, 59 * time.Second},
+		// opens the next candle
+		{102, 1.5, 61 * time.Second},
+		{103, 1, 90 * time.Second},
+	}
+
+	var closed []Candle
+	for _, trade := range trades {
+		closed = append(closed, b.add(Trade, trade.price, trade.volume, start.Add(trade.offset))...)
+	}
+	closed = append(closed, b.closeAll()...)
+
+	expected := []Candle{
+		{
+			Source: Trade, Interval: time.Minute, Start: start,
+			Open: "100", High: "104", Low: "98", Close: "101", Volume: "3.75",
+		},
+		{
+			Source: Trade, Interval: time.Minute, Start: start.Add(time.Minute),
+			Open: "102", High: "103", Low: "102", Close: "103", Volume: "2.5",
+		},
+	}
+	if len(closed) != len(expected) {
+		t.Fatalf("closed %d candles, expected %d", len(closed), len(expected))
+	}
+	for i, want := range expected {
+		if closed[i] != want {
+			t.Errorf("candle %d: %+v, expected %+v", i, closed[i], want)
+		}
+	}
+
+	// price candles have no volume
+	b.add(Mid, 100, 0, start)
+	if c := b.closeAll(); len(c) != 1 || c[0].Volume != "" {
+		t.Errorf("mid candles %+v, expected one without volume", c)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	b := New(2, time.Minute)
+	start := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		b.add(Mid, float64(100+i), 0, start.Add(time.Duration(i)*time.Minute))
+	}
+	b.closeAll()
+
+	tests := []struct {
+		n     int
+		opens []string
+	}{
+		{n: -1, opens: []string{}},
+		{n: 0, opens: []string{}},
+		{n: 1, opens: []string{"102"}},
+		// only two candles are kept
+		{n: 5, opens: []string{"101", "102"}},
+	}
+	for _, tt := range tests {
+		history := b.History(Mid, time.Minute, tt.n)
+		if len(history) != len(tt.opens) {
+			t.Errorf("History(%d) returned %d candles, expected %d", tt.n, len(history), len(tt.opens))
+			continue
+		}
+		for i, open := range tt.opens {
+			if history[i].Open != open {
+				t.Errorf("History(%d)[%d] opened at %s, expected %s", tt.n, i, history[i].Open, open)
+			}
+		}
+	}
+}
@@ -1,66 +1,176 @@
 package exchange
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
 )
 
 type BinanceUS struct {
-	updates chan MarketUpdate
-	url     string
-	name    string
-	symbol  string
-	valid   bool
-	logger  *logger.Logger
+	updates     chan MarketUpdate
+	trades      chan Trade
+	depth       chan book.Snapshot
+	diff        *binanceUSDepth
+	url         string
+	name        string
+	symbol      string
+	valid       bool
+	fallback    *fallback
+	parseErrors *parseReporter
+	logger      *logger.Logger
 }
 
 func NewBinanceUS(pair symbol.CurrencyPair) *BinanceUS {
 	c := make(chan MarketUpdate, updateBufSize)
 	name := fmt.Sprintf("Binance.US: %s", pair.BinanceUS)
+	logger := logger.Named(name)
 
 	return &BinanceUS{
-		updates: c,
-		url:     fmt.Sprintf("wss://stream.binance.us:9443/ws/%s@bookTicker", pair.BinanceUS),
-		name:    name,
-		symbol:  pair.BinanceUS,
-		valid:   pair.BinanceUS != "",
-		logger:  logger.Named(name),
+		updates:     c,
+		url:         "wss://stream.binance.us:9443/stream?streams=",
+		name:        name,
+		symbol:      pair.BinanceUS,
+		valid:       pair.BinanceUS != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
 	}
 }
 
 func (e *BinanceUS) Recv() {
 	e.logger.Debug("connecting to socket")
-	conn := ws.New(e.url)
-	if err := conn.Connect(); err != nil {
-		e.logger.Warn("could not connect to socket, RETURNING")
-		return
-	}
-	e.logger.Debug("connected to socket")
-
-	for {
-		var message binanceUSMessage
-		if err := conn.ReadJSON(&message); err != nil {
-			e.logger.Warn(err, " RETURNING")
-			return
-		}
+	streams := []string{fmt.Sprintf("%s@bookTicker", e.symbol)}
+	if e.depth != nil {
+		// top of book is taken from the local book instead of the book ticker
+		streams = []string{fmt.Sprintf("%s@depth@100ms", e.symbol)}
+	}
+	if e.trades != nil {
+		streams = append(streams, fmt.Sprintf("%s@trade", e.symbol))
+	}
+
+	// combined stream, each message is wrapped with the name of its stream
+	conn := ws.New(e.url + strings.Join(streams, "/"))
+	conn.SetKeepalive(keepaliveInterval)
+	conn.SetReadTimeout(readTimeout)
+	conn.SetRateLimit(websocketLimiter("Binance.US"))
+	conn.SetOnConnect(func(c *ws.Client) error {
+		// diffs may have been missed while disconnected
+		e.diff = newBinanceUSDepth(e.symbol)
+		return nil
+	})
+
+	lastUpdate := MarketUpdate{}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
+	})
+	e.fallback.stream(conn, e.logger, func() error {
+		for {
+			_, rawMessage, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+
+			var stream binanceUSStream
+			if err := json.Unmarshal(rawMessage, &stream); err != nil {
+				e.parseErrors.report("message", rawMessage, err)
+				continue
+			}
+
+			if strings.HasSuffix(stream.Stream, "@trade") {
+				var trade binanceUSTrade
+				if err := json.Unmarshal(stream.Data, &trade); err != nil {
+					e.parseErrors.report("trade", stream.Data, err)
+					continue
+				}
+
+				// buyer is the maker, so the taker sold
+				side := Buy
+				if trade.BuyerMaker {
+					side = Sell
+				}
+
+				e.trades <- Trade{
+					Price: trade.Price,
+					Size:  trade.Quantity,
+					Side:  side,
+					ID:    fmt.Sprint(trade.TradeID),
+					Time:  time.UnixMilli(trade.TradeTime),
+					Name:  e.name,
+				}
+				continue
+			}
+
+			if strings.HasSuffix(stream.Stream, "@depth@100ms") {
+				var diff binanceUSDepthUpdate
+				if err := json.Unmarshal(stream.Data, &diff); err != nil {
+					e.parseErrors.report("depth update", stream.Data, err)
+					continue
+				}
 
-		e.updates <- MarketUpdate{
-			Ask:     message.Ask,
-			AskSize: message.AskSize,
-			Bid:     message.Bid,
-			BidSize: message.BidSize,
-			Name:    e.name,
+				changed, err := e.diff.merge(diff)
+				if err != nil {
+					e.logger.Warn("depth book out of sync ", err)
+					// the book is rebuilt from the next snapshot, withdraw
+					// its quote until then
+					if lastUpdate != (MarketUpdate{}) {
+						e.updates <- MarketUpdate{Name: e.name}
+						lastUpdate = MarketUpdate{}
+					}
+					continue
+				}
+				if !changed {
+					continue
+				}
+
+				update := bookUpdate(e.diff.book, e.name)
+				if update != lastUpdate {
+					e.updates <- update
+				}
+				lastUpdate = update
+				e.depth <- e.diff.book.Snapshot(e.name, depthLevels)
+				continue
+			}
+
+			update, err := parseBinanceUSBookTicker(stream.Data)
+			if err != nil {
+				e.parseErrors.report("book ticker", stream.Data, err)
+				continue
+			}
+			update.Name = e.name
+
+			e.updates <- update
 		}
-	}
+	})
 }
 
 func (e *BinanceUS) Updates() chan MarketUpdate {
 	return e.updates
 }
 
+// Access to trade channel, subscribes to the trade stream if called before Recv
+func (e *BinanceUS) Trades() chan Trade {
+	if e.trades == nil {
+		e.trades = make(chan Trade, updateBufSize)
+	}
+	return e.trades
+}
+
+// Access to depth channel, switches to the diff depth stream and maintains
+// a local book if called before Recv
+func (e *BinanceUS) Depth() chan book.Snapshot {
+	if e.depth == nil {
+		e.depth = make(chan book.Snapshot, updateBufSize)
+	}
+	return e.depth
+}
+
 func (e *BinanceUS) Name() string {
 	return e.name
 }
@@ -69,6 +179,27 @@ func (e *BinanceUS) Valid() bool {
 	return e.valid
 }
 
+// Poll the REST book ticker while the websocket is down, must be called before Recv
+func (e *BinanceUS) EnableFallback() {
+	e.fallback = newFallback(e.name, binanceUSFallback, strings.ToUpper(e.symbol), e.updates)
+}
+
+// top of book from a bookTicker payload, shared by Binance.US and Binance USD-M
+func parseBinanceUSBookTicker(data []byte) (MarketUpdate, error) {
+	var message binanceUSMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return MarketUpdate{}, err
+	}
+
+	update := MarketUpdate{
+		Ask:     message.Ask,
+		AskSize: message.AskSize,
+		Bid:     message.Bid,
+		BidSize: message.BidSize,
+	}
+	return update, checkQuote(update)
+}
+
 type binanceUSMessage struct {
 	UpdateID int    `json:"u"`
 	Symbol   string `json:"s"`
@@ -77,3 +208,162 @@ type binanceUSMessage struct {
 	Ask      string `json:"a"`
 	AskSize  string `json:"A"`
 }
+
+type binanceUSStream struct {
+	Stream string          `json:"stream"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// keys differing only by case are all declared, json would otherwise decode
+// E into e and M into m
+type binanceUSTrade struct {
+	EventType  string `json:"e"`
+	EventTime  int64  `json:"E"`
+	Symbol     string `json:"s"`
+	TradeID    int64  `json:"t"`
+	Price      string `json:"p"`
+	Quantity   string `json:"q"`
+	TradeTime  int64  `json:"T"`
+	BuyerMaker bool   `json:"m"`
+	Ignore     bool   `json:"M"`
+}
+
+// Local book maintained from the diff depth stream and a REST snapshot,
+// aligned by update id following Binance's rules
+type binanceUSDepth struct {
+	symbol       string
+	book         *book.Book
+	lastUpdateId int64
+	synced       bool
+	buffer       []binanceUSDepthUpdate
+	schedule     *snapshotSchedule
+	// REST snapshot of the book, replaced in tests
+	snapshot func() (binanceUSDepthSnapshot, error)
+}
+
+func newBinanceUSDepth(symbol string) *binanceUSDepth {
+	d := &binanceUSDepth{
+		symbol:   symbol,
+		book:     book.New(),
+		schedule: newSnapshotSchedule(),
+	}
+	d.snapshot = d.fetchSnapshot
+	return d
+}
+
+// merge a diff into the book, buffering diffs until a snapshot has been
+// applied. Returns true if the book changed, an error if the book lost sync
+func (d *binanceUSDepth) merge(diff binanceUSDepthUpdate) (bool, error) {
+	if d.synced {
+		return d.apply(diff)
+	}
+
+	d.buffer = append(d.buffer, diff)
+	if len(d.buffer) > maxBufferedDiffs {
+		d.buffer = d.buffer[len(d.buffer)-maxBufferedDiffs:]
+	}
+	if !d.schedule.due() {
+		return false, nil
+	}
+
+	if err := d.sync(); err != nil {
+		d.schedule.failed()
+		return false, err
+	}
+	if !d.synced {
+		d.schedule.failed()
+		return false, nil
+	}
+
+	d.schedule.reset()
+	return true, nil
+}
+
+// apply a diff to a synced book, a gap or malformed diff drops the book
+// out of sync
+func (d *binanceUSDepth) apply(diff binanceUSDepthUpdate) (bool, error) {
+	if diff.FinalUpdateId <= d.lastUpdateId {
+		return false, nil
+	}
+
+	// the first diff after a snapshot may straddle it, every later diff
+	// must start exactly where the previous one ended
+	if diff.FirstUpdateId > d.lastUpdateId+1 {
+		d.synced = false
+		d.buffer = []binanceUSDepthUpdate{diff}
+		return false, fmt.Errorf("update id gap: expected %d, received %d", d.lastUpdateId+1, diff.FirstUpdateId)
+	}
+
+	if err := setLevels(d.book, book.Bid, diff.Bids); err != nil {
+		d.synced = false
+		d.buffer = nil
+		return false, err
+	}
+	if err := setLevels(d.book, book.Ask, diff.Asks); err != nil {
+		d.synced = false
+		d.buffer = nil
+		return false, err
+	}
+
+	d.lastUpdateId = diff.FinalUpdateId
+	return true, nil
+}
+
+// rebuild the book from a snapshot and replay the buffered diffs on top of
+// it. The book stays out of sync if the snapshot is older than the buffer
+func (d *binanceUSDepth) sync() error {
+	snapshot, err := d.snapshot()
+	if err != nil {
+		return err
+	}
+
+	if snapshot.LastUpdateId < d.buffer[0].FirstUpdateId-1 {
+		return nil
+	}
+
+	d.book.Clear()
+	if err := setLevels(d.book, book.Bid, snapshot.Bids); err != nil {
+		return err
+	}
+	if err := setLevels(d.book, book.Ask, snapshot.Asks); err != nil {
+		return err
+	}
+
+	d.lastUpdateId = snapshot.LastUpdateId
+	d.synced = true
+
+	buffered := d.buffer
+	d.buffer = nil
+	for i, diff := range buffered {
+		if _, err := d.apply(diff); err != nil {
+			// keep the diffs after the gap for the next snapshot
+			d.buffer = append(d.buffer, buffered[i+1:]...)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *binanceUSDepth) fetchSnapshot() (binanceUSDepthSnapshot, error) {
+	var snapshot binanceUSDepthSnapshot
+	url := fmt.Sprintf("https://api.binance.us/api/v3/depth?symbol=%s&limit=1000", strings.ToUpper(d.symbol))
+	err := getJSON(restLimiter("Binance.US", 0), url, &snapshot)
+	return snapshot, err
+}
+
+type binanceUSDepthUpdate struct {
+	EventType     string     `json:"e"`
+	EventTime     int64      `json:"E"`
+	Symbol        string     `json:"s"`
+	FirstUpdateId int64      `json:"U"`
+	FinalUpdateId int64      `json:"u"`
+	Bids          [][]string `json:"b"`
+	Asks          [][]string `json:"a"`
+}
+
+type binanceUSDepthSnapshot struct {
+	LastUpdateId int64      `json:"lastUpdateId"`
+	Bids         [][]string `json:"bids"`
+	Asks         [][]string `json:"asks"`
+}
@@ -0,0 +1,184 @@
+package exchange
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseBinanceUSBookTicker(t *testing.T) {
+	update, err := parseBinanceUSBookTicker(fixture(t, "binanceus/book_ticker.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := MarketUpdate{
+		Bid: "27012.55000000", BidSize: "0.04420000",
+		Ask: "27014.16000000", AskSize: "0.11012000",
+	}
+	if update != want {
+		t.Errorf("parsed %+v, expected %+v", update, want)
+	}
+}
+
+func FuzzParseBinanceUS(f *testing.F) {
+	f.Add(fixture(f, "binanceus/book_ticker.json"))
+	f.Add([]byte(`{"u":3619847213,"s":"BTCUSDT","b":"","B":"","a":"","A":""}`))
+	f.Add([]byte(`{"u":"3619847213","b":27012.55}`))
+	f.Add([]byte(`{"result":null,"id":1}`))
+	f.Add([]byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		update, err := parseBinanceUSBookTicker(data)
+		if err != nil {
+			return
+		}
+		requireNumbers(t, data, update.Bid, update.BidSize, update.Ask, update.AskSize)
+
+		// fields differ only by case, prices and sizes must not be swapped
+		if update.Bid != jsonField(data, "b") || update.BidSize != jsonField(data, "B") ||
+			update.Ask != jsonField(data, "a") || update.AskSize != jsonField(data, "A") {
+			t.Errorf("parsed %+v from %s", update, data)
+		}
+	})
+}
+
+func depthDiff(first, last int64, bids ...[]string) binanceUSDepthUpdate {
+	return binanceUSDepthUpdate{FirstUpdateId: first, FinalUpdateId: last, Bids: bids}
+}
+
+func TestBinanceUSDepthAlignment(t *testing.T) {
+	type step struct {
+		diff binanceUSDepthUpdate
+		// the snapshot backoff has elapsed
+		retry    bool
+		changed  bool
+		err      bool
+		synced   bool
+		lastId   int64
+		buffered int
+	}
+
+	tests := []struct {
+		name      string
+		snapshots []binanceUSDepthSnapshot
+		steps     []step
+		fetches   int
+		bid       string
+	}{
+		{
+			name: "diffs up to the snapshot are dropped, the straddling diff is applied",
+			snapshots: []binanceUSDepthSnapshot{
+				{LastUpdateId: 100, Bids: [][]string{{"100", "1"}}},
+			},
+			steps: []step{
+				{diff: depthDiff(95, 99, []string{"99", "1"}), changed: true, synced: true, lastId: 100},
+				{diff: depthDiff(100, 102, []string{"101", "2"}), changed: true, synced: true, lastId: 102},
+				{diff: depthDiff(101, 102, []string{"103", "1"}), synced: true, lastId: 102},
+				{diff: depthDiff(103, 103, []string{"101", "0"}), changed: true, synced: true, lastId: 103},
+			},
+			fetches: 1,
+			bid:     "100",
+		},
+		{
+			name: "an outdated snapshot is retried after the backoff",
+			snapshots: []binanceUSDepthSnapshot{
+				{LastUpdateId: 90},
+				{LastUpdateId: 105, Bids: [][]string{{"100", "1"}}},
+			},
+			steps: []step{
+				{diff: depthDiff(95, 99), buffered: 1},
+				{diff: depthDiff(100, 101), buffered: 2},
+				{diff: depthDiff(102, 106, []string{"102", "1"}), retry: true, changed: true, synced: true, lastId: 106},
+			},
+			fetches: 2,
+			bid:     "102",
+		},
+		{
+			name: "a gap drops the book out of sync until the next snapshot",
+			snapshots: []binanceUSDepthSnapshot{
+				{LastUpdateId: 100, Bids: [][]string{{"100", "1"}}},
+				{LastUpdateId: 110, Bids: [][]string{{"99", "1"}}},
+			},
+			steps: []step{
+				{diff: depthDiff(101, 105), changed: true, synced: true, lastId: 105},
+				{diff: depthDiff(107, 108), err: true, lastId: 105, buffered: 1},
+				{diff: depthDiff(109, 110), changed: true, synced: true, lastId: 110},
+			},
+			fetches: 2,
+			bid:     "99",
+		},
+		{
+			name: "a gap in the buffered diffs keeps the later diffs",
+			snapshots: []binanceUSDepthSnapshot{
+				{LastUpdateId: 90},
+				{LastUpdateId: 100, Bids: [][]string{{"100", "1"}}},
+			},
+			steps: []step{
+				{diff: depthDiff(95, 100), buffered: 1},
+				{diff: depthDiff(103, 104), buffered: 2},
+				{diff: depthDiff(105, 106), retry: true, err: true, lastId: 100, buffered: 2},
+			},
+			fetches: 2,
+			bid:     "100",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newBinanceUSDepth("btcusdt")
+			fetches := 0
+			d.snapshot = func() (binanceUSDepthSnapshot, error) {
+				if fetches == len(test.snapshots) {
+					t.Fatal("unexpected snapshot request")
+				}
+				fetches++
+				return test.snapshots[fetches-1], nil
+			}
+
+			for i, s := range test.steps {
+				if s.retry {
+					d.schedule.reset()
+				}
+				changed, err := d.merge(s.diff)
+				if (err != nil) != s.err {
+					t.Fatalf("step %d: error %v", i, err)
+				}
+				if changed != s.changed || d.synced != s.synced || d.lastUpdateId != s.lastId || len(d.buffer) != s.buffered {
+					t.Errorf("step %d: changed %t, synced %t, last update id %d, %d buffered, expected %t, %t, %d, %d",
+						i, changed, d.synced, d.lastUpdateId, len(d.buffer), s.changed, s.synced, s.lastId, s.buffered)
+				}
+			}
+
+			if fetches != test.fetches {
+				t.Errorf("%d snapshots requested, expected %d", fetches, test.fetches)
+			}
+			if bid, _ := d.book.Top(); bid.Price != test.bid {
+				t.Errorf("best bid %s, expected %s", bid.Price, test.bid)
+			}
+		})
+	}
+}
+
+func TestBinanceUSDepthBufferCap(t *testing.T) {
+	d := newBinanceUSDepth("btcusdt")
+	fetches := 0
+	d.snapshot = func() (binanceUSDepthSnapshot, error) {
+		fetches++
+		return binanceUSDepthSnapshot{}, errors.New("unavailable")
+	}
+
+	for i := int64(1); i <= maxBufferedDiffs+10; i++ {
+		d.merge(depthDiff(i, i))
+	}
+
+	if len(d.buffer) != maxBufferedDiffs {
+		t.Errorf("%d diffs buffered, expected %d", len(d.buffer), maxBufferedDiffs)
+	}
+	if first := d.buffer[0].FirstUpdateId; first != 11 {
+		t.Errorf("oldest buffered diff starts at %d, expected 11", first)
+	}
+	// the failed snapshot is not requested again on every diff
+	if fetches != 1 {
+		t.Errorf("%d snapshots requested, expected 1", fetches)
+	}
+}
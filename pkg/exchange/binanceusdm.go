@@ -0,0 +1,176 @@
+// Aggregate top of book, mark price and funding for a perpetual listed on
+// Binance USD-M futures
+
+package exchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
+)
+
+type BinanceUSDM struct {
+	updates     chan MarketUpdate
+	perp        perpState
+	contract    symbol.Contract
+	url         string
+	name        string
+	symbol      string
+	valid       bool
+	parseErrors *parseReporter
+	logger      *logger.Logger
+}
+
+// Create new BinanceUSDM struct
+func NewBinanceUSDM(perps symbol.Perpetuals) *BinanceUSDM {
+	c := make(chan MarketUpdate, updateBufSize)
+	name := fmt.Sprintf("Binance USD-M: %s", perps.BinanceUSDM.Symbol)
+	logger := logger.Named(name)
+
+	return &BinanceUSDM{
+		updates:     c,
+		contract:    perps.BinanceUSDM,
+		url:         "wss://fstream.binance.com/stream?streams=",
+		name:        name,
+		symbol:      strings.ToLower(perps.BinanceUSDM.Symbol),
+		valid:       perps.BinanceUSDM.Symbol != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
+	}
+}
+
+// Receive book ticker data from Binance USD-M, send any top of book updates
+// over the updates channel as a MarketUpdate struct
+func (e *BinanceUSDM) Recv() {
+	e.logger.Debug("connecting to socket")
+	streams := []string{fmt.Sprintf("%s@bookTicker", e.symbol)}
+	if e.perp.perps != nil {
+		// mark price, index price and funding rate every second
+		streams = append(streams, fmt.Sprintf("%s@markPrice@1s", e.symbol))
+	}
+
+	conn := ws.New(e.url + strings.Join(streams, "/"))
+	conn.SetKeepalive(keepaliveInterval)
+	conn.SetReadTimeout(readTimeout)
+	conn.SetRateLimit(websocketLimiter("Binance USD-M"))
+	if err := conn.Connect(); err != nil {
+		e.logger.Warn("could not connect to socket, RETURNING")
+		return
+	}
+	e.logger.Debug("connected to socket")
+
+	lastUpdate := MarketUpdate{}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
+	})
+	for {
+		_, rawMessage, err := conn.ReadMessage()
+		if err != nil {
+			e.logger.Warn(err, " RETURNING")
+			return
+		}
+
+		var stream binanceUSStream
+		if err := json.Unmarshal(rawMessage, &stream); err != nil {
+			e.parseErrors.report("message", rawMessage, err)
+			continue
+		}
+
+		if strings.HasSuffix(stream.Stream, "@markPrice@1s") {
+			mark, err := parseBinanceUSDMMarkPrice(stream.Data)
+			if err != nil {
+				e.parseErrors.report("mark price", stream.Data, err)
+				continue
+			}
+
+			mark.MarketUpdate = e.perp.latest.MarketUpdate
+			e.perp.latest = mark
+			e.perp.send()
+			continue
+		}
+
+		update, err := parseBinanceUSBookTicker(stream.Data)
+		if err != nil {
+			e.parseErrors.report("book ticker", stream.Data, err)
+			continue
+		}
+		update.Name = e.name
+
+		if update != lastUpdate {
+			e.updates <- update
+		}
+		lastUpdate = update
+
+		e.perp.latest.MarketUpdate = update
+		e.perp.send()
+	}
+}
+
+// Name of data source
+func (e *BinanceUSDM) Name() string {
+	return e.name
+}
+
+// Access to update channel
+func (e *BinanceUSDM) Updates() chan MarketUpdate {
+	return e.updates
+}
+
+func (e *BinanceUSDM) Valid() bool {
+	return e.valid
+}
+
+// Contract specification of the perpetual
+func (e *BinanceUSDM) Contract() symbol.Contract {
+	return e.contract
+}
+
+// Access to perpetual channel, subscribes to the mark price stream if called before Recv
+func (e *BinanceUSDM) Perpetual() chan PerpUpdate {
+	return e.perp.channel()
+}
+
+// mark price, index price and funding of a markPrice update, the quote is
+// left empty
+func parseBinanceUSDMMarkPrice(data []byte) (PerpUpdate, error) {
+	var mark binanceUSDMMarkPrice
+	if err := json.Unmarshal(data, &mark); err != nil {
+		return PerpUpdate{}, err
+	}
+
+	for _, price := range []string{mark.MarkPrice, mark.IndexPrice} {
+		if p, err := parseNumber(price); err != nil || p <= 0 {
+			return PerpUpdate{}, fmt.Errorf("invalid price %q", price)
+		}
+	}
+	if _, err := parseNumber(mark.FundingRate); err != nil {
+		return PerpUpdate{}, fmt.Errorf("invalid funding rate %q", mark.FundingRate)
+	}
+
+	return PerpUpdate{
+		MarkPrice:   mark.MarkPrice,
+		IndexPrice:  mark.IndexPrice,
+		FundingRate: mark.FundingRate,
+		NextFunding: time.UnixMilli(mark.NextFundingTime),
+	}, nil
+}
+
+// keys differing only by case are all declared, json would otherwise decode
+// E into e and the estimated settle price P into the mark price p
+type binanceUSDMMarkPrice struct {
+	EventType       string `json:"e"`
+	EventTime       int64  `json:"E"`
+	Symbol          string `json:"s"`
+	MarkPrice       string `json:"p"`
+	SettlePrice     string `json:"P"`
+	IndexPrice      string `json:"i"`
+	FundingRate     string `json:"r"`
+	NextFundingTime int64  `json:"T"`
+}
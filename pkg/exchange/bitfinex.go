@@ -0,0 +1,413 @@
+// Aggregate top of book updates from a currency pair listed on Bitfinex.
+// Bitfinex sends data as arrays keyed by channel id rather than json objects
+
+package exchange
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
+)
+
+// conf flag requesting a checksum message after every book update
+const bitfinexChecksumFlag = 131072
+
+// number of levels per side covered by the checksum
+const bitfinexChecksumLevels = 25
+
+// heartbeats are sent on every channel once every 15 seconds
+const bitfinexReadTimeout = 30 * time.Second
+
+type Bitfinex struct {
+	updates     chan MarketUpdate
+	trades      chan Trade
+	depth       chan book.Snapshot
+	url         string
+	name        string
+	symbol      string
+	valid       bool
+	channels    map[int64]string
+	book        *book.Book
+	synced      bool
+	fallback    *fallback
+	parseErrors *parseReporter
+	logger      *logger.Logger
+}
+
+// Create new Bitfinex struct
+func NewBitfinex(pair symbol.CurrencyPair) *Bitfinex {
+	c := make(chan MarketUpdate, updateBufSize)
+	name := fmt.Sprintf("Bitfinex: %s", pair.Bitfinex)
+	logger := logger.Named(name)
+
+	return &Bitfinex{
+		updates:     c,
+		url:         "wss://api-pub.bitfinex.com/ws/2",
+		name:        name,
+		symbol:      pair.Bitfinex,
+		valid:       pair.Bitfinex != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
+	}
+}
+
+// Receive book data from Bitfinex, send any top of book updates
+// over the updates channel as a MarketUpdate struct
+func (e *Bitfinex) Recv() {
+	e.logger.Debug("connecting to socket")
+	conn := ws.New(e.url)
+	conn.SetCompression(true)
+	conn.SetReadTimeout(bitfinexReadTimeout)
+
+	conn.SetOnConnect(func(c *ws.Client) error {
+		// channel ids are assigned per connection
+		e.channels = make(map[int64]string)
+		e.book = book.New()
+		e.synced = false
+
+		err := c.WriteJSON(bitfinexConf{
+			Event: "conf",
+			Flags: bitfinexChecksumFlag,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := c.WriteJSON(e.bookSubscription()); err != nil {
+			return err
+		}
+
+		if e.trades != nil {
+			return c.WriteJSON(bitfinexSubscription{
+				Event:   "subscribe",
+				Channel: "trades",
+				Symbol:  e.symbol,
+			})
+		}
+
+		return nil
+	})
+
+	lastUpdate := MarketUpdate{}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
+	})
+	e.fallback.stream(conn, e.logger, func() error {
+		for {
+			_, rawMessage, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+
+			rawMessage = bytes.TrimSpace(rawMessage)
+			if len(rawMessage) == 0 {
+				continue
+			}
+
+			// events are json objects, channel data are arrays
+			if rawMessage[0] == '{' {
+				e.handleEvent(rawMessage)
+				continue
+			}
+
+			var message []json.RawMessage
+			if err := json.Unmarshal(rawMessage, &message); err != nil {
+				e.parseErrors.report("message", rawMessage, err)
+				continue
+			}
+			if len(message) < 2 {
+				e.parseErrors.report("message", rawMessage, errors.New("missing channel payload"))
+				continue
+			}
+
+			var chanId int64
+			if err := json.Unmarshal(message[0], &chanId); err != nil {
+				e.parseErrors.report("channel id", rawMessage, err)
+				continue
+			}
+
+			switch e.channels[chanId] {
+			case "book":
+				changed, err := e.handleBook(message[1:])
+				if err != nil {
+					// withdraw the quote and rebuild the book from a new snapshot
+					e.logger.Warn("book out of sync ", err)
+					e.updates <- MarketUpdate{Name: e.name}
+					lastUpdate = MarketUpdate{}
+					e.synced = false
+					e.book.Clear()
+
+					// a failed write closes the connection, which the
+					// stream reconnects and resubscribes
+					err := conn.WriteJSON(bitfinexUnsubscribe{Event: "unsubscribe", ChanId: chanId})
+					if err != nil {
+						return err
+					}
+					if err := conn.WriteJSON(e.bookSubscription()); err != nil {
+						return err
+					}
+					continue
+				}
+				if !changed {
+					continue
+				}
+
+				update := bookUpdate(e.book, e.name)
+				if update != lastUpdate {
+					e.updates <- update
+				}
+				lastUpdate = update
+				if e.depth != nil {
+					e.depth <- e.book.Snapshot(e.name, depthLevels)
+				}
+			case "trades":
+				e.handleTrades(message[1:])
+			default:
+				e.logger.Debug("message for unknown channel ", chanId)
+			}
+		}
+	})
+}
+
+// Name of data source
+func (e *Bitfinex) Name() string {
+	return e.name
+}
+
+// Access to update channel
+func (e *Bitfinex) Updates() chan MarketUpdate {
+	return e.updates
+}
+
+func (e *Bitfinex) Valid() bool {
+	return e.valid
+}
+
+// Poll the REST ticker while the websocket is down, must be called before Recv
+func (e *Bitfinex) EnableFallback() {
+	e.fallback = newFallback(e.name, bitfinexFallback, e.symbol, e.updates)
+}
+
+// Access to trade channel, subscribes to the trades channel if called before Recv
+func (e *Bitfinex) Trades() chan Trade {
+	if e.trades == nil {
+		e.trades = make(chan Trade, updateBufSize)
+	}
+	return e.trades
+}
+
+// Access to depth channel, publishes the local book if called before Recv
+func (e *Bitfinex) Depth() chan book.Snapshot {
+	if e.depth == nil {
+		e.depth = make(chan book.Snapshot, updateBufSize)
+	}
+	return e.depth
+}
+
+func (e *Bitfinex) bookSubscription() bitfinexSubscription {
+	return bitfinexSubscription{
+		Event:   "subscribe",
+		Channel: "book",
+		Symbol:  e.symbol,
+		Prec:    "P0",
+		Freq:    "F0",
+		Len:     fmt.Sprint(bitfinexChecksumLevels),
+	}
+}
+
+// track channel ids from subscription events
+func (e *Bitfinex) handleEvent(rawMessage []byte) {
+	var event bitfinexEvent
+	if err := json.Unmarshal(rawMessage, &event); err != nil {
+		e.parseErrors.report("event", rawMessage, err)
+		return
+	}
+
+	switch event.Event {
+	case "subscribed":
+		e.channels[event.ChanId] = event.Channel
+	case "unsubscribed":
+		delete(e.channels, event.ChanId)
+	case "error":
+		e.logger.Warn("error event ", event.Code, " ", event.Msg)
+	case "info", "conf":
+		e.logger.Debug(string(rawMessage))
+	}
+}
+
+// apply a book channel payload: heartbeat, checksum, snapshot or single level update.
+// Returns true if the book changed
+func (e *Bitfinex) handleBook(payload []json.RawMessage) (bool, error) {
+	var kind string
+	if json.Unmarshal(payload[0], &kind) == nil {
+		switch kind {
+		case "hb":
+			return false, nil
+		case "cs":
+			if len(payload) < 2 || !e.synced {
+				return false, nil
+			}
+
+			var checksum int32
+			if err := json.Unmarshal(payload[1], &checksum); err != nil {
+				return false, err
+			}
+			if expected := e.checksum(); expected != checksum {
+				return false, fmt.Errorf("checksum mismatch: expected %d, received %d", expected, checksum)
+			}
+			return false, nil
+		}
+
+		return false, nil
+	}
+
+	var levels [][]json.Number
+	if err := json.Unmarshal(payload[0], &levels); err == nil {
+		// snapshot
+		e.book.Clear()
+		for _, level := range levels {
+			if err := e.setLevel(level); err != nil {
+				return false, err
+			}
+		}
+		e.synced = true
+		return true, nil
+	}
+
+	var level []json.Number
+	if err := json.Unmarshal(payload[0], &level); err != nil {
+		return false, err
+	}
+	if !e.synced {
+		return false, nil
+	}
+
+	return true, e.setLevel(level)
+}
+
+// apply a [price, count, amount] level, positive amounts are bids
+func (e *Bitfinex) setLevel(level []json.Number) error {
+	if len(level) < 3 {
+		return fmt.Errorf("malformed level %v", level)
+	}
+
+	price := level[0].String()
+	amount := level[2].String()
+	side := book.Bid
+	if strings.HasPrefix(amount, "-") {
+		side = book.Ask
+		amount = strings.TrimPrefix(amount, "-")
+	}
+
+	if level[1].String() == "0" {
+		// a count of zero removes the level, amount is 1 or -1
+		return e.book.Set(side, price, "0")
+	}
+
+	return e.book.Set(side, price, amount)
+}
+
+// crc32 of the top levels of the book, interleaving bids and asks as
+// price:amount pairs with asks as negative amounts
+func (e *Bitfinex) checksum() int32 {
+	bids := e.book.Bids(bitfinexChecksumLevels)
+	asks := e.book.Asks(bitfinexChecksumLevels)
+
+	var parts []string
+	for i := 0; i < bitfinexChecksumLevels; i++ {
+		if i < len(bids) {
+			parts = append(parts, bids[i].Price, bids[i].Size)
+		}
+		if i < len(asks) {
+			parts = append(parts, asks[i].Price, "-"+asks[i].Size)
+		}
+	}
+
+	return int32(crc32.ChecksumIEEE([]byte(strings.Join(parts, ":"))))
+}
+
+// send executed trades, snapshots of past trades and trade updates are ignored
+func (e *Bitfinex) handleTrades(payload []json.RawMessage) {
+	var kind string
+	if json.Unmarshal(payload[0], &kind) != nil || kind != "te" || len(payload) < 2 {
+		return
+	}
+
+	trade, err := parseBitfinexTrade(payload[1])
+	if err != nil {
+		e.parseErrors.report("trade", payload[1], err)
+		return
+	}
+	trade.Name = e.name
+	e.trades <- trade
+}
+
+// trade of a [id, timestamp, amount, price] array, a negative amount is a sell
+func parseBitfinexTrade(data []byte) (Trade, error) {
+	var fields []json.Number
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return Trade{}, err
+	}
+	if len(fields) < 4 {
+		return Trade{}, fmt.Errorf("malformed trade %v", fields)
+	}
+
+	side := Buy
+	size := fields[2].String()
+	if strings.HasPrefix(size, "-") {
+		side = Sell
+		size = strings.TrimPrefix(size, "-")
+	}
+
+	ms, err := fields[1].Int64()
+	if err != nil {
+		return Trade{}, err
+	}
+
+	trade := Trade{
+		Price: fields[3].String(),
+		Size:  size,
+		Side:  side,
+		ID:    fields[0].String(),
+		Time:  time.UnixMilli(ms),
+	}
+	return trade, checkTrade(trade)
+}
+
+type bitfinexConf struct {
+	Event string `json:"event"`
+	Flags int    `json:"flags"`
+}
+
+type bitfinexSubscription struct {
+	Event   string `json:"event"`
+	Channel string `json:"channel"`
+	Symbol  string `json:"symbol"`
+	Prec    string `json:"prec,omitempty"`
+	Freq    string `json:"freq,omitempty"`
+	Len     string `json:"len,omitempty"`
+}
+
+type bitfinexUnsubscribe struct {
+	Event  string `json:"event"`
+	ChanId int64  `json:"chanId"`
+}
+
+type bitfinexEvent struct {
+	Event   string `json:"event"`
+	Channel string `json:"channel"`
+	ChanId  int64  `json:"chanId"`
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+}
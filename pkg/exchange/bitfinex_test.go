@@ -0,0 +1,124 @@
+package exchange
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+)
+
+func TestBitfinexChecksumMismatch(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	url := newVenueServer(t, func(conn *websocket.Conn) {
+		var conf bitfinexConf
+		readRequest(t, conn, &conf)
+		var subscription bitfinexSubscription
+		readRequest(t, conn, &subscription)
+		if subscription.Channel != "book" || subscription.Symbol != "tBTCUSD" {
+			t.Errorf("received %+v, expected to subscribe to the tBTCUSD book", subscription)
+		}
+
+		send(t, conn,
+			fixture(t, "bitfinex/info.json"),
+			fixture(t, "bitfinex/conf.json"),
+			fixture(t, "bitfinex/subscribed.json"),
+			fixture(t, "bitfinex/snapshot.json"),
+			fixture(t, "bitfinex/checksum_mismatch.json"),
+		)
+
+		// the book is resubscribed for a new snapshot
+		var unsubscribe bitfinexUnsubscribe
+		readRequest(t, conn, &unsubscribe)
+		if unsubscribe.Event != "unsubscribe" || unsubscribe.ChanId != 17082 {
+			t.Errorf("received %+v, expected to unsubscribe from channel 17082", unsubscribe)
+		}
+		readRequest(t, conn, &subscription)
+		if subscription.Event != "subscribe" || subscription.Channel != "book" {
+			t.Errorf("received %+v, expected to subscribe to the book", subscription)
+		}
+
+		send(t, conn,
+			fixture(t, "bitfinex/unsubscribed.json"),
+			fixture(t, "bitfinex/resubscribed.json"),
+			fixture(t, "bitfinex/resnapshot.json"),
+		)
+		<-done
+	})
+
+	e := NewBitfinex(symbol.CurrencyPair{Bitfinex: "tBTCUSD"})
+	e.url = url
+	go e.Recv()
+
+	expected := []MarketUpdate{
+		{
+			Bid: "27012", BidSize: "0.6255",
+			Ask: "27013", AskSize: "0.8411",
+			Name: "Bitfinex: tBTCUSD",
+		},
+		// withdrawn until the new snapshot
+		{Name: "Bitfinex: tBTCUSD"},
+		{
+			Bid: "27015", BidSize: "0.3",
+			Ask: "27016", AskSize: "0.45",
+			Name: "Bitfinex: tBTCUSD",
+		},
+	}
+	for i, want := range expected {
+		if update := receive(t, e.Updates()); update != want {
+			t.Errorf("update %d: received %+v, expected %+v", i, update, want)
+		}
+	}
+}
+
+func FuzzParseBitfinex(f *testing.F) {
+	f.Add(fixture(f, "bitfinex/snapshot.json"))
+	f.Add(fixture(f, "bitfinex/checksum_mismatch.json"))
+	f.Add([]byte(`[17082,[27012,0,1]]`))
+	f.Add([]byte(`[17082,"hb"]`))
+	f.Add([]byte(`[17083,"te",[1376834913,1683037867801,-0.01,27013]]`))
+	f.Add([]byte(`[17083,"te",[1376834913,1683037867801,0.01]]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var message []json.RawMessage
+		if err := json.Unmarshal(data, &message); err != nil || len(message) < 2 {
+			return
+		}
+
+		e := &Bitfinex{book: book.New()}
+		if _, err := e.handleBook(message[1:]); err == nil {
+			// [price, count, amount] levels, asks have negative amounts
+			var sent [][]json.Number
+			json.Unmarshal(message[1], &sent)
+			var bids, asks [][]string
+			for _, level := range sent {
+				if len(level) < 3 {
+					continue
+				}
+				amount := level[2].String()
+				if strings.HasPrefix(amount, "-") {
+					asks = append(asks, []string{level[0].String(), strings.TrimPrefix(amount, "-")})
+				} else {
+					bids = append(bids, []string{level[0].String(), amount})
+				}
+			}
+			requireLevels(t, data, e.book.Bids(0), bids)
+			requireLevels(t, data, e.book.Asks(0), asks)
+		}
+
+		if len(message) < 3 {
+			return
+		}
+		if trade, err := parseBitfinexTrade(message[2]); err == nil {
+			var sent []json.Number
+			json.Unmarshal(message[2], &sent)
+			if sell := strings.HasPrefix(sent[2].String(), "-"); sell != (trade.Side == Sell) {
+				t.Errorf("parsed a %s from amount %s in %s", trade.Side, sent[2], data)
+			}
+		}
+	})
+}
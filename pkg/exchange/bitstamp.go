@@ -3,7 +3,11 @@
 package exchange
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
@@ -11,78 +15,129 @@ import (
 )
 
 type Bitstamp struct {
-	updates chan MarketUpdate
-	url     string
-	name    string
-	symbol  string
-	valid   bool
-	logger  *logger.Logger
+	updates     chan MarketUpdate
+	trades      chan Trade
+	url         string
+	name        string
+	symbol      string
+	valid       bool
+	fallback    *fallback
+	parseErrors *parseReporter
+	logger      *logger.Logger
 }
 
 func NewBitstamp(pair symbol.CurrencyPair) *Bitstamp {
 	c := make(chan MarketUpdate, updateBufSize)
 	name := fmt.Sprintf("Bitstamp: %s", pair.Bitstamp)
+	logger := logger.Named(name)
 
 	return &Bitstamp{
-		updates: c,
-		url:     "wss://ws.bitstamp.net",
-		symbol:  pair.Bitstamp,
-		name:    name,
-		valid:   pair.Bitstamp != "",
-		logger:  logger.Named(name),
+		updates:     c,
+		url:         "wss://ws.bitstamp.net",
+		symbol:      pair.Bitstamp,
+		name:        name,
+		valid:       pair.Bitstamp != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
 	}
 }
 
 func (e *Bitstamp) Recv() {
 	e.logger.Debug("connecting to socket")
 	conn := ws.New(e.url)
+	conn.SetKeepalive(keepaliveInterval)
+	conn.SetReadTimeout(readTimeout)
+
+	channels := []string{fmt.Sprintf("order_book_%s", e.symbol)}
+	if e.trades != nil {
+		channels = append(channels, fmt.Sprintf("live_trades_%s", e.symbol))
+	}
 
 	conn.SetOnConnect(func(c *ws.Client) error {
-		err := c.WriteJSON(bitstampSubscription{
-			bitstampMessage: bitstampMessage{
-				Event: "bts:subscribe",
-			},
-			Data: map[string]string{
-				"channel": fmt.Sprintf("order_book_%s", e.symbol),
-			},
-		})
-
-		if err != nil {
-			e.logger.Info(err)
-			return err
+		for _, channel := range channels {
+			err := c.WriteJSON(bitstampSubscription{
+				bitstampMessage: bitstampMessage{
+					Event: "bts:subscribe",
+				},
+				Data: map[string]string{
+					"channel": channel,
+				},
+			})
+
+			if err != nil {
+				e.logger.Info(err)
+				return err
+			}
 		}
 
-		var subcribtionAck bitstampMessage
-		return c.ReadJSON(&subcribtionAck)
+		// acks are skipped with the other events, data may arrive before them
+		return nil
 	})
 
-	if err := conn.Connect(); err != nil {
-		e.logger.Warn("Could not connect to socket, RETURNING")
-		return
-	}
-	e.logger.Debug("connected to socket")
-
 	lastUpdate := MarketUpdate{}
-	for {
-		var message bitstampOrderBook
-		if err := conn.ReadJSON(&message); err != nil {
-			e.logger.Warn(err, " RETURNING")
-			return
-		}
-
-		update := MarketUpdate{
-			Bid:     message.Data.Bids[0][0],
-			BidSize: message.Data.Bids[0][1],
-			Ask:     message.Data.Asks[0][0],
-			AskSize: message.Data.Asks[0][1],
-			Name:    e.name,
-		}
-
-		if update != lastUpdate {
-			e.updates <- update
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
+	})
+	e.fallback.stream(conn, e.logger, func() error {
+		for {
+			_, rawMessage, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+
+			var event bitstampMessage
+			if err := json.Unmarshal(rawMessage, &event); err != nil {
+				e.parseErrors.report("message", rawMessage, err)
+				continue
+			}
+
+			if event.Event == "trade" && strings.HasPrefix(event.Channel, "live_trades_") {
+				var message bitstampTrade
+				if err := json.Unmarshal(rawMessage, &message); err != nil {
+					e.parseErrors.report("trade", rawMessage, err)
+					continue
+				}
+
+				side := Buy
+				if message.Data.Type == 1 {
+					side = Sell
+				}
+
+				micros, err := strconv.ParseInt(message.Data.Microtimestamp, 10, 64)
+				if err != nil {
+					e.parseErrors.report("trade", rawMessage, err)
+					continue
+				}
+				e.trades <- Trade{
+					Price: message.Data.Price,
+					Size:  message.Data.Amount,
+					Side:  side,
+					ID:    fmt.Sprint(message.Data.Id),
+					Time:  time.UnixMicro(micros),
+					Name:  e.name,
+				}
+				continue
+			}
+
+			if event.Event != "data" {
+				continue
+			}
+
+			update, err := parseBitstampOrderBook(rawMessage)
+			if err != nil {
+				e.parseErrors.report("book", rawMessage, err)
+				continue
+			}
+			update.Name = e.name
+
+			if update != lastUpdate {
+				e.updates <- update
+			}
+			lastUpdate = update
 		}
-		lastUpdate = update
-	}
+	})
 }
 
 func (e *Bitstamp) Name() string {
@@ -97,6 +152,45 @@ func (e *Bitstamp) Valid() bool {
 	return e.valid
 }
 
+// Poll the REST ticker while the websocket is down, must be called before Recv
+func (e *Bitstamp) EnableFallback() {
+	e.fallback = newFallback(e.name, bitstampFallback, e.symbol, e.updates)
+}
+
+// Access to trade channel, subscribes to live trades if called before Recv
+func (e *Bitstamp) Trades() chan Trade {
+	if e.trades == nil {
+		e.trades = make(chan Trade, updateBufSize)
+	}
+	return e.trades
+}
+
+// best bid and ask of an order book snapshot message
+func parseBitstampOrderBook(rawMessage []byte) (MarketUpdate, error) {
+	var message bitstampOrderBook
+	if err := json.Unmarshal(rawMessage, &message); err != nil {
+		return MarketUpdate{}, err
+	}
+
+	bid, bidSize, err := topLevel(message.Data.Bids)
+	if err != nil {
+		return MarketUpdate{}, fmt.Errorf("bids: %w", err)
+	}
+
+	ask, askSize, err := topLevel(message.Data.Asks)
+	if err != nil {
+		return MarketUpdate{}, fmt.Errorf("asks: %w", err)
+	}
+
+	update := MarketUpdate{
+		Bid:     bid,
+		BidSize: bidSize,
+		Ask:     ask,
+		AskSize: askSize,
+	}
+	return update, checkQuote(update)
+}
+
 type bitstampMessage struct {
 	Event   string `json:"event"`
 	Channel string `json:"channel,omitempty"`
@@ -118,3 +212,16 @@ type bitstampOrderBookData struct {
 	Bids           [][]string `json:"bids"`
 	Asks           [][]string `json:"asks"`
 }
+
+type bitstampTrade struct {
+	bitstampMessage
+	Data bitstampTradeData `json:"data"`
+}
+
+type bitstampTradeData struct {
+	Id             int64  `json:"id"`
+	Amount         string `json:"amount_str"`
+	Price          string `json:"price_str"`
+	Type           int    `json:"type"`
+	Microtimestamp string `json:"microtimestamp"`
+}
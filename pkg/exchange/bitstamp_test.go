@@ -0,0 +1,38 @@
+package exchange
+
+import "testing"
+
+func TestParseBitstampOrderBook(t *testing.T) {
+	update, err := parseBitstampOrderBook(fixture(t, "bitstamp/order_book.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := MarketUpdate{
+		Bid: "27011", BidSize: "0.25000000",
+		Ask: "27015", AskSize: "0.04000000",
+	}
+	if update != want {
+		t.Errorf("parsed %+v, expected %+v", update, want)
+	}
+}
+
+func FuzzParseBitstamp(f *testing.F) {
+	f.Add(fixture(f, "bitstamp/order_book.json"))
+	f.Add([]byte(`{"data":{"bids":[],"asks":[["27015","0.04"]]},"channel":"order_book_btcusd","event":"data"}`))
+	f.Add([]byte(`{"data":{"bids":[["27011"]],"asks":[["27015"]]},"event":"data"}`))
+	f.Add([]byte(`{"event":"bts:subscription_succeeded","channel":"order_book_btcusd","data":{}}`))
+	f.Add([]byte(`{"data":{"bids":[[27011,0.25]]}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		update, err := parseBitstampOrderBook(data)
+		if err != nil {
+			return
+		}
+		requireNumbers(t, data, update.Bid, update.BidSize, update.Ask, update.AskSize)
+
+		// the quote is the first level of each side
+		requireSent(t, data, "data.bids.0.0", update.Bid)
+		requireSent(t, data, "data.asks.0.0", update.Ask)
+	})
+}
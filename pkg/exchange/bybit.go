@@ -0,0 +1,255 @@
+// Aggregate top of book updates from a currency pair listed on Bybit spot
+
+package exchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
+)
+
+// Bybit recommends a ping every 20 seconds to keep the connection alive
+const bybitPingInterval = 20 * time.Second
+
+type Bybit struct {
+	updates     chan MarketUpdate
+	trades      chan Trade
+	depth       chan book.Snapshot
+	book        *book.Book
+	url         string
+	name        string
+	symbol      string
+	valid       bool
+	fallback    *fallback
+	parseErrors *parseReporter
+	logger      *logger.Logger
+}
+
+// Create new Bybit struct
+func NewBybit(pair symbol.CurrencyPair) *Bybit {
+	c := make(chan MarketUpdate, updateBufSize)
+	name := fmt.Sprintf("Bybit: %s", pair.Bybit)
+	logger := logger.Named(name)
+
+	return &Bybit{
+		updates:     c,
+		url:         "wss://stream.bybit.com/v5/public/spot",
+		name:        name,
+		symbol:      pair.Bybit,
+		valid:       pair.Bybit != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
+	}
+}
+
+// Receive book data from Bybit, send any top of book updates
+// over the updates channel as a MarketUpdate struct
+func (e *Bybit) Recv() {
+	e.logger.Debug("connecting to socket")
+	conn := ws.New(e.url)
+	conn.SetAppPing(bybitPingInterval, func(c *ws.Client) error {
+		return c.WriteJSON(bybitRequest{Op: "ping"})
+	})
+	conn.SetReadTimeout(2 * bybitPingInterval)
+
+	// level 1 book for the best bid and offer, or 50 levels in depth mode
+	topics := []string{fmt.Sprintf("orderbook.1.%s", e.symbol)}
+	if e.depth != nil {
+		topics = []string{fmt.Sprintf("orderbook.50.%s", e.symbol)}
+	}
+	if e.trades != nil {
+		topics = append(topics, fmt.Sprintf("publicTrade.%s", e.symbol))
+	}
+
+	conn.SetOnConnect(func(c *ws.Client) error {
+		// book is rebuilt from the snapshot sent after subscribing
+		e.book = book.New()
+
+		// the ack is handled by the read loop, data may arrive before it
+		return c.WriteJSON(bybitRequest{
+			Op:   "subscribe",
+			Args: topics,
+		})
+	})
+
+	lastUpdate := MarketUpdate{}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
+	})
+	e.fallback.stream(conn, e.logger, func() error {
+		for {
+			_, rawMessage, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+
+			var message bybitMessage
+			if err := json.Unmarshal(rawMessage, &message); err != nil {
+				e.parseErrors.report("message", rawMessage, err)
+				continue
+			}
+
+			if message.Op == "ping" || message.Op == "pong" {
+				e.logger.Debug("pong received")
+				continue
+			}
+			if message.Op == "subscribe" {
+				if message.Success {
+					e.logger.Debug("subscribed to ", strings.Join(topics, ","))
+				} else {
+					e.logger.Warn("could not subscribe: ", message.RetMsg)
+				}
+				continue
+			}
+
+			switch {
+			case strings.HasPrefix(message.Topic, "publicTrade."):
+				trades, err := parseBybitTrades(message.Data)
+				if err != nil {
+					e.parseErrors.report("trade", rawMessage, err)
+					continue
+				}
+				for _, trade := range trades {
+					trade.Name = e.name
+					e.trades <- trade
+				}
+			case strings.HasPrefix(message.Topic, "orderbook."):
+				if err := mergeBybitBook(e.book, message); err != nil {
+					e.parseErrors.report("book", rawMessage, err)
+					continue
+				}
+
+				update := bookUpdate(e.book, e.name)
+				if update != lastUpdate {
+					e.updates <- update
+				}
+				lastUpdate = update
+				if e.depth != nil {
+					e.depth <- e.book.Snapshot(e.name, depthLevels)
+				}
+			default:
+				e.logger.Info("unidentified message: ", string(rawMessage))
+			}
+		}
+	})
+}
+
+// Name of data source
+func (e *Bybit) Name() string {
+	return e.name
+}
+
+// Access to update channel
+func (e *Bybit) Updates() chan MarketUpdate {
+	return e.updates
+}
+
+func (e *Bybit) Valid() bool {
+	return e.valid
+}
+
+// Poll the REST spot ticker while the websocket is down, must be called before Recv
+func (e *Bybit) EnableFallback() {
+	e.fallback = newFallback(e.name, bybitFallback, e.symbol, e.updates)
+}
+
+// Access to trade channel, subscribes to public trades if called before Recv
+func (e *Bybit) Trades() chan Trade {
+	if e.trades == nil {
+		e.trades = make(chan Trade, updateBufSize)
+	}
+	return e.trades
+}
+
+// Access to depth channel, subscribes to the 50 level book if called before Recv
+func (e *Bybit) Depth() chan book.Snapshot {
+	if e.depth == nil {
+		e.depth = make(chan book.Snapshot, updateBufSize)
+	}
+	return e.depth
+}
+
+// apply an orderbook snapshot or delta to a book
+func mergeBybitBook(b *book.Book, message bybitMessage) error {
+	var data bybitBook
+	if err := json.Unmarshal(message.Data, &data); err != nil {
+		return err
+	}
+
+	if message.Type == "snapshot" {
+		b.Clear()
+	}
+	if err := setLevels(b, book.Bid, data.Bids); err != nil {
+		return err
+	}
+	return setLevels(b, book.Ask, data.Asks)
+}
+
+// trades of a publicTrade message
+func parseBybitTrades(data []byte) ([]Trade, error) {
+	var bybitTrades []bybitTrade
+	if err := json.Unmarshal(data, &bybitTrades); err != nil {
+		return nil, err
+	}
+
+	trades := make([]Trade, 0, len(bybitTrades))
+	for _, t := range bybitTrades {
+		trade := Trade{
+			Price: t.Price,
+			Size:  t.Volume,
+			Side:  strings.ToLower(t.Side),
+			ID:    t.TradeId,
+			Time:  time.UnixMilli(t.Time),
+		}
+		if err := checkTrade(trade); err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+
+	return trades, nil
+}
+
+type bybitRequest struct {
+	Op   string   `json:"op"`
+	Args []string `json:"args,omitempty"`
+}
+
+type bybitResponse struct {
+	Success bool   `json:"success"`
+	RetMsg  string `json:"ret_msg"`
+	Op      string `json:"op"`
+}
+
+type bybitMessage struct {
+	bybitResponse
+	Topic string          `json:"topic"`
+	Type  string          `json:"type"`
+	Ts    int64           `json:"ts"`
+	Data  json.RawMessage `json:"data"`
+}
+
+type bybitBook struct {
+	Symbol   string     `json:"s"`
+	Bids     [][]string `json:"b"`
+	Asks     [][]string `json:"a"`
+	UpdateId int64      `json:"u"`
+	Seq      int64      `json:"seq"`
+}
+
+type bybitTrade struct {
+	Time    int64  `json:"T"`
+	Symbol  string `json:"s"`
+	Side    string `json:"S"`
+	Volume  string `json:"v"`
+	Price   string `json:"p"`
+	TradeId string `json:"i"`
+}
@@ -0,0 +1,111 @@
+package exchange
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+)
+
+func TestBybit(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	subscribed := func(conn *websocket.Conn) {
+		var request bybitRequest
+		readRequest(t, conn, &request)
+		if request.Op != "subscribe" || len(request.Args) != 2 ||
+			request.Args[0] != "orderbook.1.BTCUSDT" || request.Args[1] != "publicTrade.BTCUSDT" {
+			t.Errorf("received %+v, expected to subscribe to the book and trades", request)
+		}
+	}
+
+	url := newVenueServer(t,
+		func(conn *websocket.Conn) {
+			subscribed(conn)
+
+			// data may arrive before the subscription ack
+			send(t, conn,
+				fixture(t, "bybit/orderbook.json"),
+				fixture(t, "bybit/subscribe.json"),
+				fixture(t, "bybit/trade.json"),
+			)
+			// the connection is dropped once the handler returns
+		},
+		func(conn *websocket.Conn) {
+			subscribed(conn)
+			send(t, conn,
+				fixture(t, "bybit/subscribe.json"),
+				fixture(t, "bybit/orderbook_2.json"),
+			)
+			<-done
+		},
+	)
+
+	e := NewBybit(symbol.CurrencyPair{Bybit: "BTCUSDT"})
+	e.url = url
+	trades := e.Trades()
+	go e.Recv()
+
+	expected := []MarketUpdate{
+		{
+			Bid: "27011.92", BidSize: "0.743",
+			Ask: "27011.93", AskSize: "1.512",
+			Name: "Bybit: BTCUSDT",
+		},
+		// withdrawn while reconnecting
+		{Name: "Bybit: BTCUSDT"},
+		{
+			Bid: "27012.4", BidSize: "0.2",
+			Ask: "27012.5", AskSize: "0.94",
+			Name: "Bybit: BTCUSDT",
+		},
+	}
+	for i, want := range expected {
+		if update := receive(t, e.Updates()); update != want {
+			t.Errorf("update %d: received %+v, expected %+v", i, update, want)
+		}
+	}
+
+	trade := receive(t, trades)
+	if trade.Side != Buy || trade.Price != "27011.93" || trade.Size != "0.012" || trade.ID != "2290000000057431034" {
+		t.Errorf("received %+v, expected a buy of 0.012 at 27011.93", trade)
+	}
+}
+
+func FuzzParseBybit(f *testing.F) {
+	f.Add(fixture(f, "bybit/orderbook.json"))
+	f.Add(fixture(f, "bybit/trade.json"))
+	f.Add(fixture(f, "bybit/subscribe.json"))
+	f.Add([]byte(`{"topic":"orderbook.50.BTCUSDT","type":"delta","data":{"s":"BTCUSDT","b":[["27011.92","0"]],"a":[["27011.93"]]}}`))
+	f.Add([]byte(`{"topic":"publicTrade.BTCUSDT","type":"snapshot","data":[{"T":1,"p":"27011.93","v":"-1","S":"Hold"}]}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var message bybitMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			return
+		}
+
+		b := book.New()
+		if err := mergeBybitBook(b, message); err == nil {
+			var sent bybitBook
+			json.Unmarshal(message.Data, &sent)
+			requireLevels(t, data, b.Bids(0), sent.Bids)
+			requireLevels(t, data, b.Asks(0), sent.Asks)
+		}
+
+		if trades, err := parseBybitTrades(message.Data); err == nil {
+			var sent []bybitTrade
+			json.Unmarshal(message.Data, &sent)
+			for i, trade := range trades {
+				// sides are sent capitalized
+				if !strings.EqualFold(trade.Side, sent[i].Side) || trade.ID != sent[i].TradeId {
+					t.Errorf("trade %d parsed as %+v from %s", i, trade, data)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,214 @@
+// Aggregate top of book, mark price and funding for a perpetual listed on
+// Bybit linear (USDT margined) contracts
+
+package exchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
+)
+
+type BybitLinear struct {
+	updates     chan MarketUpdate
+	perp        perpState
+	contract    symbol.Contract
+	url         string
+	name        string
+	symbol      string
+	valid       bool
+	parseErrors *parseReporter
+	logger      *logger.Logger
+}
+
+// Create new BybitLinear struct
+func NewBybitLinear(perps symbol.Perpetuals) *BybitLinear {
+	c := make(chan MarketUpdate, updateBufSize)
+	name := fmt.Sprintf("Bybit Linear: %s", perps.BybitLinear.Symbol)
+	logger := logger.Named(name)
+
+	return &BybitLinear{
+		updates:     c,
+		contract:    perps.BybitLinear,
+		url:         "wss://stream.bybit.com/v5/public/linear",
+		name:        name,
+		symbol:      perps.BybitLinear.Symbol,
+		valid:       perps.BybitLinear.Symbol != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
+	}
+}
+
+// Receive book data from Bybit, send any top of book updates
+// over the updates channel as a MarketUpdate struct
+func (e *BybitLinear) Recv() {
+	e.logger.Debug("connecting to socket")
+	conn := ws.New(e.url)
+	conn.SetAppPing(bybitPingInterval, func(c *ws.Client) error {
+		return c.WriteJSON(bybitRequest{Op: "ping"})
+	})
+	conn.SetReadTimeout(2 * bybitPingInterval)
+
+	topics := []string{fmt.Sprintf("orderbook.1.%s", e.symbol)}
+	if e.perp.perps != nil {
+		// the ticker carries mark price, index price and funding
+		topics = append(topics, fmt.Sprintf("tickers.%s", e.symbol))
+	}
+
+	conn.SetOnConnect(func(c *ws.Client) error {
+		// the ack is handled by the read loop, data may arrive before it
+		return c.WriteJSON(bybitRequest{
+			Op:   "subscribe",
+			Args: topics,
+		})
+	})
+
+	if err := conn.Connect(); err != nil {
+		e.logger.Warn("could not connect to socket, RETURNING")
+		return
+	}
+	e.logger.Debug("connected to socket")
+
+	lastUpdate := MarketUpdate{}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
+	})
+	for {
+		_, rawMessage, err := conn.ReadMessage()
+		if err != nil {
+			e.logger.Warn(err, " RETURNING")
+			return
+		}
+
+		var message bybitMessage
+		if err := json.Unmarshal(rawMessage, &message); err != nil {
+			e.parseErrors.report("message", rawMessage, err)
+			continue
+		}
+
+		if message.Op == "ping" || message.Op == "pong" {
+			e.logger.Debug("pong received")
+			continue
+		}
+		if message.Op == "subscribe" {
+			if message.Success {
+				e.logger.Debug("subscribed to ", strings.Join(topics, ","))
+			} else {
+				e.logger.Warn("could not subscribe: ", message.RetMsg)
+			}
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(message.Topic, "tickers."):
+			data, err := parseBybitLinearTicker(message.Data)
+			if err != nil {
+				e.parseErrors.report("ticker", rawMessage, err)
+				continue
+			}
+
+			// deltas only include the fields that changed
+			e.mergeTicker(data)
+			e.perp.send()
+		case strings.HasPrefix(message.Topic, "orderbook."):
+			// every push of the level 1 book is a snapshot
+			b := book.New()
+			if err := mergeBybitBook(b, message); err != nil {
+				e.parseErrors.report("book", rawMessage, err)
+				continue
+			}
+
+			update := bookUpdate(b, e.name)
+			if update != lastUpdate {
+				e.updates <- update
+			}
+			lastUpdate = update
+
+			e.perp.latest.MarketUpdate = update
+			e.perp.send()
+		default:
+			e.logger.Info("unidentified message: ", string(rawMessage))
+		}
+	}
+}
+
+// Name of data source
+func (e *BybitLinear) Name() string {
+	return e.name
+}
+
+// Access to update channel
+func (e *BybitLinear) Updates() chan MarketUpdate {
+	return e.updates
+}
+
+func (e *BybitLinear) Valid() bool {
+	return e.valid
+}
+
+// Contract specification of the perpetual
+func (e *BybitLinear) Contract() symbol.Contract {
+	return e.contract
+}
+
+// Access to perpetual channel, subscribes to the ticker if called before Recv
+func (e *BybitLinear) Perpetual() chan PerpUpdate {
+	return e.perp.channel()
+}
+
+func (e *BybitLinear) mergeTicker(data bybitLinearTicker) {
+	if data.MarkPrice != "" {
+		e.perp.latest.MarkPrice = data.MarkPrice
+	}
+	if data.IndexPrice != "" {
+		e.perp.latest.IndexPrice = data.IndexPrice
+	}
+	if data.FundingRate != "" {
+		e.perp.latest.FundingRate = data.FundingRate
+	}
+	if ms, err := strconv.ParseInt(data.NextFundingTime, 10, 64); err == nil {
+		e.perp.latest.NextFunding = time.UnixMilli(ms)
+	}
+}
+
+// ticker snapshot or delta, a delta only carries the fields that changed
+func parseBybitLinearTicker(data []byte) (bybitLinearTicker, error) {
+	var ticker bybitLinearTicker
+	if err := json.Unmarshal(data, &ticker); err != nil {
+		return bybitLinearTicker{}, err
+	}
+
+	// funding rates may be negative, prices may not
+	for _, price := range []string{ticker.MarkPrice, ticker.IndexPrice} {
+		if price == "" {
+			continue
+		}
+		if p, err := parseNumber(price); err != nil || p <= 0 {
+			return bybitLinearTicker{}, fmt.Errorf("invalid price %q", price)
+		}
+	}
+	if ticker.FundingRate != "" {
+		if _, err := parseNumber(ticker.FundingRate); err != nil {
+			return bybitLinearTicker{}, fmt.Errorf("invalid funding rate %q", ticker.FundingRate)
+		}
+	}
+
+	return ticker, nil
+}
+
+type bybitLinearTicker struct {
+	Symbol          string `json:"symbol"`
+	MarkPrice       string `json:"markPrice"`
+	IndexPrice      string `json:"indexPrice"`
+	FundingRate     string `json:"fundingRate"`
+	NextFundingTime string `json:"nextFundingTime"`
+}
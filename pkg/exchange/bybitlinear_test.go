@@ -0,0 +1,110 @@
+package exchange
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+)
+
+func TestBybitLinear(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	url := newVenueServer(t, func(conn *websocket.Conn) {
+		var request bybitRequest
+		readRequest(t, conn, &request)
+		if request.Op != "subscribe" || len(request.Args) != 2 ||
+			request.Args[0] != "orderbook.1.BTCUSDT" || request.Args[1] != "tickers.BTCUSDT" {
+			t.Errorf("received %+v, expected to subscribe to the book and ticker", request)
+		}
+
+		// data may arrive before the subscription ack
+		send(t, conn,
+			fixture(t, "bybitlinear/orderbook.json"),
+			fixture(t, "bybitlinear/subscribe.json"),
+			fixture(t, "bybitlinear/tickers.json"),
+			fixture(t, "bybitlinear/tickers_delta.json"),
+		)
+		<-done
+	})
+
+	e := NewBybitLinear(symbol.Perpetuals{BybitLinear: symbol.Contract{Symbol: "BTCUSDT"}})
+	e.url = url
+	perps := e.Perpetual()
+	go e.Recv()
+
+	quote := MarketUpdate{
+		Bid: "27008.10", BidSize: "12.441",
+		Ask: "27008.20", AskSize: "3.079",
+		Name: "Bybit Linear: BTCUSDT",
+	}
+	if update := receive(t, e.Updates()); update != quote {
+		t.Errorf("received %+v, expected %+v", update, quote)
+	}
+
+	nextFunding := time.UnixMilli(1683043200000)
+	expected := []PerpUpdate{
+		{MarketUpdate: quote},
+		{
+			MarketUpdate: quote,
+			MarkPrice:    "27007.95",
+			IndexPrice:   "27015.03",
+			FundingRate:  "0.0001",
+			NextFunding:  nextFunding,
+		},
+		// deltas only change the fields they carry
+		{
+			MarketUpdate: quote,
+			MarkPrice:    "27008.31",
+			IndexPrice:   "27015.03",
+			FundingRate:  "0.0001",
+			NextFunding:  nextFunding,
+		},
+	}
+	for i, want := range expected {
+		if update := receive(t, perps); update != want {
+			t.Errorf("perpetual update %d: received %+v, expected %+v", i, update, want)
+		}
+	}
+}
+
+func FuzzParseBybitLinear(f *testing.F) {
+	f.Add(fixture(f, "bybitlinear/tickers.json"))
+	f.Add(fixture(f, "bybitlinear/tickers_delta.json"))
+	f.Add([]byte(`{"topic":"tickers.BTCUSDT","type":"delta","data":{"markPrice":"-1","fundingRate":"x"}}`))
+	f.Add([]byte(`{"topic":"tickers.BTCUSDT","type":"delta","data":{"nextFundingTime":"soon"}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var message bybitMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			return
+		}
+		ticker, err := parseBybitLinearTicker(message.Data)
+		if err != nil {
+			return
+		}
+		requireNumbers(t, data, ticker.MarkPrice, ticker.IndexPrice, ticker.FundingRate)
+
+		// a delta keeps every field it does not carry
+		previous := PerpUpdate{
+			MarkPrice:   "27007.95",
+			IndexPrice:  "27015.03",
+			FundingRate: "0.0001",
+			NextFunding: time.UnixMilli(1683043200000),
+		}
+		e := &BybitLinear{}
+		e.perp.latest = previous
+		e.mergeTicker(ticker)
+
+		merged := e.perp.latest
+		if ticker.MarkPrice == "" && merged.MarkPrice != previous.MarkPrice ||
+			ticker.IndexPrice == "" && merged.IndexPrice != previous.IndexPrice ||
+			ticker.FundingRate == "" && merged.FundingRate != previous.FundingRate ||
+			ticker.NextFundingTime == "" && !merged.NextFunding.Equal(previous.NextFunding) {
+			t.Errorf("merging %s changed %+v to %+v", data, previous, merged)
+		}
+	})
+}
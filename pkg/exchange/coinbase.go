@@ -3,33 +3,44 @@
 package exchange
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
 )
 
 type Coinbase struct {
-	updates chan MarketUpdate
-	symbol  string
-	name    string
-	url     string
-	valid   bool
-	logger  *logger.Logger
+	updates     chan MarketUpdate
+	trades      chan Trade
+	depth       chan book.Snapshot
+	book        *book.Book
+	synced      bool
+	symbol      string
+	name        string
+	url         string
+	valid       bool
+	fallback    *fallback
+	parseErrors *parseReporter
+	logger      *logger.Logger
 }
 
 func NewCoinbase(pair symbol.CurrencyPair) *Coinbase {
 	c := make(chan MarketUpdate, updateBufSize)
 	name := fmt.Sprintf("Coinbase: %s", pair.Coinbase)
+	logger := logger.Named(name)
 
 	return &Coinbase{
-		updates: c,
-		symbol:  pair.Coinbase,
-		name:    name,
-		url:     "wss://ws-feed.exchange.coinbase.com",
-		valid:   pair.Coinbase != "",
-		logger:  logger.Named(name),
+		updates:     c,
+		symbol:      pair.Coinbase,
+		name:        name,
+		url:         "wss://ws-feed.exchange.coinbase.com",
+		valid:       pair.Coinbase != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
 	}
 }
 
@@ -39,50 +50,116 @@ func (e *Coinbase) Recv() {
 	// connect to websocket
 	e.logger.Debug("connecting to socket")
 	conn := ws.New(e.url)
+	conn.SetKeepalive(keepaliveInterval)
+	conn.SetReadTimeout(readTimeout)
+
+	channels := []string{"ticker"}
+	if e.depth != nil {
+		// the ticker only updates on trades, the local book reflects
+		// every change to the top of book
+		channels = []string{"level2_batch"}
+	}
+	if e.trades != nil {
+		channels = append(channels, "matches")
+	}
 
 	conn.SetOnConnect(func(c *ws.Client) error {
+		// book is rebuilt from the snapshot sent after subscribing
+		e.book = book.New()
+		e.synced = false
+
 		// subscribe to ticker channel
-		err := conn.WriteJSON(coinbaseRequest{
+		err := c.WriteJSON(coinbaseRequest{
 			Type:       "subscribe",
 			ProductIds: []string{e.symbol},
-			Channels:   []string{"ticker"},
+			Channels:   channels,
 		})
 
-		if err != nil {
-			return err
-		}
-
-		// confirm accurate subscription
-		var resp coinbaseSubscriptionResponse
-		if err := conn.ReadJSON(&resp); err != nil {
-			e.logger.Info(err)
-			return err
-		}
+		// the subscriptions ack is handled with the other messages, book
+		// messages may arrive before it
+		return err
+	})
 
-		return nil
+	lastUpdate := MarketUpdate{}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
 	})
+	e.fallback.stream(conn, e.logger, func() error {
+		for {
+			_, rawMessage, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
 
-	if err := conn.Connect(); err != nil {
-		e.logger.Warn("could not connect to socket, RETURNING")
-		return
-	}
-	e.logger.Debug("connected to socket")
+			var message coinbaseMessage
+			if err := json.Unmarshal(rawMessage, &message); err != nil {
+				e.parseErrors.report("message", rawMessage, err)
+				continue
+			}
 
-	for {
-		var message coinbaseMessage
-		if err := conn.ReadJSON(&message); err != nil {
-			e.logger.Warn(err, ", RETURNING")
-			return
-		}
+			switch message.Type {
+			case "snapshot", "l2update":
+				if err := e.mergeLevel2(&message); err != nil {
+					// withdraw the partially applied book and resubscribe
+					// for a new snapshot
+					e.logger.Warn("level2 book out of sync, resubscribing ", err)
+					e.updates <- MarketUpdate{Name: e.name}
+					lastUpdate = MarketUpdate{}
+					e.resync(conn)
+					continue
+				}
+				if !e.synced {
+					continue
+				}
+
+				update := bookUpdate(e.book, e.name)
+				if update != lastUpdate {
+					e.updates <- update
+				}
+				lastUpdate = update
+				e.depth <- e.book.Snapshot(e.name, depthLevels)
+			case "subscriptions":
+				e.logger.Debug("subscribed ", string(rawMessage))
+			case "error":
+				e.logger.Warn("subscription error ", message.Message, " ", message.Reason)
+			case "ticker":
+				update, err := parseCoinbaseTicker(rawMessage)
+				if err != nil {
+					e.parseErrors.report("ticker", rawMessage, err)
+					continue
+				}
+				update.Name = e.name
 
-		e.updates <- MarketUpdate{
-			Ask:     message.BestAsk,
-			AskSize: message.BestAskSize,
-			Bid:     message.BestBid,
-			BidSize: message.BestBidSize,
-			Name:    e.name,
+				e.updates <- update
+			case "match", "last_match":
+				if e.trades == nil {
+					continue
+				}
+
+				// side of a match is the maker's, report the taker's
+				side := Buy
+				if message.Side == "buy" {
+					side = Sell
+				}
+
+				t, err := time.Parse(time.RFC3339Nano, message.Time)
+				if err != nil {
+					e.parseErrors.report("match", rawMessage, err)
+					continue
+				}
+				e.trades <- Trade{
+					Price: message.Price,
+					Size:  message.Size,
+					Side:  side,
+					ID:    fmt.Sprint(message.TradeId),
+					Time:  t,
+					Name:  e.name,
+				}
+			}
 		}
-	}
+	})
 }
 
 // Name of data source
@@ -95,25 +172,116 @@ func (e *Coinbase) Updates() chan MarketUpdate {
 	return e.updates
 }
 
+// Access to trade channel, subscribes to the matches channel if called before Recv
+func (e *Coinbase) Trades() chan Trade {
+	if e.trades == nil {
+		e.trades = make(chan Trade, updateBufSize)
+	}
+	return e.trades
+}
+
+// Access to depth channel, switches to the level2_batch channel and maintains
+// a local book if called before Recv
+func (e *Coinbase) Depth() chan book.Snapshot {
+	if e.depth == nil {
+		e.depth = make(chan book.Snapshot, updateBufSize)
+	}
+	return e.depth
+}
+
 func (e *Coinbase) Valid() bool {
 	return e.valid
 }
 
+// Poll the REST level 1 book while the websocket is down, must be called before Recv
+func (e *Coinbase) EnableFallback() {
+	e.fallback = newFallback(e.name, coinbaseFallback, e.symbol, e.updates)
+}
+
+// top of book from a ticker message
+func parseCoinbaseTicker(rawMessage []byte) (MarketUpdate, error) {
+	var message coinbaseMessage
+	if err := json.Unmarshal(rawMessage, &message); err != nil {
+		return MarketUpdate{}, err
+	}
+
+	update := MarketUpdate{
+		Ask:     message.BestAsk,
+		AskSize: message.BestAskSize,
+		Bid:     message.BestBid,
+		BidSize: message.BestBidSize,
+	}
+	return update, checkQuote(update)
+}
+
+// apply a level2 snapshot or update to the local book
+func (e *Coinbase) mergeLevel2(message *coinbaseMessage) error {
+	if message.Type == "snapshot" {
+		e.book.Clear()
+		if err := setLevels(e.book, book.Bid, message.Bids); err != nil {
+			return err
+		}
+		if err := setLevels(e.book, book.Ask, message.Asks); err != nil {
+			return err
+		}
+
+		e.synced = true
+		return nil
+	}
+
+	if !e.synced {
+		// updates before the snapshot are already reflected in it
+		return nil
+	}
+
+	for _, change := range message.Changes {
+		if len(change) < 3 {
+			return fmt.Errorf("malformed change %v", change)
+		}
+
+		side := book.Bid
+		if change[0] == "sell" {
+			side = book.Ask
+		}
+		if err := e.book.Set(side, change[1], change[2]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// drop the local book and resubscribe to the level2 channel, which is
+// answered with a new snapshot
+func (e *Coinbase) resync(conn *ws.Client) {
+	e.synced = false
+	e.book.Clear()
+
+	for _, request := range []string{"unsubscribe", "subscribe"} {
+		err := conn.WriteJSON(coinbaseRequest{
+			Type:       request,
+			ProductIds: []string{e.symbol},
+			Channels:   []string{"level2_batch"},
+		})
+		if err != nil {
+			// the failed write closes the connection, reconnecting
+			// subscribes again
+			e.logger.Info("could not resubscribe ", err)
+			return
+		}
+	}
+}
+
 type coinbaseRequest struct {
 	Type       string   `json:"type"`
 	ProductIds []string `json:"product_ids"`
 	Channels   []string `json:"channels"`
 }
 
-type coinbaseSubscriptionResponse struct {
-	Type     string                   `json:"type"`
-	Channels []map[string]interface{} `json:"channels"`
-}
-
 type coinbaseMessage struct {
 	Type        string `json:"type"`
 	Sequence    int    `json:"sequence"`
-	ProductId   string `json:"ETH-USD"`
+	ProductId   string `json:"product_id"`
 	Price       string `json:"price"`
 	Open24h     string `json:"open_24h"`
 	Volume24h   string `json:"volume_24h"`
@@ -128,4 +296,14 @@ type coinbaseMessage struct {
 	Time        string `json:"time"`
 	TradeId     int    `json:"trade_id"`
 	LastSize    string `json:"last_size"`
+	Size        string `json:"size"`
+
+	// error fields
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+
+	// level2 snapshot and update fields
+	Bids    [][]string `json:"bids"`
+	Asks    [][]string `json:"asks"`
+	Changes [][]string `json:"changes"`
 }
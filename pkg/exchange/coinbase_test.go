@@ -0,0 +1,138 @@
+package exchange
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+)
+
+func TestCoinbaseTicker(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	url := newVenueServer(t, func(conn *websocket.Conn) {
+		var request coinbaseRequest
+		readRequest(t, conn, &request)
+		if len(request.Channels) != 1 || request.Channels[0] != "ticker" {
+			t.Errorf("subscribed to %v, expected the ticker", request.Channels)
+		}
+
+		send(t, conn,
+			fixture(t, "coinbase/subscriptions.json"),
+			fixture(t, "coinbase/error.json"),
+			fixture(t, "coinbase/ticker.json"),
+		)
+		<-done
+	})
+
+	e := NewCoinbase(symbol.CurrencyPair{Coinbase: "BTC-USD"})
+	e.url = url
+	go e.Recv()
+
+	expected := MarketUpdate{
+		Bid: "27012.34", BidSize: "0.51000000",
+		Ask: "27013.87", AskSize: "0.12500000",
+		Name: "Coinbase: BTC-USD",
+	}
+	if update := receive(t, e.Updates()); update != expected {
+		t.Errorf("received %+v, expected %+v", update, expected)
+	}
+}
+
+func TestCoinbaseLevel2(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	url := newVenueServer(t, func(conn *websocket.Conn) {
+		var request coinbaseRequest
+		readRequest(t, conn, &request)
+
+		// the snapshot may arrive before the subscription ack
+		send(t, conn,
+			fixture(t, "coinbase/snapshot.json"),
+			fixture(t, "coinbase/subscriptions.json"),
+			fixture(t, "coinbase/l2update.json"),
+			fixture(t, "coinbase/match.json"),
+			fixture(t, "coinbase/l2update_malformed.json"),
+		)
+
+		// the broken book is resubscribed for a new snapshot
+		for _, expected := range []string{"unsubscribe", "subscribe"} {
+			readRequest(t, conn, &request)
+			if request.Type != expected || len(request.Channels) != 1 || request.Channels[0] != "level2_batch" {
+				t.Errorf("received %+v, expected to %s level2_batch", request, expected)
+			}
+		}
+		send(t, conn, fixture(t, "coinbase/snapshot.json"))
+		<-done
+	})
+
+	e := NewCoinbase(symbol.CurrencyPair{Coinbase: "BTC-USD"})
+	e.url = url
+	e.Depth()
+	trades := e.Trades()
+	go e.Recv()
+
+	snapshot := MarketUpdate{
+		Bid: "27012.34", BidSize: "0.51000000",
+		Ask: "27013.87", AskSize: "0.12500000",
+		Name: "Coinbase: BTC-USD",
+	}
+	expected := []MarketUpdate{
+		snapshot,
+		{
+			Bid: "27012.90", BidSize: "0.30000000",
+			Ask: "27014.50", AskSize: "2.00000000",
+			Name: "Coinbase: BTC-USD",
+		},
+		// malformed update withdraws the quote until the new snapshot
+		{Name: "Coinbase: BTC-USD"},
+		snapshot,
+	}
+	for i, want := range expected {
+		if update := receive(t, e.Updates()); update != want {
+			t.Errorf("update %d: received %+v, expected %+v", i, update, want)
+		}
+	}
+
+	trade := receive(t, trades)
+	if trade.Side != Buy || trade.Price != "27013.87" || trade.Size != "0.00120000" || trade.ID != "524071386" {
+		t.Errorf("received %+v, expected a taker buy of 0.0012 at 27013.87", trade)
+	}
+}
+
+func TestParseCoinbaseTicker(t *testing.T) {
+	update, err := parseCoinbaseTicker(fixture(t, "coinbase/ticker.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := MarketUpdate{
+		Bid: "27012.34", BidSize: "0.51000000",
+		Ask: "27013.87", AskSize: "0.12500000",
+	}
+	if update != want {
+		t.Errorf("parsed %+v, expected %+v", update, want)
+	}
+}
+
+func FuzzParseCoinbase(f *testing.F) {
+	f.Add(fixture(f, "coinbase/ticker.json"))
+	f.Add(fixture(f, "coinbase/subscriptions.json"))
+	f.Add(fixture(f, "coinbase/error.json"))
+	f.Add([]byte(`{"type":"ticker","product_id":"BTC-USD","best_bid":"","best_ask":""}`))
+	f.Add([]byte(`{"type":"ticker","best_bid":27012.34,"trade_id":"524071385"}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		update, err := parseCoinbaseTicker(data)
+		if err != nil {
+			return
+		}
+		requireNumbers(t, data, update.Bid, update.BidSize, update.Ask, update.AskSize)
+
+		// a side missing from the ticker stays empty
+		requireSent(t, data, "best_bid", update.Bid)
+		requireSent(t, data, "best_ask", update.Ask)
+	})
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
@@ -15,27 +17,35 @@ import (
 // message method for heartbeat response
 const heartbeatRequestMethod = "public/respond-heartbeat"
 
+// heartbeats are sent every 30 seconds
+const cryptoComReadTimeout = 60 * time.Second
+
 type CryptoCom struct {
-	updates chan MarketUpdate
-	url     string
-	name    string
-	symbol  string
-	valid   bool
-	logger  *logger.Logger
+	updates     chan MarketUpdate
+	trades      chan Trade
+	url         string
+	name        string
+	symbol      string
+	valid       bool
+	fallback    *fallback
+	parseErrors *parseReporter
+	logger      *logger.Logger
 }
 
 // create new Crypto.com struct
 func NewCryptoCom(pair symbol.CurrencyPair) *CryptoCom {
 	c := make(chan MarketUpdate, updateBufSize)
 	name := fmt.Sprintf("Crypto.com: %s", pair.CryptoCom)
+	logger := logger.Named(name)
 
 	return &CryptoCom{
-		updates: c,
-		url:     "wss://stream.crypto.com/exchange/v1/market",
-		name:    name,
-		symbol:  pair.CryptoCom,
-		valid:   pair.CryptoCom != "",
-		logger:  logger.Named(name),
+		updates:     c,
+		url:         "wss://stream.crypto.com/exchange/v1/market",
+		name:        name,
+		symbol:      pair.CryptoCom,
+		valid:       pair.CryptoCom != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
 	}
 }
 
@@ -44,12 +54,18 @@ func NewCryptoCom(pair symbol.CurrencyPair) *CryptoCom {
 func (e *CryptoCom) Recv() {
 	e.logger.Debug("connecting to socket")
 	conn := ws.New(e.url)
+	conn.SetReadTimeout(cryptoComReadTimeout)
+
+	channels := []string{fmt.Sprintf("book.%s", e.symbol)}
+	if e.trades != nil {
+		channels = append(channels, fmt.Sprintf("trade.%s", e.symbol))
+	}
 
 	conn.SetOnConnect(func(c *ws.Client) error {
-		c.WriteJSON(buildCryptoComSubscription(e.symbol))
+		c.WriteJSON(buildCryptoComSubscription(channels...))
 
 		var resp cryptoComSubscriptionResponse
-		if err := conn.ReadJSON(&resp); err != nil {
+		if err := c.ReadJSON(&resp); err != nil {
 			e.logger.Info(err)
 			return err
 		}
@@ -61,47 +77,73 @@ func (e *CryptoCom) Recv() {
 		return nil
 	})
 
-	if err := conn.Connect(); err != nil {
-		e.logger.Warn("could not connect to socket, RETURNING")
-		return
-	}
-	e.logger.Debug("connected to socket")
-
 	lastUpdate := MarketUpdate{}
-	for {
-		_, raw_msg, err := conn.ReadMessage()
-		if err != nil {
-			e.logger.Warn(e.name, err)
-			return
-		}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
+	})
+	e.fallback.stream(conn, e.logger, func() error {
+		for {
+			_, raw_msg, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
 
-		var message cryptoComMessage
-		json.Unmarshal(raw_msg, &message)
-
-		if message.Method == "public/heartbeat" {
-			// Crypto.com requires a heartbeat message response every
-			// 	 30 seconds to keep websocket connection alive
-			var h cryptoComHeartbeat
-			json.Unmarshal(raw_msg, &h)
-			conn.WriteJSON(cryptoComMessage{
-				Id:     h.Id,
-				Method: heartbeatRequestMethod,
-			})
-		} else if message.Method == "subscribe" {
-			var bookMsg cryptoComBookMsg
-			json.Unmarshal(raw_msg, &bookMsg)
-
-			update := parseCryptoComBookData(&bookMsg)
-			update.Name = e.name
-			if update != lastUpdate {
-				e.updates <- update
+			var message cryptoComChannelMsg
+			if err := json.Unmarshal(raw_msg, &message); err != nil {
+				e.parseErrors.report("message", raw_msg, err)
+				continue
 			}
 
-			lastUpdate = update
-		} else {
-			e.logger.Info(e.name, "unidentified message:", message.Method)
+			if message.Method == "public/heartbeat" {
+				// Crypto.com requires a heartbeat message response every
+				// 	 30 seconds to keep websocket connection alive
+				var h cryptoComHeartbeat
+				if err := json.Unmarshal(raw_msg, &h); err != nil {
+					e.parseErrors.report("heartbeat", raw_msg, err)
+					continue
+				}
+				conn.WriteJSON(cryptoComMessage{
+					Id:     h.Id,
+					Method: heartbeatRequestMethod,
+				})
+			} else if message.Method == "subscribe" && message.Result.Channel == "trade" {
+				var tradeMsg cryptoComTradeMsg
+				if err := json.Unmarshal(raw_msg, &tradeMsg); err != nil {
+					e.parseErrors.report("trade", raw_msg, err)
+					continue
+				}
+
+				for _, trade := range tradeMsg.Result.Data {
+					e.trades <- Trade{
+						Price: trade.Price,
+						Size:  trade.Quantity,
+						Side:  strings.ToLower(trade.Side),
+						ID:    trade.TradeId,
+						Time:  time.UnixMilli(trade.Time),
+						Name:  e.name,
+					}
+				}
+			} else if message.Method == "subscribe" {
+				update, err := parseCryptoComBookData(raw_msg)
+				if errors.Is(err, errNoBookData) {
+					continue
+				} else if err != nil {
+					e.parseErrors.report("book", raw_msg, err)
+					continue
+				}
+				update.Name = e.name
+				if update != lastUpdate {
+					e.updates <- update
+				}
+
+				lastUpdate = update
+			} else {
+				e.logger.Info(e.name, "unidentified message:", message.Method)
+			}
 		}
-	}
+	})
 }
 
 // Name of data source
@@ -118,38 +160,75 @@ func (e *CryptoCom) Valid() bool {
 	return e.valid
 }
 
+// Poll the REST book while the websocket is down, must be called before Recv
+func (e *CryptoCom) EnableFallback() {
+	e.fallback = newFallback(e.name, cryptoComFallback, e.symbol, e.updates)
+}
+
+// Access to trade channel, subscribes to the trade channel if called before Recv
+func (e *CryptoCom) Trades() chan Trade {
+	if e.trades == nil {
+		e.trades = make(chan Trade, updateBufSize)
+	}
+	return e.trades
+}
+
 // parse a Crypto.com book websocket message into our market update object
 // best bid and ask, as well as volume for both
-func parseCryptoComBookData(c *cryptoComBookMsg) MarketUpdate {
-	var ask string
-	var askSize string
-	if len(c.Result.Data[0].Asks) != 0 {
-		askSlice := c.Result.Data[0].Asks
-		ask = askSlice[0][0]
-		askSize = stringMultiply(askSlice[0][1], askSlice[0][2])
+func parseCryptoComBookData(rawMessage []byte) (MarketUpdate, error) {
+	var c cryptoComBookMsg
+	if err := json.Unmarshal(rawMessage, &c); err != nil {
+		return MarketUpdate{}, err
+	}
+	if len(c.Result.Data) == 0 {
+		return MarketUpdate{}, errNoBookData
 	}
 
-	var bid string
-	var bidSize string
-	if len(c.Result.Data[0].Bids) != 0 {
-		bidSlice := c.Result.Data[0].Bids
-		bid = bidSlice[0][0]
-		bidSize = stringMultiply(bidSlice[0][1], bidSlice[0][2])
+	ask, askSize, err := parseCryptoComLevel(c.Result.Data[0].Asks)
+	if err != nil {
+		return MarketUpdate{}, fmt.Errorf("asks: %w", err)
 	}
 
-	return MarketUpdate{
+	bid, bidSize, err := parseCryptoComLevel(c.Result.Data[0].Bids)
+	if err != nil {
+		return MarketUpdate{}, fmt.Errorf("bids: %w", err)
+	}
+
+	update := MarketUpdate{
 		Ask:     ask,
 		AskSize: askSize,
 		Bid:     bid,
 		BidSize: bidSize,
 	}
+	if update == (MarketUpdate{}) {
+		// an empty book withdraws the quote
+		return update, nil
+	}
+	return update, checkQuote(update)
+}
+
+// price and size of the best [price, quantity, orders] level, empty if the
+// side has no levels
+func parseCryptoComLevel(levels [][]string) (string, string, error) {
+	if len(levels) == 0 {
+		return "", "", nil
+	}
+	if len(levels[0]) < 3 {
+		return "", "", fmt.Errorf("malformed level %v", levels[0])
+	}
+
+	size, err := stringMultiply(levels[0][1], levels[0][2])
+	if err != nil {
+		return "", "", err
+	}
+
+	return levels[0][0], size, nil
 }
 
-// Build the byte message payload for subscribing to a certain symbol's book data
-func buildCryptoComSubscription(symbol string) subscription {
-	c := []string{fmt.Sprintf("book.%s", symbol)}
+// Build the byte message payload for subscribing to a set of channels
+func buildCryptoComSubscription(channels ...string) subscription {
 	params := map[string][]string{
-		"channels": c,
+		"channels": channels,
 	}
 
 	return subscription{
@@ -178,6 +257,13 @@ type cryptoComMessage struct {
 	Method string `json:"method"`
 }
 
+type cryptoComChannelMsg struct {
+	cryptoComMessage
+	Result struct {
+		Channel string `json:"channel"`
+	} `json:"result"`
+}
+
 type cryptoComSubscriptionResponse struct {
 	cryptoComMessage
 	Code    int    `json:"code"`
@@ -191,7 +277,7 @@ type cryptoComBookMsg struct {
 }
 
 type cryptoComResult struct {
-	Channel        string              `json:"book"`
+	Channel        string              `json:"channel"`
 	Subscription   string              `json:"subscription"`
 	InstrumentName string              `json:"instrument_name"`
 	Data           []cryptoComBookData `json:"data"`
@@ -203,3 +289,19 @@ type cryptoComBookData struct {
 	LastUpdate  int        `json:"t"`
 	MessageTime int        `json:"tt"`
 }
+
+type cryptoComTradeMsg struct {
+	cryptoComMessage
+	Result struct {
+		Channel string               `json:"channel"`
+		Data    []cryptoComTradeData `json:"data"`
+	} `json:"result"`
+}
+
+type cryptoComTradeData struct {
+	TradeId  string `json:"d"`
+	Time     int64  `json:"t"`
+	Price    string `json:"p"`
+	Quantity string `json:"q"`
+	Side     string `json:"s"`
+}
@@ -0,0 +1,46 @@
+package exchange
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseCryptoComBookData(t *testing.T) {
+	update, err := parseCryptoComBookData(fixture(t, "cryptocom/book.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sizes are the quantity of the best level times its order count
+	want := MarketUpdate{
+		Bid: "27013.01", BidSize: "0.120000",
+		Ask: "27013.84", AskSize: "0.030000",
+	}
+	if update != want {
+		t.Errorf("parsed %+v, expected %+v", update, want)
+	}
+
+	if _, err := parseCryptoComBookData(fixture(t, "cryptocom/subscribed.json")); !errors.Is(err, errNoBookData) {
+		t.Errorf("parsing a subscription response returned %v, expected %v", err, errNoBookData)
+	}
+}
+
+func FuzzParseCryptoCom(f *testing.F) {
+	f.Add(fixture(f, "cryptocom/book.json"))
+	f.Add(fixture(f, "cryptocom/subscribed.json"))
+	f.Add([]byte(`{"method":"subscribe","result":{"channel":"book","data":[{"asks":[["27013.84","0.015"]],"bids":[]}]}}`))
+	f.Add([]byte(`{"method":"subscribe","result":{"channel":"book","data":[{"asks":[["27013.84","x","2"]]}]}}`))
+	f.Add([]byte(`{"id":1,"method":"public/heartbeat"}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		update, err := parseCryptoComBookData(data)
+		if err != nil {
+			return
+		}
+		requireNumbers(t, data, update.Bid, update.BidSize, update.Ask, update.AskSize)
+
+		// prices are those of the best levels, a side without levels is empty
+		requireSent(t, data, "result.data.0.bids.0.0", update.Bid)
+		requireSent(t, data, "result.data.0.asks.0.0", update.Ask)
+	})
+}
@@ -0,0 +1,91 @@
+// Perpetual futures venues stream the same top of book updates as spot venues,
+// plus the mark price, index price and funding rate of the contract
+
+package exchange
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+)
+
+// Implemented by perpetual futures exchanges. Mark price, index price and
+// funding are only subscribed to if Perpetual is called before Recv
+type Derivative interface {
+	Exchange
+	Contract() symbol.Contract
+	Perpetual() chan PerpUpdate
+}
+
+// Latest state of a perpetual contract, sent whenever the top of book or any
+// of the contract's reference prices change
+type PerpUpdate struct {
+	MarketUpdate
+	MarkPrice   string
+	IndexPrice  string
+	FundingRate string
+	NextFunding time.Time
+}
+
+// tracks the latest state of a perpetual, merged from separate streams
+type perpState struct {
+	perps  chan PerpUpdate
+	latest PerpUpdate
+	last   PerpUpdate
+}
+
+// send the latest state if anything has changed since the last send
+func (p *perpState) send() {
+	if p.perps == nil || p.latest == p.last {
+		return
+	}
+
+	p.perps <- p.latest
+	p.last = p.latest
+}
+
+// perpetual channel, created the first time it is accessed
+func (p *perpState) channel() chan PerpUpdate {
+	if p.perps == nil {
+		p.perps = make(chan PerpUpdate, updateBufSize)
+	}
+	return p.perps
+}
+
+// amount of the base currency represented by size contracts, computed exactly
+// so that sizes keep the precision of the venue's strings
+func contractsToBase(size string, contractSize string) (string, error) {
+	if contractSize == "" || contractSize == "1" {
+		return size, nil
+	}
+
+	// big.Rat also accepts fractions such as 1/2, which no venue sends
+	if _, err := parseNumber(size); err != nil {
+		return "", fmt.Errorf("invalid size %q", size)
+	}
+	s, ok := new(big.Rat).SetString(size)
+	if !ok {
+		return "", fmt.Errorf("invalid size %q", size)
+	}
+	c, ok := new(big.Rat).SetString(contractSize)
+	if !ok {
+		return "", fmt.Errorf("invalid contract size %q", contractSize)
+	}
+
+	amount := s.Mul(s, c).FloatString(decimals(size) + decimals(contractSize))
+	if strings.Contains(amount, ".") {
+		amount = strings.TrimSuffix(strings.TrimRight(amount, "0"), ".")
+	}
+	return amount, nil
+}
+
+// number of digits after the decimal point
+func decimals(s string) int {
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return len(s) - i - 1
+	}
+	return 0
+}
@@ -0,0 +1,169 @@
+package exchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+)
+
+func TestContractsToBase(t *testing.T) {
+	tests := []struct {
+		size         string
+		contractSize string
+		expected     string
+	}{
+		{"1201", "0.01", "12.01"},
+		{"84", "0.01", "0.84"},
+		{"3", "0.1", "0.3"},
+		{"1.5", "0.1", "0.15"},
+		{"250", "10", "2500"},
+		{"0", "0.01", "0"},
+		{"0.5", "1", "0.5"},
+		{"0.5", "", "0.5"},
+	}
+
+	for _, test := range tests {
+		amount, err := contractsToBase(test.size, test.contractSize)
+		if err != nil {
+			t.Errorf("%s contracts of %s: %v", test.size, test.contractSize, err)
+			continue
+		}
+		if amount != test.expected {
+			t.Errorf("%s contracts of %s converted to %s, expected %s", test.size, test.contractSize, amount, test.expected)
+		}
+	}
+
+	if _, err := contractsToBase("1e", "0.01"); err == nil {
+		t.Error("converted an invalid size")
+	}
+}
+
+func TestOKXSwapSizesInBaseCurrency(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	url := newVenueServer(t, func(conn *websocket.Conn) {
+		var request okxRequest
+		readRequest(t, conn, &request)
+
+		send(t, conn,
+			fixture(t, "okxswap/bbo_tbt.json"),
+			fixture(t, "okxswap/subscribe.json"),
+		)
+		<-done
+	})
+
+	e := NewOKXSwap(symbol.Perpetuals{OKXSwap: symbol.Contract{
+		Symbol:       "BTC-USDT-SWAP",
+		ContractSize: "0.01",
+		TickSize:     "0.1",
+		Settle:       "USDT",
+	}})
+	e.url = url
+	go e.Recv()
+
+	expected := MarketUpdate{
+		Bid: "27020", BidSize: "12.01",
+		Ask: "27020.1", AskSize: "0.84",
+		Name: "OKX Swap: BTC-USDT-SWAP",
+	}
+	if update := receive(t, e.Updates()); update != expected {
+		t.Errorf("received %+v, expected %+v", update, expected)
+	}
+}
+
+func FuzzParseOKXSwap(f *testing.F) {
+	f.Add(fixture(f, "okxswap/bbo_tbt.json"))
+	f.Add(fixture(f, "okxswap/subscribe.json"))
+	f.Add([]byte(`{"arg":{"channel":"bbo-tbt"},"data":[{"asks":[["27020.1","1/2"]],"bids":[["27020","1e2"]]}]}`))
+	f.Add([]byte(`{"arg":{"channel":"bbo-tbt"},"data":[{"asks":[["27020.1","-84"]],"bids":[]}]}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var message okxMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			return
+		}
+
+		contracts, err := parseOKXBook(message.Data, "")
+		scaled, scaledErr := parseOKXBook(message.Data, "0.01")
+		if (err == nil) != (scaledErr == nil) {
+			t.Fatalf("contract size changed whether %s parses: %v, %v", data, err, scaledErr)
+		}
+		if err != nil {
+			return
+		}
+
+		// sizes are the contract counts times the contract size
+		for _, side := range [][2][]book.Level{
+			{contracts.Bids(0), scaled.Bids(0)},
+			{contracts.Asks(0), scaled.Asks(0)},
+		} {
+			if len(side[0]) != len(side[1]) {
+				t.Fatalf("%d levels in contracts, %d scaled from %s", len(side[0]), len(side[1]), data)
+			}
+			for i := range side[0] {
+				count, _ := strconv.ParseFloat(side[0][i].Size, 64)
+				size, _ := strconv.ParseFloat(side[1][i].Size, 64)
+				if math.Abs(count*0.01-size) > 1e-9*math.Max(1, size) {
+					t.Errorf("%s contracts scaled to %s in %s", side[0][i].Size, side[1][i].Size, data)
+				}
+			}
+		}
+	})
+}
+
+func TestParseBinanceUSDMMarkPrice(t *testing.T) {
+	var stream binanceUSStream
+	if err := json.Unmarshal(fixture(t, "binanceusdm/mark_price.json"), &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	update, err := parseBinanceUSDMMarkPrice(stream.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := PerpUpdate{
+		MarkPrice:   "27001.50000000",
+		IndexPrice:  "27015.38148936",
+		FundingRate: "0.00010000",
+		NextFunding: time.UnixMilli(1683043200000),
+	}
+	if update != want {
+		t.Errorf("parsed %+v, expected %+v", update, want)
+	}
+}
+
+func FuzzParseBinanceUSDM(f *testing.F) {
+	f.Add(fixture(f, "binanceusdm/mark_price.json"))
+	f.Add(fixture(f, "binanceusdm/book_ticker.json"))
+	f.Add([]byte(`{"stream":"btcusdt@markPrice@1s","data":{"p":"27001.5","i":"","r":"-0.0001","T":"soon"}}`))
+	f.Add([]byte(`{"stream":"btcusdt@markPrice@1s","data":{"p":"-1","i":"27015.38","r":"x"}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var stream binanceUSStream
+		if err := json.Unmarshal(data, &stream); err != nil {
+			return
+		}
+		update, err := parseBinanceUSDMMarkPrice(stream.Data)
+		if err != nil {
+			return
+		}
+		requireNumbers(t, data, update.MarkPrice, update.IndexPrice, update.FundingRate)
+
+		// the quote comes from the book ticker stream and is kept by the caller
+		if update.MarketUpdate != (MarketUpdate{}) {
+			t.Errorf("parsed quote %+v from %s", update.MarketUpdate, data)
+		}
+		if fmt.Sprint(update.NextFunding.UnixMilli()) != jsonField(stream.Data, "T") && jsonField(stream.Data, "T") != "" {
+			t.Errorf("next funding %s parsed from %s", update.NextFunding, data)
+		}
+	})
+}
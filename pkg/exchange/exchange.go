@@ -1,13 +1,33 @@
 package exchange
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"strconv"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
 )
 
 const updateBufSize = 100
 
+// number of levels per side published over depth channels
+const depthLevels = 50
+
+// liveness checks for venues without application level heartbeats, a
+// connection is reconnected if neither data nor pongs arrive within readTimeout
+const (
+	keepaliveInterval = 30 * time.Second
+	readTimeout       = 90 * time.Second
+)
+
+// taker side of a trade
+const (
+	Buy  = "buy"
+	Sell = "sell"
+)
+
 type Exchange interface {
 	Recv()
 	Updates() chan MarketUpdate
@@ -15,25 +35,122 @@ type Exchange interface {
 	Name() string
 }
 
+// Constructors of the websocket spot venues, e.g. for NewSynthetics. Kucoin is
+// last since creating it requests a connection token
+var SpotVenues = []func(symbol.CurrencyPair) Exchange{
+	func(p symbol.CurrencyPair) Exchange { return NewCoinbase(p) },
+	func(p symbol.CurrencyPair) Exchange { return NewBinanceUS(p) },
+	func(p symbol.CurrencyPair) Exchange { return NewOKX(p) },
+	func(p symbol.CurrencyPair) Exchange { return NewBybit(p) },
+	func(p symbol.CurrencyPair) Exchange { return NewBitstamp(p) },
+	func(p symbol.CurrencyPair) Exchange { return NewBitfinex(p) },
+	func(p symbol.CurrencyPair) Exchange { return NewGemini(p) },
+	func(p symbol.CurrencyPair) Exchange { return NewCryptoCom(p) },
+	func(p symbol.CurrencyPair) Exchange { return NewKucoin(p) },
+}
+
 type MarketUpdate struct {
 	Bid     string
 	Ask     string
 	BidSize string
 	AskSize string
 	Name    string
+
+	// set when the quote is derived by chaining other venues' quotes,
+	// Path lists the legs used to build it
+	Synthetic bool
+	Path      string
+
+	// set when the quote comes from polling a REST endpoint while the
+	// venue's websocket is down
+	Degraded bool
+}
+
+// Implemented by exchanges that can stream public trades. The trade feed is
+// only subscribed to if Trades is called before Recv
+type TradeSource interface {
+	Name() string
+	Trades() chan Trade
+}
+
+// Implemented by exchanges that can maintain a local order book. The exchange
+// only runs in depth mode if Depth is called before Recv
+type DepthSource interface {
+	Name() string
+	Depth() chan book.Snapshot
+}
+
+type Trade struct {
+	Price string
+	Size  string
+	Side  string
+	ID    string
+	Time  time.Time
+	Name  string
+}
+
+// A candle published by an exchange
+type Candle struct {
+	Interval time.Duration
+	Start    time.Time
+	Open     string
+	High     string
+	Low      string
+	Close    string
+	Volume   string
+	Name     string
+}
+
+// top of a local book as a market update
+func bookUpdate(b *book.Book, name string) MarketUpdate {
+	bid, ask := b.Top()
+	return MarketUpdate{
+		Bid:     bid.Price,
+		BidSize: bid.Size,
+		Ask:     ask.Price,
+		AskSize: ask.Size,
+		Name:    name,
+	}
+}
+
+// set [price, size, ...] levels on one side of a book
+func setLevels(b *book.Book, side book.Side, levels [][]string) error {
+	for _, l := range levels {
+		if len(l) < 2 {
+			return fmt.Errorf("malformed level %v", l)
+		}
+		if err := b.Set(side, l[0], l[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// price and size of the first [price, size, ...] level
+func topLevel(levels [][]string) (string, string, error) {
+	if len(levels) == 0 {
+		return "", "", errors.New("no levels")
+	}
+	if len(levels[0]) < 2 {
+		return "", "", fmt.Errorf("malformed level %v", levels[0])
+	}
+
+	return levels[0][0], levels[0][1], nil
 }
 
-func stringMultiply(s1 string, s2 string) string {
+// product of two decimal strings
+func stringMultiply(s1 string, s2 string) (string, error) {
 	// need to create more efficient process
 	f1, err := strconv.ParseFloat(s1, 64)
 	if err != nil {
-		log.Panicln("could not convert string to float")
+		return "", err
 	}
 
 	f2, err := strconv.ParseFloat(s2, 64)
 	if err != nil {
-		log.Panicln("could not convert string to float")
+		return "", err
 	}
 
-	return fmt.Sprintf("%f", f1*f2)
+	return fmt.Sprintf("%f", f1*f2), nil
 }
@@ -0,0 +1,218 @@
+// Poll a venue's REST endpoint while its websocket is down so that the venue
+// keeps contributing degraded quotes until streaming resumes
+
+package exchange
+
+import (
+	"sync"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
+)
+
+// default polling interval of the REST fallbacks
+const fallbackInterval = 2 * time.Second
+
+type fallback struct {
+	poller *Poller
+
+	// stop and done are set while polling
+	mux  *sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// create a fallback that polls config for symbol, sending updates named name
+// over the updates channel of the exchange it stands in for
+func newFallback(name string, config PollerConfig, symbol string, updates chan MarketUpdate) *fallback {
+	if config.Interval.Duration == 0 {
+		config.Interval.Duration = fallbackInterval
+	}
+	if config.Jitter == 0 {
+		config.Jitter = 0.1
+	}
+
+	p := NewPoller(config, symbol)
+	p.name = name
+	p.updates = updates
+	p.logger = logger.Named(name + " REST fallback")
+
+	return &fallback{
+		poller: p,
+		mux:    &sync.Mutex{},
+	}
+}
+
+// connect to the websocket and stream from it with read until the connection is
+// lost for good. With a fallback the REST endpoint is polled whenever the
+// websocket is down and streaming resumes once it reconnects, without one
+// stream returns when the reconnect policy gives up
+func (f *fallback) stream(conn *ws.Client, log *logger.Logger, read func() error) {
+	if f != nil {
+		// poll while the first connection is retried too, the reconnect
+		// policy may never give up
+		conn.OnConnectFailed(func(err error) {
+			if f.start() {
+				log.Warn(err, " falling back to REST while connecting")
+			}
+		})
+		conn.OnDisconnect(func(err error) {
+			log.Warn(err, " falling back to REST")
+			f.start()
+		})
+		conn.OnReconnect(func() {
+			if f.stopPolling() {
+				log.Info("socket reconnected, resuming streaming")
+			}
+		})
+	}
+
+	for {
+		err := conn.Connect()
+		if err == nil {
+			log.Debug("connected to socket")
+			f.stopPolling()
+			err = read()
+			if conn.Connected() {
+				// read stopped on an error of its own, e.g. a failed
+				// write, and the connection is reestablished by the
+				// next read
+				log.Info(err, " restarting stream")
+				continue
+			}
+		}
+
+		if f == nil {
+			log.Warn(err, " RETURNING")
+			return
+		}
+
+		// the reconnect policy gave up, keep polling while retrying
+		log.Warn("could not connect to socket, polling REST ", err)
+		f.start()
+	}
+}
+
+// start polling if not already polling, returns false if the fallback was
+// already polling
+func (f *fallback) start() bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.stop != nil {
+		return false
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		f.poller.run(stop, true)
+		close(done)
+	}()
+	f.stop, f.done = stop, done
+	return true
+}
+
+// stop polling, returns false if the fallback was not polling
+func (f *fallback) stopPolling() bool {
+	if f == nil {
+		return false
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.stop == nil {
+		return false
+	}
+
+	close(f.stop)
+	<-f.done
+	f.stop, f.done = nil, nil
+	return true
+}
+
+// REST endpoints used as fallbacks, fields map the top of book of each response
+
+var binanceUSFallback = PollerConfig{
+	Name: "Binance.US",
+	URL:  "https://api.binance.us/api/v3/ticker/bookTicker?symbol={symbol}",
+	Fields: FieldMapping{
+		Bid: "bidPrice", BidSize: "bidQty",
+		Ask: "askPrice", AskSize: "askQty",
+	},
+}
+
+var bitfinexFallback = PollerConfig{
+	Name: "Bitfinex",
+	URL:  "https://api-pub.bitfinex.com/v2/ticker/{symbol}",
+	Fields: FieldMapping{
+		Bid: "0", BidSize: "1",
+		Ask: "2", AskSize: "3",
+	},
+}
+
+var bitstampFallback = PollerConfig{
+	Name: "Bitstamp",
+	// the ticker has no sizes, the first levels of the book do
+	URL: "https://www.bitstamp.net/api/v2/order_book/{symbol}/",
+	Fields: FieldMapping{
+		Bid: "bids.0.0", BidSize: "bids.0.1",
+		Ask: "asks.0.0", AskSize: "asks.0.1",
+	},
+}
+
+var bybitFallback = PollerConfig{
+	Name: "Bybit",
+	URL:  "https://api.bybit.com/v5/market/tickers?category=spot&symbol={symbol}",
+	Fields: FieldMapping{
+		Bid: "result.list.0.bid1Price", BidSize: "result.list.0.bid1Size",
+		Ask: "result.list.0.ask1Price", AskSize: "result.list.0.ask1Size",
+	},
+}
+
+var coinbaseFallback = PollerConfig{
+	Name: "Coinbase",
+	URL:  "https://api.exchange.coinbase.com/products/{symbol}/book?level=1",
+	Fields: FieldMapping{
+		Bid: "bids.0.0", BidSize: "bids.0.1",
+		Ask: "asks.0.0", AskSize: "asks.0.1",
+	},
+}
+
+var cryptoComFallback = PollerConfig{
+	Name: "Crypto.com",
+	URL:  "https://api.crypto.com/exchange/v1/public/get-book?instrument_name={symbol}&depth=1",
+	Fields: FieldMapping{
+		Bid: "result.data.0.bids.0.0", BidSize: "result.data.0.bids.0.1",
+		Ask: "result.data.0.asks.0.0", AskSize: "result.data.0.asks.0.1",
+	},
+}
+
+var geminiFallback = PollerConfig{
+	Name: "Gemini",
+	URL:  "https://api.gemini.com/v1/book/{symbol}?limit_bids=1&limit_asks=1",
+	Fields: FieldMapping{
+		Bid: "bids.0.price", BidSize: "bids.0.amount",
+		Ask: "asks.0.price", AskSize: "asks.0.amount",
+	},
+}
+
+var kucoinFallback = PollerConfig{
+	Name: "Kucoin",
+	URL:  "https://api.kucoin.com/api/v1/market/orderbook/level1?symbol={symbol}",
+	Fields: FieldMapping{
+		Bid: "data.bestBid", BidSize: "data.bestBidSize",
+		Ask: "data.bestAsk", AskSize: "data.bestAskSize",
+	},
+}
+
+var okxFallback = PollerConfig{
+	Name: "OKX",
+	URL:  "https://www.okx.com/api/v5/market/ticker?instId={symbol}",
+	Fields: FieldMapping{
+		Bid: "data.0.bidPx", BidSize: "data.0.bidSz",
+		Ask: "data.0.askPx", AskSize: "data.0.askSz",
+	},
+}
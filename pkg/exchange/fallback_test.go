@@ -0,0 +1,78 @@
+package exchange
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
+)
+
+func TestFallbackPollsWhileFirstConnecting(t *testing.T) {
+	rest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"bid":"27012.34","ask":"27013.87"}`))
+	}))
+	defer rest.Close()
+
+	// refuse the first connections, then accept and stay idle
+	attempts := &atomic.Int64{}
+	done := make(chan struct{})
+	defer close(done)
+	socket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= 5 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-done
+	}))
+	defer socket.Close()
+
+	updates := make(chan MarketUpdate, updateBufSize)
+	f := newFallback("Test: BTC-USD", PollerConfig{
+		Name:     "Test",
+		URL:      rest.URL + "/{symbol}",
+		Interval: Duration{10 * time.Millisecond},
+		Fields:   FieldMapping{Bid: "bid", Ask: "ask"},
+	}, "BTC-USD", updates)
+
+	// the default policy retries forever
+	conn := ws.New("ws" + strings.TrimPrefix(socket.URL, "http"))
+	conn.SetReconnectPolicy(ws.Policy{
+		InitialInterval: 50 * time.Millisecond,
+		MaxInterval:     50 * time.Millisecond,
+	})
+
+	streaming := make(chan struct{})
+	go f.stream(conn, logger.Named("Test"), func() error {
+		close(streaming)
+		// stream for the rest of the test, then end the stream goroutine
+		// since stream itself reconnects forever with a fallback
+		<-done
+		conn.Close()
+		runtime.Goexit()
+		return nil
+	})
+
+	update := receive(t, updates)
+	if !update.Degraded || update.Bid != "27012.34" || update.Name != "Test: BTC-USD" {
+		t.Errorf("received %+v, expected a degraded quote while connecting", update)
+	}
+
+	receive(t, streaming)
+	if f.stopPolling() {
+		t.Error("still polling after connecting")
+	}
+}
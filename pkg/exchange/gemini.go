@@ -3,7 +3,9 @@
 package exchange
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
@@ -11,26 +13,31 @@ import (
 )
 
 type Gemini struct {
-	updates chan MarketUpdate
-	url     string
-	name    string
-	symbol  string
-	valid   bool
-	logger  *logger.Logger
+	updates     chan MarketUpdate
+	trades      chan Trade
+	url         string
+	name        string
+	symbol      string
+	valid       bool
+	fallback    *fallback
+	parseErrors *parseReporter
+	logger      *logger.Logger
 }
 
 // Create new Gemini struct
 func NewGemini(pair symbol.CurrencyPair) *Gemini {
 	c := make(chan MarketUpdate, updateBufSize)
 	name := fmt.Sprintf("Gemini: %s", pair.Gemini)
+	logger := logger.Named(name)
 
 	return &Gemini{
-		updates: c,
-		url:     fmt.Sprintf("wss://api.gemini.com/v1/marketdata/%s?top_of_book=true", pair.Gemini),
-		name:    name,
-		symbol:  pair.Gemini,
-		valid:   pair.Gemini != "",
-		logger:  logger.Named(name),
+		updates:     c,
+		url:         fmt.Sprintf("wss://api.gemini.com/v1/marketdata/%s?top_of_book=true", pair.Gemini),
+		name:        name,
+		symbol:      pair.Gemini,
+		valid:       pair.Gemini != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
 	}
 }
 
@@ -38,43 +45,50 @@ func NewGemini(pair symbol.CurrencyPair) *Gemini {
 // over the updates channel as a MarketUpdate struct
 func (e *Gemini) Recv() {
 	e.logger.Debug("connecting to socket")
-	conn := ws.New(e.url)
-	if err := conn.Connect(); err != nil {
-		e.logger.Warn("could not connect to socket, RETURNING")
-		return
+	url := e.url
+	if e.trades != nil {
+		url += "&trades=true"
 	}
-	e.logger.Debug("connected to socket")
-
-	var ask string
-	var askSize string
-	var bid string
-	var bidSize string
-	for {
-		var message geminiMessage
-		if err := conn.ReadJSON(&message); err != nil {
-			e.logger.Warn(err, " RETURNING")
-			continue
-		}
 
-		for _, event := range message.Events {
-			if event.Side == "bid" {
-				bid = event.Price
-				bidSize = event.Remaining
+	conn := ws.New(url)
+	conn.SetKeepalive(keepaliveInterval)
+	conn.SetReadTimeout(readTimeout)
+
+	quote := MarketUpdate{}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote, the book is resent on reconnect
+		e.updates <- MarketUpdate{Name: e.name}
+		quote = MarketUpdate{}
+	})
+	e.fallback.stream(conn, e.logger, func() error {
+		for {
+			_, rawMessage, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+
+			update, trades, err := parseGeminiUpdate(rawMessage, quote)
+			if err != nil {
+				e.parseErrors.report("message", rawMessage, err)
+				continue
 			}
-			if event.Side == "ask" {
-				ask = event.Price
-				askSize = event.Remaining
+			if e.trades != nil {
+				for _, trade := range trades {
+					trade.Name = e.name
+					e.trades <- trade
+				}
+			}
+
+			// nothing to publish until the book has been received
+			quote = update
+			if quote.Bid == "" && quote.Ask == "" {
+				continue
 			}
-		}
 
-		e.updates <- MarketUpdate{
-			Ask:     ask,
-			AskSize: askSize,
-			Bid:     bid,
-			BidSize: bidSize,
-			Name:    e.name,
+			quote.Name = e.name
+			e.updates <- quote
 		}
-	}
+	})
 }
 
 // Name of data source
@@ -90,6 +104,63 @@ func (e *Gemini) Valid() bool {
 	return e.valid
 }
 
+// Poll the REST v1 book while the websocket is down, must be called before Recv
+func (e *Gemini) EnableFallback() {
+	e.fallback = newFallback(e.name, geminiFallback, e.symbol, e.updates)
+}
+
+// Access to trade channel, requests trade events if called before Recv
+func (e *Gemini) Trades() chan Trade {
+	if e.trades == nil {
+		e.trades = make(chan Trade, updateBufSize)
+	}
+	return e.trades
+}
+
+// apply the events of an update message to the top of book in quote,
+// returning the new top of book and the trades in the message
+func parseGeminiUpdate(rawMessage []byte, quote MarketUpdate) (MarketUpdate, []Trade, error) {
+	var message geminiMessage
+	if err := json.Unmarshal(rawMessage, &message); err != nil {
+		return MarketUpdate{}, nil, err
+	}
+
+	var trades []Trade
+	for _, event := range message.Events {
+		if event.Type == "trade" {
+			// report the taker's side
+			side := Buy
+			if event.MakerSide == "bid" {
+				side = Sell
+			}
+
+			trade := Trade{
+				Price: event.Price,
+				Size:  event.Amount,
+				Side:  side,
+				ID:    fmt.Sprint(event.Tid),
+				Time:  time.UnixMilli(int64(message.TimestampMS)),
+			}
+			if err := checkTrade(trade); err != nil {
+				return MarketUpdate{}, nil, err
+			}
+			trades = append(trades, trade)
+			continue
+		}
+
+		if event.Side == "bid" {
+			quote.Bid = event.Price
+			quote.BidSize = event.Remaining
+		}
+		if event.Side == "ask" {
+			quote.Ask = event.Price
+			quote.AskSize = event.Remaining
+		}
+	}
+
+	return quote, trades, nil
+}
+
 // Struct to represent Gemini json message
 type geminiMessage struct {
 	Type           string        `json:"type"`
@@ -108,4 +179,7 @@ type geminiEvent struct {
 	Remaining string `json:"remaining"`
 	Delta     string `json:"delta"`
 	Reason    string `json:"reason"`
+	Tid       int64  `json:"tid"`
+	Amount    string `json:"amount"`
+	MakerSide string `json:"makerSide"`
 }
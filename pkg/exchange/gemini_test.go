@@ -0,0 +1,74 @@
+package exchange
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseGeminiUpdate(t *testing.T) {
+	quote, trades, err := parseGeminiUpdate(fixture(t, "gemini/initial.json"), MarketUpdate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 0 {
+		t.Errorf("parsed trades %+v from the initial book", trades)
+	}
+
+	// a trade at the ask reduces it
+	quote, trades, err = parseGeminiUpdate(fixture(t, "gemini/trade.json"), quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := MarketUpdate{
+		Bid: "27011.97", BidSize: "0.2",
+		Ask: "27014.62", AskSize: "0.04",
+	}
+	if quote != want {
+		t.Errorf("parsed %+v, expected %+v", quote, want)
+	}
+
+	wantTrade := Trade{
+		Price: "27014.62",
+		Size:  "0.01",
+		Side:  Buy,
+		ID:    "54125311027",
+		Time:  time.UnixMilli(1683037867512),
+	}
+	if len(trades) != 1 || trades[0] != wantTrade {
+		t.Errorf("parsed trades %+v, expected %+v", trades, wantTrade)
+	}
+}
+
+func FuzzParseGemini(f *testing.F) {
+	f.Add(fixture(f, "gemini/initial.json"))
+	f.Add(fixture(f, "gemini/trade.json"))
+	f.Add([]byte(`{"type":"heartbeat","socket_sequence":12}`))
+	f.Add([]byte(`{"type":"update","events":[{"type":"change","side":"bid"}]}`))
+	f.Add([]byte(`{"type":"update","events":[{"type":"trade","tid":"1","price":27014.62}]}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, trades, err := parseGeminiUpdate(data, MarketUpdate{})
+		if err != nil {
+			return
+		}
+		var message geminiMessage
+		json.Unmarshal(data, &message)
+		var makerSides []string
+		for _, event := range message.Events {
+			if event.Type == "trade" {
+				makerSides = append(makerSides, event.MakerSide)
+			}
+		}
+
+		for i, trade := range trades {
+			requireNumbers(t, data, trade.Price, trade.Size)
+
+			// the taker's side is reported, opposite to the maker's
+			if (trade.Side == Sell) != (makerSides[i] == "bid") {
+				t.Errorf("trade %d is a %s with maker side %q in %s", i, trade.Side, makerSides[i], data)
+			}
+		}
+	})
+}
@@ -0,0 +1,373 @@
+// Aggregate top of book updates for several currency pairs listed on Gemini
+// over a single connection to the v2 market data API
+
+package exchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
+)
+
+type GeminiV2 struct {
+	url         string
+	name        string
+	symbols     []string
+	views       map[string]*GeminiV2Symbol
+	books       map[string]*book.Book
+	resyncing   map[string]bool
+	valid       bool
+	once        *sync.Once
+	parseErrors *parseReporter
+	logger      *logger.Logger
+}
+
+// One symbol of a GeminiV2 connection. Each symbol is a separate exchange with
+// its own channels, named the same as the v1 Gemini adapter
+type GeminiV2Symbol struct {
+	conn    *GeminiV2
+	updates chan MarketUpdate
+	trades  chan Trade
+	depth   chan book.Snapshot
+	candles chan Candle
+	symbol  string
+	name    string
+}
+
+// Create new GeminiV2 struct subscribed to every pair listed on Gemini
+func NewGeminiV2(pairs ...symbol.CurrencyPair) *GeminiV2 {
+	var symbols []string
+	for _, pair := range pairs {
+		if pair.Gemini != "" {
+			symbols = append(symbols, strings.ToUpper(pair.Gemini))
+		}
+	}
+	name := fmt.Sprintf("Gemini v2: %s", strings.Join(symbols, ","))
+	logger := logger.Named(name)
+
+	e := &GeminiV2{
+		url:         "wss://api.gemini.com/v2/marketdata",
+		name:        name,
+		symbols:     symbols,
+		views:       make(map[string]*GeminiV2Symbol),
+		valid:       len(symbols) != 0,
+		once:        &sync.Once{},
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
+	}
+	for _, symbol := range symbols {
+		e.views[symbol] = &GeminiV2Symbol{
+			conn:    e,
+			updates: make(chan MarketUpdate, updateBufSize),
+			symbol:  symbol,
+			name:    fmt.Sprintf("Gemini: %s", symbol),
+		}
+	}
+
+	return e
+}
+
+// Exchanges sharing the connection, one per symbol in the order the pairs were given
+func (e *GeminiV2) Symbols() []*GeminiV2Symbol {
+	views := make([]*GeminiV2Symbol, 0, len(e.symbols))
+	for _, symbol := range e.symbols {
+		views = append(views, e.views[symbol])
+	}
+	return views
+}
+
+// Receive l2 data for every symbol and send any top of book updates over the
+// updates channel of the symbol. Only the first call connects, the others block
+func (e *GeminiV2) Recv() {
+	e.once.Do(e.recv)
+}
+
+func (e *GeminiV2) recv() {
+	e.logger.Debug("connecting to socket")
+	conn := ws.New(e.url)
+	conn.SetKeepalive(keepaliveInterval)
+	conn.SetReadTimeout(readTimeout)
+
+	subscriptions := []geminiV2Subscription{{Name: "l2", Symbols: e.symbols}}
+	var candleSymbols []string
+	for _, symbol := range e.symbols {
+		if e.views[symbol].candles != nil {
+			candleSymbols = append(candleSymbols, symbol)
+		}
+	}
+	if len(candleSymbols) != 0 {
+		subscriptions = append(subscriptions, geminiV2Subscription{Name: "candles_1m", Symbols: candleSymbols})
+	}
+
+	conn.SetOnConnect(func(c *ws.Client) error {
+		// the first l2 update of each symbol is a full book
+		e.books = make(map[string]*book.Book)
+		e.resyncing = make(map[string]bool)
+
+		return c.WriteJSON(geminiV2Request{
+			Type:          "subscribe",
+			Subscriptions: subscriptions,
+		})
+	})
+
+	if err := conn.Connect(); err != nil {
+		e.logger.Warn("could not connect to socket, RETURNING")
+		return
+	}
+	e.logger.Debug("connected to socket")
+
+	lastUpdates := make(map[string]MarketUpdate)
+	conn.OnDisconnect(func(error) {
+		// withdraw every symbol's stale quote while reconnecting
+		for symbol := range lastUpdates {
+			view := e.views[symbol]
+			view.updates <- MarketUpdate{Name: view.name}
+		}
+		lastUpdates = make(map[string]MarketUpdate)
+	})
+	for {
+		_, rawMessage, err := conn.ReadMessage()
+		if err != nil {
+			e.logger.Warn(err, " RETURNING")
+			return
+		}
+
+		var message geminiV2Message
+		if err := json.Unmarshal(rawMessage, &message); err != nil {
+			e.parseErrors.report("message", rawMessage, err)
+			continue
+		}
+
+		view, ok := e.views[message.Symbol]
+		if !ok {
+			continue
+		}
+
+		switch message.Type {
+		case "l2_updates":
+			// a full book carries the latest trades, incrementals do not
+			full := message.Trades != nil
+			if e.resyncing[message.Symbol] {
+				if !full {
+					// sent before the book was requested again
+					continue
+				}
+				delete(e.resyncing, message.Symbol)
+			}
+
+			b, ok := e.books[message.Symbol]
+			if !ok {
+				b = book.New()
+				e.books[message.Symbol] = b
+			}
+
+			if err := e.mergeL2(b, &message); err != nil {
+				e.logger.Warn(message.Symbol, " l2 book out of sync ", err)
+				delete(e.books, message.Symbol)
+				e.resyncing[message.Symbol] = true
+
+				// withdraw the quote until the full book arrives
+				if _, ok := lastUpdates[message.Symbol]; ok {
+					view.updates <- MarketUpdate{Name: view.name}
+					delete(lastUpdates, message.Symbol)
+				}
+				if err := e.resubscribe(conn, message.Symbol); err != nil {
+					e.logger.Warn("could not resubscribe to ", message.Symbol, " ", err)
+				}
+				continue
+			}
+
+			for _, trade := range message.Trades {
+				view.sendTrade(trade)
+			}
+
+			update := bookUpdate(b, view.name)
+			if update != lastUpdates[message.Symbol] {
+				view.updates <- update
+			}
+			lastUpdates[message.Symbol] = update
+			if view.depth != nil {
+				view.depth <- b.Snapshot(view.name, depthLevels)
+			}
+		case "trade":
+			view.sendTrade(message.geminiV2Trade)
+		case "candles_1m_updates":
+			if view.candles == nil {
+				continue
+			}
+
+			var candles [][]json.Number
+			if err := json.Unmarshal(message.Changes, &candles); err != nil {
+				e.parseErrors.report("candles", rawMessage, err)
+				continue
+			}
+
+			for _, change := range candles {
+				if len(change) < 6 {
+					e.parseErrors.report("candles", rawMessage, fmt.Errorf("malformed candle %v", change))
+					continue
+				}
+
+				start, err := change[0].Int64()
+				if err != nil {
+					e.parseErrors.report("candles", rawMessage, err)
+					continue
+				}
+				view.candles <- Candle{
+					Interval: time.Minute,
+					Start:    time.UnixMilli(start),
+					Open:     change[1].String(),
+					High:     change[2].String(),
+					Low:      change[3].String(),
+					Close:    change[4].String(),
+					Volume:   change[5].String(),
+					Name:     view.name,
+				}
+			}
+		}
+	}
+}
+
+// Name of the connection
+func (e *GeminiV2) Name() string {
+	return e.name
+}
+
+func (e *GeminiV2) Valid() bool {
+	return e.valid
+}
+
+// Receive updates for the symbol, connecting the shared connection if no other
+// symbol has
+func (e *GeminiV2Symbol) Recv() {
+	e.conn.Recv()
+}
+
+// Name of data source
+func (e *GeminiV2Symbol) Name() string {
+	return e.name
+}
+
+func (e *GeminiV2Symbol) Updates() chan MarketUpdate {
+	return e.updates
+}
+
+func (e *GeminiV2Symbol) Valid() bool {
+	return true
+}
+
+// Access to trade channel, trades are included in the l2 feed
+func (e *GeminiV2Symbol) Trades() chan Trade {
+	if e.trades == nil {
+		e.trades = make(chan Trade, updateBufSize)
+	}
+	return e.trades
+}
+
+// Access to depth channel, publishes the l2 book of the symbol if called before Recv
+func (e *GeminiV2Symbol) Depth() chan book.Snapshot {
+	if e.depth == nil {
+		e.depth = make(chan book.Snapshot, updateBufSize)
+	}
+	return e.depth
+}
+
+// Access to candle channel, subscribes to one minute candles if called before
+// any symbol of the connection is received
+func (e *GeminiV2Symbol) Candles() chan Candle {
+	if e.candles == nil {
+		e.candles = make(chan Candle, updateBufSize)
+	}
+	return e.candles
+}
+
+// apply the changes of an l2 update to a symbol's book
+func (e *GeminiV2) mergeL2(b *book.Book, message *geminiV2Message) error {
+	if len(message.Changes) == 0 {
+		return nil
+	}
+
+	var changes [][]string
+	if err := json.Unmarshal(message.Changes, &changes); err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if len(change) < 3 {
+			return fmt.Errorf("malformed change %v", change)
+		}
+
+		var side book.Side
+		switch change[0] {
+		case "buy":
+			side = book.Bid
+		case "sell":
+			side = book.Ask
+		default:
+			return fmt.Errorf("unknown side %q", change[0])
+		}
+		if err := b.Set(side, change[1], change[2]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// request the full l2 book of a symbol again by resubscribing to it
+func (e *GeminiV2) resubscribe(c *ws.Client, symbol string) error {
+	l2 := []geminiV2Subscription{{Name: "l2", Symbols: []string{symbol}}}
+	if err := c.WriteJSON(geminiV2Request{Type: "unsubscribe", Subscriptions: l2}); err != nil {
+		return err
+	}
+	return c.WriteJSON(geminiV2Request{Type: "subscribe", Subscriptions: l2})
+}
+
+func (e *GeminiV2Symbol) sendTrade(trade geminiV2Trade) {
+	if e.trades == nil {
+		return
+	}
+
+	e.trades <- Trade{
+		Price: trade.Price,
+		Size:  trade.Quantity,
+		Side:  trade.Side,
+		ID:    fmt.Sprint(trade.EventId),
+		Time:  time.UnixMilli(trade.Timestamp),
+		Name:  e.name,
+	}
+}
+
+type geminiV2Request struct {
+	Type          string                 `json:"type"`
+	Subscriptions []geminiV2Subscription `json:"subscriptions"`
+}
+
+type geminiV2Subscription struct {
+	Name    string   `json:"name"`
+	Symbols []string `json:"symbols"`
+}
+
+// Struct to represent every Gemini v2 json message, fields are set by type
+type geminiV2Message struct {
+	geminiV2Trade
+	Type    string          `json:"type"`
+	Symbol  string          `json:"symbol"`
+	Changes json.RawMessage `json:"changes"`
+	Trades  []geminiV2Trade `json:"trades"`
+}
+
+type geminiV2Trade struct {
+	EventId   int64  `json:"event_id"`
+	Timestamp int64  `json:"timestamp"`
+	Price     string `json:"price"`
+	Quantity  string `json:"quantity"`
+	Side      string `json:"side"`
+}
@@ -0,0 +1,163 @@
+package exchange
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+)
+
+func TestGeminiV2SymbolsHaveSeparateChannels(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	url := newVenueServer(t, func(conn *websocket.Conn) {
+		var request geminiV2Request
+		readRequest(t, conn, &request)
+		if len(request.Subscriptions) != 1 || len(request.Subscriptions[0].Symbols) != 2 {
+			t.Errorf("subscribed to %+v, expected l2 for both symbols", request.Subscriptions)
+		}
+
+		send(t, conn,
+			fixture(t, "geminiv2/l2_btcusd.json"),
+			// not subscribed
+			fixture(t, "geminiv2/l2_dogeusd.json"),
+			fixture(t, "geminiv2/l2_ethusd.json"),
+			fixture(t, "geminiv2/trade_ethusd.json"),
+		)
+		<-done
+	})
+
+	e := NewGeminiV2(symbol.CurrencyPair{Gemini: "btcusd"}, symbol.CurrencyPair{Gemini: "ethusd"})
+	e.url = url
+	symbols := e.Symbols()
+	if len(symbols) != 2 {
+		t.Fatalf("%d symbols, expected 2", len(symbols))
+	}
+	btc, eth := symbols[0], symbols[1]
+	btcTrades, ethTrades := btc.Trades(), eth.Trades()
+
+	// every symbol receives, only one connects
+	go btc.Recv()
+	go eth.Recv()
+
+	expected := MarketUpdate{
+		Bid: "27011.51", BidSize: "0.25000000",
+		Ask: "27013.02", AskSize: "0.40000000",
+		Name: "Gemini: BTCUSD",
+	}
+	if update := receive(t, btc.Updates()); update != expected {
+		t.Errorf("BTCUSD received %+v, expected %+v", update, expected)
+	}
+
+	expected = MarketUpdate{
+		Bid: "1865.12", BidSize: "4.50000000",
+		Ask: "1865.48", AskSize: "2.20000000",
+		Name: "Gemini: ETHUSD",
+	}
+	if update := receive(t, eth.Updates()); update != expected {
+		t.Errorf("ETHUSD received %+v, expected %+v", update, expected)
+	}
+
+	if trade := receive(t, btcTrades); trade.Name != "Gemini: BTCUSD" || trade.Price != "27012.10" {
+		t.Errorf("BTCUSD received trade %+v", trade)
+	}
+	if trade := receive(t, ethTrades); trade.Name != "Gemini: ETHUSD" || trade.Price != "1865.48" {
+		t.Errorf("ETHUSD received trade %+v", trade)
+	}
+
+	select {
+	case update := <-btc.Updates():
+		t.Errorf("BTCUSD received another symbol's update %+v", update)
+	default:
+	}
+}
+
+func TestGeminiV2ResubscribesOutOfSyncBook(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	url := newVenueServer(t, func(conn *websocket.Conn) {
+		var request geminiV2Request
+		readRequest(t, conn, &request)
+		send(t, conn,
+			fixture(t, "geminiv2/l2_btcusd.json"),
+			fixture(t, "geminiv2/l2_btcusd_malformed.json"),
+		)
+
+		// the symbol's l2 subscription is replaced to receive a full book
+		for _, expected := range []string{"unsubscribe", "subscribe"} {
+			var request geminiV2Request
+			readRequest(t, conn, &request)
+			if request.Type != expected || len(request.Subscriptions) != 1 ||
+				request.Subscriptions[0].Name != "l2" || len(request.Subscriptions[0].Symbols) != 1 ||
+				request.Subscriptions[0].Symbols[0] != "BTCUSD" {
+				t.Errorf("received %+v, expected to %s l2 for BTCUSD", request, expected)
+			}
+		}
+
+		send(t, conn,
+			// in flight before the unsubscribe, ignored
+			fixture(t, "geminiv2/l2_btcusd_update.json"),
+			fixture(t, "geminiv2/l2_btcusd_resubscribed.json"),
+		)
+		<-done
+	})
+
+	e := NewGeminiV2(symbol.CurrencyPair{Gemini: "btcusd"})
+	e.url = url
+	btc := e.Symbols()[0]
+	go btc.Recv()
+
+	if update := receive(t, btc.Updates()); update.Bid != "27011.51" {
+		t.Errorf("received %+v before the malformed update", update)
+	}
+	if update := receive(t, btc.Updates()); update != (MarketUpdate{Name: "Gemini: BTCUSD"}) {
+		t.Errorf("received %+v, expected the quote to be withdrawn", update)
+	}
+
+	expected := MarketUpdate{
+		Bid: "27009.80", BidSize: "0.50000000",
+		Ask: "27012.75", AskSize: "1.20000000",
+		Name: "Gemini: BTCUSD",
+	}
+	if update := receive(t, btc.Updates()); update != expected {
+		t.Errorf("received %+v after resubscribing, expected %+v", update, expected)
+	}
+}
+
+func FuzzParseGeminiV2(f *testing.F) {
+	f.Add(fixture(f, "geminiv2/l2_btcusd.json"))
+	f.Add(fixture(f, "geminiv2/l2_btcusd_update.json"))
+	f.Add(fixture(f, "geminiv2/l2_btcusd_malformed.json"))
+	f.Add([]byte(`{"type":"l2_updates","symbol":"BTCUSD","changes":[["hold","27011.51","1"],["sell","27013.02","0"]]}`))
+	f.Add([]byte(`{"type":"l2_updates","symbol":"BTCUSD","changes":{}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var message geminiV2Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			return
+		}
+
+		b := book.New()
+		if err := (&GeminiV2{}).mergeL2(b, &message); err != nil {
+			return
+		}
+
+		// [side, price, size] changes, buys are bids
+		var changes [][]string
+		json.Unmarshal(message.Changes, &changes)
+		var bids, asks [][]string
+		for _, change := range changes {
+			if change[0] == "buy" {
+				bids = append(bids, change[1:])
+			} else {
+				asks = append(asks, change[1:])
+			}
+		}
+		requireLevels(t, data, b.Bids(0), bids)
+		requireLevels(t, data, b.Asks(0), asks)
+	})
+}
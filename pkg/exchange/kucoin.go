@@ -6,21 +6,32 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/transport"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
 )
 
 type Kucoin struct {
 	updates      chan MarketUpdate
+	trades       chan Trade
+	depth        chan book.Snapshot
+	level2       *kucoinLevel2
 	symbol       string
 	name         string
 	url          string
 	valid        bool
 	pingInterval int
+	pingTimeout  int
+	fallback     *fallback
+	pool         *ws.Pool
+	parseErrors  *parseReporter
 	logger       *logger.Logger
 }
 
@@ -31,11 +42,12 @@ func NewKucoin(pair symbol.CurrencyPair) *Kucoin {
 	logger := logger.Named(name)
 
 	k := &Kucoin{
-		updates: c,
-		symbol:  s,
-		name:    name,
-		valid:   s != "",
-		logger:  logger,
+		updates:     c,
+		symbol:      s,
+		name:        name,
+		valid:       s != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
 	}
 
 	if err := k.applyForInstanceServer(); err != nil {
@@ -47,11 +59,41 @@ func NewKucoin(pair symbol.CurrencyPair) *Kucoin {
 }
 
 func (e *Kucoin) Recv() {
+	topics := []string{fmt.Sprintf("/market/ticker:%s", e.symbol)}
+	if e.depth != nil {
+		// top of book is taken from the local book instead of the ticker
+		topics = []string{fmt.Sprintf("/market/level2:%s", e.symbol)}
+	}
+	if e.trades != nil {
+		topics = append(topics, fmt.Sprintf("/market/match:%s", e.symbol))
+	}
+
+	if e.pool != nil {
+		e.recvPooled(topics)
+		return
+	}
+
 	// connect to websocket
 	e.logger.Debug("connecting to socket")
 	conn := ws.New(e.url)
+	// the url changes whenever a new token is granted
+	conn.SetURLFunc(func() (string, error) {
+		return e.url, nil
+	})
+	conn.SetAppPing(time.Duration(e.pingInterval)*time.Millisecond, func(c *ws.Client) error {
+		return c.WriteJSON(kucoinMessage{
+			Id:   "1",
+			Type: "ping",
+		})
+	})
+	conn.SetReadTimeout(time.Duration(e.pingInterval+e.pingTimeout) * time.Millisecond)
+	conn.SetRateLimit(websocketLimiter("Kucoin"))
+	conn.SetPingRateLimit(pingLimiter("Kucoin"))
 
 	conn.SetOnConnect(func(c *ws.Client) error {
+		// updates may have been missed while disconnected
+		e.level2 = newKucoinLevel2(e.symbol)
+
 		// welcome message
 		var welcomeMessage kucoinMessage
 		if err := c.ReadJSON(&welcomeMessage); err != nil {
@@ -65,119 +107,528 @@ func (e *Kucoin) Recv() {
 			return err
 		}
 
-		err := c.WriteJSON(kucoinSubscribe{
-			kucoinMessage: kucoinMessage{
-				Type: "subscribe",
-				Id:   "1",
-			},
-			Topic:          fmt.Sprintf("/market/ticker:%s", e.symbol),
-			PrivateChannel: false,
-			Response:       true,
-		})
-		if err != nil {
-			// if error in connection, apply for new token
-			e.applyForInstanceServer()
-			return err
+		for i, topic := range topics {
+			err := c.WriteJSON(kucoinSubscribe{
+				kucoinMessage: kucoinMessage{
+					Type: "subscribe",
+					Id:   fmt.Sprint(i + 1),
+				},
+				Topic:          topic,
+				PrivateChannel: false,
+				Response:       true,
+			})
+			if err != nil {
+				// if error in connection, apply for new token
+				e.applyForInstanceServer()
+				return err
+			}
 		}
 
-		var ackMessage kucoinMessage
-		if err := c.ReadJSON(&ackMessage); err != nil {
-			// if error in connection, apply for new token
-			e.applyForInstanceServer()
-			return err
+		// acks are handled with the data, which may arrive before them
+		return nil
+	})
+
+	lastUpdate := MarketUpdate{}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
+	})
+	e.fallback.stream(conn, e.logger, func() error {
+		for {
+			_, rawMessage, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+
+			e.handle(rawMessage, &lastUpdate)
 		}
+	})
+}
 
-		return nil
+// receive messages for topics over a shared connection pool
+func (e *Kucoin) recvPooled(topics []string) {
+	e.level2 = newKucoinLevel2(e.symbol)
+
+	// a nil message marks a lost connection
+	messages := make(chan []byte, updateBufSize)
+	subscribed := make(map[string]bool)
+	for _, topic := range topics {
+		subscribed[topic] = true
+	}
+	e.pool.OnDisconnect(func(topic string) {
+		if !subscribed[topic] {
+			return
+		}
+		// runs on the pool's connection, which must not wait for this reader
+		select {
+		case messages <- nil:
+		default:
+			e.logger.Warn("message buffer full, quote not withdrawn while reconnecting")
+		}
 	})
 
-	if err := conn.Connect(); err != nil {
-		e.logger.Warn("could not connect to socket, RETURNING")
-		return
+	for _, topic := range topics {
+		c, err := e.pool.Subscribe(topic)
+		if err != nil {
+			e.logger.Warn("could not subscribe to ", topic, " ", err, ", RETURNING")
+			return
+		}
+
+		go func(c chan []byte) {
+			for message := range c {
+				messages <- message
+			}
+		}(c)
 	}
-	e.logger.Debug("connected to socket")
 
-	ticker := time.NewTicker(time.Duration(e.pingInterval) * time.Millisecond)
 	lastUpdate := MarketUpdate{}
-	for {
-		select {
-		case <-ticker.C:
-			e.logger.Debug("sending ping")
-			conn.WriteJSON(kucoinMessage{
-				Id:   "1",
-				Type: "ping",
-			})
-		default:
-			_, rawMessage, err := conn.ReadMessage()
-			if err != nil {
-				e.logger.Warn("Could not read message", err)
-				continue
+	for rawMessage := range messages {
+		if rawMessage == nil {
+			// withdraw the stale quote while reconnecting, updates may be
+			// missed until then
+			if lastUpdate != (MarketUpdate{}) {
+				e.updates <- MarketUpdate{Name: e.name}
+				lastUpdate = MarketUpdate{}
 			}
+			e.level2 = newKucoinLevel2(e.symbol)
+			continue
+		}
 
-			var message kucoinMessage
-			json.Unmarshal(rawMessage, &message)
-			if message.Type == "pong" {
-				e.logger.Debug("pong received")
-				continue
-			} else if message.Type == "message" {
-				var tickerMessage kucoinTickerMessage
-				json.Unmarshal(rawMessage, &tickerMessage)
-				update := MarketUpdate{
-					Ask:     tickerMessage.Data.BestAsk,
-					AskSize: tickerMessage.Data.BestAskSize,
-					Bid:     tickerMessage.Data.BestBid,
-					BidSize: tickerMessage.Data.BestBidSize,
-					Name:    e.name,
-				}
-
-				if update != lastUpdate {
-					e.updates <- update
-				}
-				lastUpdate = update
-			} else {
-				e.logger.Warn("unknown message", string(rawMessage))
+		e.handle(rawMessage, &lastUpdate)
+	}
+}
+
+// handle a ticker, level2 or match message
+func (e *Kucoin) handle(rawMessage []byte, lastUpdate *MarketUpdate) {
+	var message kucoinTopicMessage
+	if err := json.Unmarshal(rawMessage, &message); err != nil {
+		e.parseErrors.report("message", rawMessage, err)
+		return
+	}
+
+	if message.Type == "pong" {
+		e.logger.Debug("pong received")
+		return
+	} else if message.Type == "ack" {
+		e.logger.Debug("subscription acknowledged ", message.Id)
+		return
+	} else if message.Type == "message" && strings.HasPrefix(message.Topic, "/market/match:") {
+		var matchMessage kucoinMatchMessage
+		if err := json.Unmarshal(rawMessage, &matchMessage); err != nil {
+			e.parseErrors.report("trade", rawMessage, err)
+			return
+		}
+
+		nanos, err := strconv.ParseInt(matchMessage.Data.Time, 10, 64)
+		if err != nil {
+			e.parseErrors.report("trade", rawMessage, err)
+			return
+		}
+		e.trades <- Trade{
+			Price: matchMessage.Data.Price,
+			Size:  matchMessage.Data.Size,
+			Side:  matchMessage.Data.Side,
+			ID:    matchMessage.Data.TradeId,
+			Time:  time.Unix(0, nanos),
+			Name:  e.name,
+		}
+	} else if message.Type == "message" && strings.HasPrefix(message.Topic, "/market/level2:") {
+		var level2Message kucoinLevel2Message
+		if err := json.Unmarshal(rawMessage, &level2Message); err != nil {
+			e.parseErrors.report("level2", rawMessage, err)
+			return
+		}
+
+		changed, err := e.level2.merge(level2Message.Data)
+		if err != nil {
+			e.logger.Warn("level2 book out of sync ", err)
+			// the book is rebuilt from the next snapshot, withdraw its
+			// quote until then
+			if *lastUpdate != (MarketUpdate{}) {
+				e.updates <- MarketUpdate{Name: e.name}
+				*lastUpdate = MarketUpdate{}
 			}
+			return
+		}
+		if !changed {
+			return
+		}
+
+		update := bookUpdate(e.level2.book, e.name)
+		if update != *lastUpdate {
+			e.updates <- update
 		}
+		*lastUpdate = update
+		e.depth <- e.level2.book.Snapshot(e.name, depthLevels)
+	} else if message.Type == "message" {
+		update, err := parseKucoinTicker(rawMessage)
+		if err != nil {
+			e.parseErrors.report("ticker", rawMessage, err)
+			return
+		}
+		update.Name = e.name
+
+		if update != *lastUpdate {
+			e.updates <- update
+		}
+		*lastUpdate = update
+	} else {
+		e.logger.Warn("unknown message", string(rawMessage))
 	}
 }
 
+// top of book from a ticker message
+func parseKucoinTicker(rawMessage []byte) (MarketUpdate, error) {
+	var tickerMessage kucoinTickerMessage
+	if err := json.Unmarshal(rawMessage, &tickerMessage); err != nil {
+		return MarketUpdate{}, err
+	}
+
+	update := MarketUpdate{
+		Ask:     tickerMessage.Data.BestAsk,
+		AskSize: tickerMessage.Data.BestAskSize,
+		Bid:     tickerMessage.Data.BestBid,
+		BidSize: tickerMessage.Data.BestBidSize,
+	}
+	return update, checkQuote(update)
+}
+
 func (e *Kucoin) applyForInstanceServer() error {
-	resp, err := http.Post("https://api.kucoin.com/api/v1/bullet-public", "", nil)
 	e.logger.Info("applying for instance server token")
+	url, server, err := requestKucoinInstanceServer()
 	if err != nil {
 		e.logger.Warn("Could not generate Kucoin Websocket URL", err)
 		return err
 	}
+
+	e.url = url
+	e.pingInterval = server.PingInterval
+	e.pingTimeout = server.PingTimeout
+	e.logger.Info("granted instance server token")
+	return nil
+}
+
+// request a public token, returning the websocket url and its instance server
+func requestKucoinInstanceServer() (string, kucoinInstanceServer, error) {
+	if err := restLimiter("Kucoin", 0).Wait(); err != nil {
+		return "", kucoinInstanceServer{}, err
+	}
+
+	resp, err := transport.HTTPClient().Post("https://api.kucoin.com/api/v1/bullet-public", "", nil)
+	if err != nil {
+		return "", kucoinInstanceServer{}, err
+	}
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		e.logger.Warn("Could not generate Kucoin Websocket URL", err)
-		return err
+		return "", kucoinInstanceServer{}, err
 	}
 
 	var httpResponse kucoinHttpResponse
-	json.Unmarshal(body, &httpResponse)
-
-	base := httpResponse.Data.InstanceServers[0].Endpoint
-	token := httpResponse.Data.Token
+	if err := json.Unmarshal(body, &httpResponse); err != nil {
+		return "", kucoinInstanceServer{}, err
+	}
+	if len(httpResponse.Data.InstanceServers) == 0 {
+		return "", kucoinInstanceServer{}, fmt.Errorf("no instance servers granted, code %s", httpResponse.Code)
+	}
 
-	e.url = fmt.Sprintf("%s?token=%s", base, token)
-	e.pingInterval = httpResponse.Data.InstanceServers[0].PingInterval
-	e.logger.Info("granted instance server token ", token)
-	return nil
+	server := httpResponse.Data.InstanceServers[0]
+	return fmt.Sprintf("%s?token=%s", server.Endpoint, httpResponse.Data.Token), server, nil
 }
 
 func (e *Kucoin) Updates() chan MarketUpdate {
 	return e.updates
 }
 
+// Access to trade channel, subscribes to the match topic if called before Recv
+func (e *Kucoin) Trades() chan Trade {
+	if e.trades == nil {
+		e.trades = make(chan Trade, updateBufSize)
+	}
+	return e.trades
+}
+
+// Access to depth channel, switches to the level2 feed and maintains a local
+// book if called before Recv
+func (e *Kucoin) Depth() chan book.Snapshot {
+	if e.depth == nil {
+		e.depth = make(chan book.Snapshot, updateBufSize)
+	}
+	return e.depth
+}
+
 func (e *Kucoin) Valid() bool {
 	return e.valid
 }
 
+// Poll the REST level 1 book while the websocket is down, must be called before Recv
+func (e *Kucoin) EnableFallback() {
+	e.fallback = newFallback(e.name, kucoinFallback, e.symbol, e.updates)
+}
+
 func (e *Kucoin) Name() string {
 	return e.name
 }
 
+// Share connections with other Kucoin adapters through pool, which must be
+// created with NewKucoinPool. Must be called before Recv
+func (e *Kucoin) SetPool(pool *ws.Pool) {
+	e.pool = pool
+}
+
+// Kucoin allows 100 topics per connection
+const kucoinMaxTopics = 100
+
+// Create a connection pool shared by Kucoin adapters
+func NewKucoinPool() *ws.Pool {
+	return ws.NewPool("Kucoin", &kucoinProtocol{
+		mux:    &sync.Mutex{},
+		logger: logger.Named("Kucoin Pool"),
+	})
+}
+
+// ws.Protocol for Kucoin's public feed
+type kucoinProtocol struct {
+	// ping settings of the last granted instance server
+	mux    *sync.Mutex
+	server kucoinInstanceServer
+	logger *logger.Logger
+}
+
+func (p *kucoinProtocol) URL() (string, error) {
+	url, server, err := requestKucoinInstanceServer()
+	if err != nil {
+		p.logger.Warn("Could not generate Kucoin Websocket URL", err)
+		return "", err
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.server = server
+	return url, nil
+}
+
+func (p *kucoinProtocol) Configure(c *ws.Client) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	c.SetAppPing(time.Duration(p.server.PingInterval)*time.Millisecond, func(c *ws.Client) error {
+		return c.WriteJSON(kucoinMessage{
+			Id:   "1",
+			Type: "ping",
+		})
+	})
+	c.SetReadTimeout(time.Duration(p.server.PingInterval+p.server.PingTimeout) * time.Millisecond)
+	c.SetRateLimit(websocketLimiter("Kucoin"))
+	c.SetPingRateLimit(pingLimiter("Kucoin"))
+}
+
+// read the welcome message
+func (p *kucoinProtocol) Connected(c *ws.Client) error {
+	var welcomeMessage kucoinMessage
+	if err := c.ReadJSON(&welcomeMessage); err != nil {
+		return err
+	}
+	if welcomeMessage.Type != "welcome" {
+		return fmt.Errorf("expected welcome message, received %s", welcomeMessage.Type)
+	}
+
+	return nil
+}
+
+func (p *kucoinProtocol) Subscribe(c *ws.Client, topics []string) error {
+	return p.request(c, "subscribe", topics)
+}
+
+func (p *kucoinProtocol) Unsubscribe(c *ws.Client, topics []string) error {
+	return p.request(c, "unsubscribe", topics)
+}
+
+func (p *kucoinProtocol) request(c *ws.Client, kind string, topics []string) error {
+	for i, topic := range topics {
+		err := c.WriteJSON(kucoinSubscribe{
+			kucoinMessage: kucoinMessage{
+				Type: kind,
+				Id:   fmt.Sprint(i + 1),
+			},
+			Topic:          topic,
+			PrivateChannel: false,
+			Response:       true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *kucoinProtocol) Topic(message []byte) string {
+	var m kucoinTopicMessage
+	if err := json.Unmarshal(message, &m); err != nil || m.Type != "message" {
+		return ""
+	}
+
+	return m.Topic
+}
+
+func (p *kucoinProtocol) MaxTopics() int {
+	return kucoinMaxTopics
+}
+
+// Local level2 book, merged from the incremental feed and a REST snapshot
+// by sequence number as described in Kucoin's documentation
+type kucoinLevel2 struct {
+	symbol   string
+	book     *book.Book
+	sequence int64
+	synced   bool
+	buffer   []kucoinLevel2Data
+	schedule *snapshotSchedule
+	// REST snapshot of the book, replaced in tests
+	snapshot func() (kucoinSnapshotData, error)
+}
+
+func newKucoinLevel2(symbol string) *kucoinLevel2 {
+	l := &kucoinLevel2{
+		symbol:   symbol,
+		book:     book.New(),
+		schedule: newSnapshotSchedule(),
+	}
+	l.snapshot = l.fetchSnapshot
+	return l
+}
+
+// merge an incremental update into the book, buffering updates until a
+// snapshot has been applied. Returns true if the book changed, an error if
+// the book lost sync
+func (l *kucoinLevel2) merge(d kucoinLevel2Data) (bool, error) {
+	if l.synced {
+		return l.apply(d)
+	}
+
+	l.buffer = append(l.buffer, d)
+	if len(l.buffer) > maxBufferedDiffs {
+		l.buffer = l.buffer[len(l.buffer)-maxBufferedDiffs:]
+	}
+	if !l.schedule.due() {
+		return false, nil
+	}
+
+	if err := l.sync(); err != nil {
+		l.schedule.failed()
+		return false, err
+	}
+	if !l.synced {
+		l.schedule.failed()
+		return false, nil
+	}
+
+	l.schedule.reset()
+	return true, nil
+}
+
+// apply an incremental update, changes already contained in the book are
+// skipped. A gap or malformed update drops the book out of sync
+func (l *kucoinLevel2) apply(d kucoinLevel2Data) (bool, error) {
+	if d.SequenceEnd <= l.sequence {
+		return false, nil
+	}
+
+	if d.SequenceStart > l.sequence+1 {
+		// missed an update, resync from a new snapshot
+		l.synced = false
+		l.buffer = []kucoinLevel2Data{d}
+		return false, fmt.Errorf("sequence gap: expected %d, received %d", l.sequence+1, d.SequenceStart)
+	}
+
+	if err := l.applyChanges(d); err != nil {
+		l.synced = false
+		l.buffer = nil
+		return false, err
+	}
+
+	l.sequence = d.SequenceEnd
+	return true, nil
+}
+
+func (l *kucoinLevel2) applyChanges(d kucoinLevel2Data) error {
+	sides := []struct {
+		side    book.Side
+		changes [][]string
+	}{{book.Bid, d.Changes.Bids}, {book.Ask, d.Changes.Asks}}
+	for _, s := range sides {
+		for _, change := range s.changes {
+			if len(change) < 3 {
+				return fmt.Errorf("malformed change %v", change)
+			}
+
+			sequence, err := strconv.ParseInt(change[2], 10, 64)
+			if err != nil {
+				return err
+			}
+			if sequence <= l.sequence {
+				continue
+			}
+
+			if err := l.book.Set(s.side, change[0], change[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rebuild the book from a snapshot and replay the buffered updates on top
+// of it. The book stays out of sync if the snapshot is older than the buffer
+func (l *kucoinLevel2) sync() error {
+	snapshot, err := l.snapshot()
+	if err != nil {
+		return err
+	}
+
+	sequence, err := strconv.ParseInt(snapshot.Sequence, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	if sequence < l.buffer[0].SequenceStart-1 {
+		return nil
+	}
+
+	l.book.Clear()
+	if err := setLevels(l.book, book.Bid, snapshot.Bids); err != nil {
+		return err
+	}
+	if err := setLevels(l.book, book.Ask, snapshot.Asks); err != nil {
+		return err
+	}
+
+	l.sequence = sequence
+	l.synced = true
+
+	buffered := l.buffer
+	l.buffer = nil
+	for i, d := range buffered {
+		if _, err := l.apply(d); err != nil {
+			// keep the updates after the gap for the next snapshot
+			l.buffer = append(l.buffer, buffered[i+1:]...)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *kucoinLevel2) fetchSnapshot() (kucoinSnapshotData, error) {
+	var resp kucoinSnapshotResponse
+	url := fmt.Sprintf("https://api.kucoin.com/api/v1/market/orderbook/level2_100?symbol=%s", l.symbol)
+	err := getJSON(restLimiter("Kucoin", 0), url, &resp)
+	return resp.Data, err
+}
+
 type kucoinHttpResponse struct {
 	Code string                      `json:"code"`
 	Data kucoinWebsocketHttpResponse `json:"data"`
@@ -208,6 +659,11 @@ type kucoinMessage struct {
 	Id   string `json:"id,omitempty"`
 }
 
+type kucoinTopicMessage struct {
+	kucoinMessage
+	Topic string `json:"topic"`
+}
+
 type kucoinTickerMessage struct {
 	kucoinMessage
 	Topic   string           `json:"topic"`
@@ -224,3 +680,50 @@ type kucoinTickerData struct {
 	BestBid     string `json:"bestBid"`
 	BestBidSize string `json:"bestBidSize"`
 }
+
+type kucoinMatchMessage struct {
+	kucoinMessage
+	Topic   string          `json:"topic"`
+	Subject string          `json:"subject"`
+	Data    kucoinMatchData `json:"data"`
+}
+
+type kucoinMatchData struct {
+	Sequence string `json:"sequence"`
+	Symbol   string `json:"symbol"`
+	Side     string `json:"side"`
+	Price    string `json:"price"`
+	Size     string `json:"size"`
+	TradeId  string `json:"tradeId"`
+	Time     string `json:"time"`
+}
+
+type kucoinLevel2Message struct {
+	kucoinMessage
+	Topic   string           `json:"topic"`
+	Subject string           `json:"subject"`
+	Data    kucoinLevel2Data `json:"data"`
+}
+
+type kucoinLevel2Data struct {
+	SequenceStart int64               `json:"sequenceStart"`
+	SequenceEnd   int64               `json:"sequenceEnd"`
+	Symbol        string              `json:"symbol"`
+	Changes       kucoinLevel2Changes `json:"changes"`
+}
+
+type kucoinLevel2Changes struct {
+	Asks [][]string `json:"asks"`
+	Bids [][]string `json:"bids"`
+}
+
+type kucoinSnapshotResponse struct {
+	Code string             `json:"code"`
+	Data kucoinSnapshotData `json:"data"`
+}
+
+type kucoinSnapshotData struct {
+	Sequence string     `json:"sequence"`
+	Bids     [][]string `json:"bids"`
+	Asks     [][]string `json:"asks"`
+}
@@ -0,0 +1,191 @@
+package exchange
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseKucoinTicker(t *testing.T) {
+	update, err := parseKucoinTicker(fixture(t, "kucoin/ticker.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := MarketUpdate{
+		Bid: "27013.2", BidSize: "1.08316546",
+		Ask: "27013.3", AskSize: "0.76474617",
+	}
+	if update != want {
+		t.Errorf("parsed %+v, expected %+v", update, want)
+	}
+}
+
+func FuzzParseKucoin(f *testing.F) {
+	f.Add(fixture(f, "kucoin/ticker.json"))
+	f.Add([]byte(`{"type":"message","topic":"/market/ticker:BTC-USDT","subject":"trade.ticker","data":{}}`))
+	f.Add([]byte(`{"type":"message","data":{"bestAsk":27013.3}}`))
+	f.Add([]byte(`{"id":"1","type":"pong"}`))
+	f.Add([]byte(`{"type":"message","data":null}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		update, err := parseKucoinTicker(data)
+		if err != nil {
+			return
+		}
+		requireNumbers(t, data, update.Bid, update.BidSize, update.Ask, update.AskSize)
+
+		// the quote is taken from the data of the message, never its envelope
+		requireSent(t, data, "data.bestBid", update.Bid)
+		requireSent(t, data, "data.bestAsk", update.Ask)
+	})
+}
+
+// level2 message with the given sequence range and [price, size, sequence] bids
+func level2Message(t *testing.T, start, end int64, bids string) kucoinLevel2Data {
+	t.Helper()
+
+	raw := fmt.Sprintf(`{"type":"message","topic":"/market/level2:BTC-USDT","subject":"trade.l2update",`+
+		`"data":{"sequenceStart":%d,"sequenceEnd":%d,"symbol":"BTC-USDT","changes":{"asks":[],"bids":%s}}}`,
+		start, end, bids)
+	var message kucoinLevel2Message
+	if err := json.Unmarshal([]byte(raw), &message); err != nil {
+		t.Fatal(err)
+	}
+	return message.Data
+}
+
+func TestKucoinLevel2Sequence(t *testing.T) {
+	type step struct {
+		start, end int64
+		bids       string
+		// the snapshot backoff has elapsed
+		retry    bool
+		changed  bool
+		err      bool
+		synced   bool
+		sequence int64
+		buffered int
+	}
+
+	tests := []struct {
+		name      string
+		snapshots []kucoinSnapshotData
+		steps     []step
+		fetches   int
+		bid       string
+	}{
+		{
+			name: "changes contained in the snapshot are skipped",
+			snapshots: []kucoinSnapshotData{
+				{Sequence: "100", Bids: [][]string{{"27010", "1"}}},
+			},
+			steps: []step{
+				{start: 99, end: 101, bids: `[["27012","1","100"],["27013","2","101"]]`, changed: true, synced: true, sequence: 101},
+				{start: 102, end: 102, bids: `[["27013","0","102"]]`, changed: true, synced: true, sequence: 102},
+				{start: 100, end: 102, bids: `[["27014","1","102"]]`, synced: true, sequence: 102},
+			},
+			fetches: 1,
+			bid:     "27010",
+		},
+		{
+			name: "an outdated snapshot is retried after the backoff",
+			snapshots: []kucoinSnapshotData{
+				{Sequence: "90"},
+				{Sequence: "101", Bids: [][]string{{"27010", "1"}}},
+			},
+			steps: []step{
+				{start: 95, end: 96, bids: `[["27011","1","96"]]`, buffered: 1},
+				{start: 97, end: 102, bids: `[["27012","1","102"]]`, buffered: 2},
+				{start: 103, end: 103, bids: `[]`, retry: true, changed: true, synced: true, sequence: 103},
+			},
+			fetches: 2,
+			bid:     "27012",
+		},
+		{
+			name: "a gap drops the book out of sync until the next snapshot",
+			snapshots: []kucoinSnapshotData{
+				{Sequence: "100", Bids: [][]string{{"27010", "1"}}},
+				{Sequence: "104", Bids: [][]string{{"27009", "1"}}},
+			},
+			steps: []step{
+				{start: 101, end: 101, bids: `[["27011","1","101"]]`, changed: true, synced: true, sequence: 101},
+				{start: 103, end: 103, bids: `[]`, err: true, sequence: 101, buffered: 1},
+				{start: 104, end: 104, bids: `[]`, changed: true, synced: true, sequence: 104},
+			},
+			fetches: 2,
+			bid:     "27009",
+		},
+		{
+			name: "a malformed change drops the book out of sync",
+			snapshots: []kucoinSnapshotData{
+				{Sequence: "100", Bids: [][]string{{"27010", "1"}}},
+			},
+			steps: []step{
+				{start: 101, end: 101, bids: `[]`, changed: true, synced: true, sequence: 101},
+				{start: 102, end: 102, bids: `[["27011","1"]]`, err: true, sequence: 101},
+			},
+			fetches: 1,
+			bid:     "27010",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newKucoinLevel2("BTC-USDT")
+			fetches := 0
+			l.snapshot = func() (kucoinSnapshotData, error) {
+				if fetches == len(test.snapshots) {
+					t.Fatal("unexpected snapshot request")
+				}
+				fetches++
+				return test.snapshots[fetches-1], nil
+			}
+
+			for i, s := range test.steps {
+				if s.retry {
+					l.schedule.reset()
+				}
+				changed, err := l.merge(level2Message(t, s.start, s.end, s.bids))
+				if (err != nil) != s.err {
+					t.Fatalf("step %d: error %v", i, err)
+				}
+				if changed != s.changed || l.synced != s.synced || l.sequence != s.sequence || len(l.buffer) != s.buffered {
+					t.Errorf("step %d: changed %t, synced %t, sequence %d, %d buffered, expected %t, %t, %d, %d",
+						i, changed, l.synced, l.sequence, len(l.buffer), s.changed, s.synced, s.sequence, s.buffered)
+				}
+			}
+
+			if fetches != test.fetches {
+				t.Errorf("%d snapshots requested, expected %d", fetches, test.fetches)
+			}
+			if bid, _ := l.book.Top(); bid.Price != test.bid {
+				t.Errorf("best bid %s, expected %s", bid.Price, test.bid)
+			}
+		})
+	}
+}
+
+func TestKucoinLevel2BufferCap(t *testing.T) {
+	l := newKucoinLevel2("BTC-USDT")
+	fetches := 0
+	l.snapshot = func() (kucoinSnapshotData, error) {
+		fetches++
+		return kucoinSnapshotData{}, errors.New("unavailable")
+	}
+
+	for i := int64(1); i <= maxBufferedDiffs+10; i++ {
+		l.merge(kucoinLevel2Data{SequenceStart: i, SequenceEnd: i})
+	}
+
+	if len(l.buffer) != maxBufferedDiffs {
+		t.Errorf("%d updates buffered, expected %d", len(l.buffer), maxBufferedDiffs)
+	}
+	if first := l.buffer[0].SequenceStart; first != 11 {
+		t.Errorf("oldest buffered update starts at %d, expected 11", first)
+	}
+	if fetches != 1 {
+		t.Errorf("%d snapshots requested, expected 1", fetches)
+	}
+}
@@ -0,0 +1,421 @@
+// Aggregate top of book updates from a currency pair listed on OKX
+
+package exchange
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
+)
+
+// OKX closes connections that are idle for 30 seconds
+const okxPingInterval = 20 * time.Second
+
+// channels per pooled connection. OKX has no documented limit, this keeps
+// the subscriptions replayed after a reconnect small
+const okxMaxTopics = 100
+
+const okxPublicURL = "wss://ws.okx.com:8443/ws/v5/public"
+
+type OKX struct {
+	updates      chan MarketUpdate
+	trades       chan Trade
+	depth        chan book.Snapshot
+	url          string
+	name         string
+	symbol       string
+	valid        bool
+	pingInterval time.Duration
+	fallback     *fallback
+	pool         *ws.Pool
+	parseErrors  *parseReporter
+	logger       *logger.Logger
+}
+
+// Create new OKX struct
+func NewOKX(pair symbol.CurrencyPair) *OKX {
+	c := make(chan MarketUpdate, updateBufSize)
+	name := fmt.Sprintf("OKX: %s", pair.OKX)
+	logger := logger.Named(name)
+
+	return &OKX{
+		updates:      c,
+		url:          okxPublicURL,
+		name:         name,
+		symbol:       pair.OKX,
+		valid:        pair.OKX != "",
+		pingInterval: okxPingInterval,
+		parseErrors:  newParseReporter(name, logger),
+		logger:       logger,
+	}
+}
+
+// Receive book data from OKX, send any top of book updates
+// over the updates channel as a MarketUpdate struct
+func (e *OKX) Recv() {
+	// tick by tick best bid and offer, or the top five levels in depth mode
+	args := []okxArg{{Channel: "bbo-tbt", InstId: e.symbol}}
+	if e.depth != nil {
+		args = []okxArg{{Channel: "books5", InstId: e.symbol}}
+	}
+	if e.trades != nil {
+		args = append(args, okxArg{Channel: "trades", InstId: e.symbol})
+	}
+
+	if e.pool != nil {
+		e.recvPooled(args)
+		return
+	}
+
+	e.logger.Debug("connecting to socket")
+	conn := ws.New(e.url)
+	conn.SetCompression(true)
+	conn.SetAppPing(e.pingInterval, func(c *ws.Client) error {
+		return c.WriteMessage(websocket.TextMessage, []byte("ping"))
+	})
+	conn.SetReadTimeout(2 * e.pingInterval)
+
+	conn.SetOnConnect(func(c *ws.Client) error {
+		// acks are handled with the data, which may arrive before them
+		return c.WriteJSON(okxRequest{
+			Op:   "subscribe",
+			Args: args,
+		})
+	})
+
+	lastUpdate := MarketUpdate{}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
+	})
+	e.fallback.stream(conn, e.logger, func() error {
+		for {
+			_, rawMessage, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+
+			e.handle(rawMessage, &lastUpdate)
+		}
+	})
+}
+
+// receive messages for args over a shared connection pool
+func (e *OKX) recvPooled(args []okxArg) {
+	// a nil message marks a lost connection
+	messages := make(chan []byte, updateBufSize)
+	subscribed := make(map[string]bool)
+	for _, arg := range args {
+		subscribed[okxTopic(arg)] = true
+	}
+	e.pool.OnDisconnect(func(topic string) {
+		if !subscribed[topic] {
+			return
+		}
+		// runs on the pool's connection, which must not wait for this reader
+		select {
+		case messages <- nil:
+		default:
+			e.logger.Warn("message buffer full, quote not withdrawn while reconnecting")
+		}
+	})
+
+	for _, arg := range args {
+		c, err := e.pool.Subscribe(okxTopic(arg))
+		if err != nil {
+			e.logger.Warn("could not subscribe to ", okxTopic(arg), " ", err, ", RETURNING")
+			return
+		}
+
+		go func(c chan []byte) {
+			for message := range c {
+				messages <- message
+			}
+		}(c)
+	}
+
+	lastUpdate := MarketUpdate{}
+	for rawMessage := range messages {
+		if rawMessage == nil {
+			// withdraw the stale quote while reconnecting
+			if lastUpdate != (MarketUpdate{}) {
+				e.updates <- MarketUpdate{Name: e.name}
+				lastUpdate = MarketUpdate{}
+			}
+			continue
+		}
+
+		e.handle(rawMessage, &lastUpdate)
+	}
+}
+
+// handle a book or trades message
+func (e *OKX) handle(rawMessage []byte, lastUpdate *MarketUpdate) {
+	if string(rawMessage) == "pong" {
+		e.logger.Debug("pong received")
+		return
+	}
+
+	var message okxMessage
+	if err := json.Unmarshal(rawMessage, &message); err != nil {
+		e.parseErrors.report("message", rawMessage, err)
+		return
+	}
+
+	if message.Event == "subscribe" {
+		e.logger.Debug("subscribed to ", message.Arg.Channel)
+		return
+	} else if message.Event == "error" {
+		e.logger.Warn("error message ", string(rawMessage))
+		return
+	}
+
+	switch message.Arg.Channel {
+	case "trades":
+		trades, err := parseOKXTrades(message.Data)
+		if err != nil {
+			e.parseErrors.report("trade", rawMessage, err)
+			return
+		}
+		for _, trade := range trades {
+			trade.Name = e.name
+			e.trades <- trade
+		}
+	case "bbo-tbt", "books5":
+		b, err := parseOKXBook(message.Data, "")
+		if errors.Is(err, errNoBookData) {
+			return
+		} else if err != nil {
+			e.parseErrors.report("book", rawMessage, err)
+			return
+		}
+
+		update := bookUpdate(b, e.name)
+		if update != *lastUpdate {
+			e.updates <- update
+		}
+		*lastUpdate = update
+		if e.depth != nil {
+			e.depth <- b.Snapshot(e.name, depthLevels)
+		}
+	}
+}
+
+// Name of data source
+func (e *OKX) Name() string {
+	return e.name
+}
+
+// Access to update channel
+func (e *OKX) Updates() chan MarketUpdate {
+	return e.updates
+}
+
+func (e *OKX) Valid() bool {
+	return e.valid
+}
+
+// Poll the REST ticker while the websocket is down, must be called before Recv
+func (e *OKX) EnableFallback() {
+	e.fallback = newFallback(e.name, okxFallback, e.symbol, e.updates)
+}
+
+// Access to trade channel, subscribes to the trades channel if called before Recv
+func (e *OKX) Trades() chan Trade {
+	if e.trades == nil {
+		e.trades = make(chan Trade, updateBufSize)
+	}
+	return e.trades
+}
+
+// Access to depth channel, subscribes to the top five levels if called before Recv
+func (e *OKX) Depth() chan book.Snapshot {
+	if e.depth == nil {
+		e.depth = make(chan book.Snapshot, updateBufSize)
+	}
+	return e.depth
+}
+
+// Share connections with other OKX adapters through pool, which must be
+// created with NewOKXPool. Must be called before Recv
+func (e *OKX) SetPool(pool *ws.Pool) {
+	e.pool = pool
+}
+
+// Create a connection pool shared by OKX adapters
+func NewOKXPool() *ws.Pool {
+	return ws.NewPool("OKX", &okxProtocol{url: okxPublicURL})
+}
+
+// ws.Protocol for OKX's public feed, topics are channel:instId
+type okxProtocol struct {
+	url string
+}
+
+func (p *okxProtocol) URL() (string, error) {
+	return p.url, nil
+}
+
+func (p *okxProtocol) Configure(c *ws.Client) {
+	c.SetCompression(true)
+	c.SetAppPing(okxPingInterval, func(c *ws.Client) error {
+		return c.WriteMessage(websocket.TextMessage, []byte("ping"))
+	})
+	c.SetReadTimeout(2 * okxPingInterval)
+}
+
+func (p *okxProtocol) Connected(c *ws.Client) error {
+	return nil
+}
+
+func (p *okxProtocol) Subscribe(c *ws.Client, topics []string) error {
+	return p.request(c, "subscribe", topics)
+}
+
+func (p *okxProtocol) Unsubscribe(c *ws.Client, topics []string) error {
+	return p.request(c, "unsubscribe", topics)
+}
+
+func (p *okxProtocol) request(c *ws.Client, op string, topics []string) error {
+	args := make([]okxArg, 0, len(topics))
+	for _, topic := range topics {
+		channel, instId, _ := strings.Cut(topic, ":")
+		args = append(args, okxArg{Channel: channel, InstId: instId})
+	}
+
+	return c.WriteJSON(okxRequest{
+		Op:   op,
+		Args: args,
+	})
+}
+
+func (p *okxProtocol) Topic(message []byte) string {
+	var m okxMessage
+	if err := json.Unmarshal(message, &m); err != nil || m.Event != "" {
+		return ""
+	}
+
+	return okxTopic(m.Arg)
+}
+
+func (p *okxProtocol) MaxTopics() int {
+	return okxMaxTopics
+}
+
+// pool topic of a channel
+func okxTopic(arg okxArg) string {
+	return arg.Channel + ":" + arg.InstId
+}
+
+type okxRequest struct {
+	Op   string   `json:"op"`
+	Args []okxArg `json:"args"`
+}
+
+type okxArg struct {
+	Channel string `json:"channel"`
+	InstId  string `json:"instId"`
+}
+
+type okxEvent struct {
+	Event string `json:"event"`
+	Code  string `json:"code"`
+	Msg   string `json:"msg"`
+	Arg   okxArg `json:"arg"`
+}
+
+type okxMessage struct {
+	okxEvent
+	Data json.RawMessage `json:"data"`
+}
+
+// book of a bbo-tbt or books5 push, every push is a full snapshot of the
+// subscribed levels. Sizes in contracts are converted to the base currency
+// if contractSize is set
+func parseOKXBook(data []byte, contractSize string) (*book.Book, error) {
+	var books []okxBook
+	if err := json.Unmarshal(data, &books); err != nil {
+		return nil, err
+	}
+	if len(books) == 0 {
+		return nil, errNoBookData
+	}
+
+	b := book.New()
+	sides := []struct {
+		side   book.Side
+		levels [][]string
+	}{{book.Bid, books[0].Bids}, {book.Ask, books[0].Asks}}
+	for _, s := range sides {
+		for _, level := range s.levels {
+			if len(level) < 2 {
+				return nil, fmt.Errorf("malformed level %v", level)
+			}
+
+			size, err := contractsToBase(level[1], contractSize)
+			if err != nil {
+				return nil, err
+			}
+			if err := b.Set(s.side, level[0], size); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return b, nil
+}
+
+// trades of a trades push
+func parseOKXTrades(data []byte) ([]Trade, error) {
+	var okxTrades []okxTrade
+	if err := json.Unmarshal(data, &okxTrades); err != nil {
+		return nil, err
+	}
+
+	trades := make([]Trade, 0, len(okxTrades))
+	for _, t := range okxTrades {
+		ms, err := strconv.ParseInt(t.Ts, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		trade := Trade{
+			Price: t.Px,
+			Size:  t.Sz,
+			Side:  t.Side,
+			ID:    t.TradeId,
+			Time:  time.UnixMilli(ms),
+		}
+		if err := checkTrade(trade); err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+
+	return trades, nil
+}
+
+type okxBook struct {
+	Asks [][]string `json:"asks"`
+	Bids [][]string `json:"bids"`
+	Ts   string     `json:"ts"`
+}
+
+type okxTrade struct {
+	InstId  string `json:"instId"`
+	TradeId string `json:"tradeId"`
+	Px      string `json:"px"`
+	Sz      string `json:"sz"`
+	Side    string `json:"side"`
+	Ts      string `json:"ts"`
+}
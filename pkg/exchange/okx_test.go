@@ -0,0 +1,236 @@
+package exchange
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
+)
+
+// answer OKX pings until n have been answered, or until done if n is zero
+func answerOKXPings(t *testing.T, conn *websocket.Conn, n int, done chan struct{}) {
+	for answered := 0; n == 0 || answered < n; {
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-done:
+			default:
+				t.Errorf("no ping received: %v", err)
+			}
+			return
+		}
+		if string(data) != "ping" {
+			t.Errorf("received %s, expected a ping", data)
+			continue
+		}
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("pong")); err != nil {
+			return
+		}
+		answered++
+	}
+}
+
+func TestOKX(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	subscribed := func(conn *websocket.Conn) {
+		var request okxRequest
+		readRequest(t, conn, &request)
+		if request.Op != "subscribe" || len(request.Args) != 2 {
+			t.Errorf("received %+v, expected to subscribe to the bbo and trades", request)
+		}
+	}
+
+	url := newVenueServer(t,
+		func(conn *websocket.Conn) {
+			subscribed(conn)
+
+			// data may arrive before the subscription ack
+			send(t, conn,
+				fixture(t, "okx/bbo_tbt.json"),
+				fixture(t, "okx/subscribe.json"),
+				fixture(t, "okx/trades.json"),
+			)
+
+			// drop the connection once the client has pinged
+			answerOKXPings(t, conn, 1, done)
+		},
+		func(conn *websocket.Conn) {
+			subscribed(conn)
+			send(t, conn,
+				fixture(t, "okx/subscribe.json"),
+				fixture(t, "okx/bbo_tbt_2.json"),
+			)
+			answerOKXPings(t, conn, 0, done)
+		},
+	)
+
+	e := NewOKX(symbol.CurrencyPair{OKX: "BTC-USDT"})
+	e.url = url
+	e.pingInterval = 100 * time.Millisecond
+	trades := e.Trades()
+	go e.Recv()
+
+	expected := []MarketUpdate{
+		{
+			Bid: "27013.4", BidSize: "1.20559834",
+			Ask: "27013.5", AskSize: "0.84121301",
+			Name: "OKX: BTC-USDT",
+		},
+		// withdrawn while reconnecting
+		{Name: "OKX: BTC-USDT"},
+		{
+			Bid: "27013.9", BidSize: "2.1",
+			Ask: "27014.1", AskSize: "0.5",
+			Name: "OKX: BTC-USDT",
+		},
+	}
+	for i, want := range expected {
+		if update := receive(t, e.Updates()); update != want {
+			t.Errorf("update %d: received %+v, expected %+v", i, update, want)
+		}
+	}
+
+	trade := receive(t, trades)
+	if trade.Side != Buy || trade.Price != "27013.5" || trade.Size != "0.00351" || trade.ID != "426173942" {
+		t.Errorf("received %+v, expected a buy of 0.00351 at 27013.5", trade)
+	}
+}
+
+func TestOKXPooled(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	// read requests until every topic is subscribed, a topic may be requested
+	// by the replay and by its subscriber
+	subscribed := func(conn *websocket.Conn) {
+		topics := make(map[string]bool)
+		for len(topics) < 2 {
+			var request okxRequest
+			readRequest(t, conn, &request)
+			if request.Op != "subscribe" {
+				t.Errorf("received %+v, expected a subscription", request)
+				return
+			}
+			for _, arg := range request.Args {
+				topics[okxTopic(arg)] = true
+			}
+		}
+	}
+
+	url := newVenueServer(t,
+		func(conn *websocket.Conn) {
+			subscribed(conn)
+			send(t, conn,
+				fixture(t, "okx/bbo_tbt.json"),
+				fixture(t, "okx/bbo_tbt_eth.json"),
+			)
+		},
+		func(conn *websocket.Conn) {
+			subscribed(conn)
+			send(t, conn,
+				fixture(t, "okx/bbo_tbt_2.json"),
+				fixture(t, "okx/bbo_tbt_eth.json"),
+			)
+			<-done
+		},
+	)
+
+	pool := ws.NewPool("OKX", &okxProtocol{url: url})
+	defer pool.Close()
+
+	btc := NewOKX(symbol.CurrencyPair{OKX: "BTC-USDT"})
+	eth := NewOKX(symbol.CurrencyPair{OKX: "ETH-USDT"})
+	for _, e := range []*OKX{btc, eth} {
+		e.SetPool(pool)
+		go e.Recv()
+	}
+
+	expected := map[*OKX][]MarketUpdate{
+		btc: {
+			{
+				Bid: "27013.4", BidSize: "1.20559834",
+				Ask: "27013.5", AskSize: "0.84121301",
+				Name: "OKX: BTC-USDT",
+			},
+			// withdrawn while the shared connection reconnects
+			{Name: "OKX: BTC-USDT"},
+			{
+				Bid: "27013.9", BidSize: "2.1",
+				Ask: "27014.1", AskSize: "0.5",
+				Name: "OKX: BTC-USDT",
+			},
+		},
+		eth: {
+			{
+				Bid: "1872.34", BidSize: "12.5",
+				Ask: "1872.35", AskSize: "4.2",
+				Name: "OKX: ETH-USDT",
+			},
+			{Name: "OKX: ETH-USDT"},
+			{
+				Bid: "1872.34", BidSize: "12.5",
+				Ask: "1872.35", AskSize: "4.2",
+				Name: "OKX: ETH-USDT",
+			},
+		},
+	}
+	for e, updates := range expected {
+		for i, want := range updates {
+			if update := receive(t, e.Updates()); update != want {
+				t.Errorf("%s update %d: received %+v, expected %+v", e.Name(), i, update, want)
+			}
+		}
+	}
+
+	if n := pool.Connections(); n != 1 {
+		t.Errorf("%d pool connections, expected 1", n)
+	}
+}
+
+func FuzzParseOKX(f *testing.F) {
+	f.Add(fixture(f, "okx/bbo_tbt.json"))
+	f.Add(fixture(f, "okx/trades.json"))
+	f.Add(fixture(f, "okx/subscribe.json"))
+	f.Add([]byte(`{"arg":{"channel":"bbo-tbt","instId":"BTC-USDT"},"data":[{"asks":[["27013.5","0"]],"bids":[["27013.4"]]}]}`))
+	f.Add([]byte(`{"arg":{"channel":"trades","instId":"BTC-USDT"},"data":[{"px":"27013.5","sz":"1","side":"hold","ts":"x"}]}`))
+	f.Add([]byte(`{"arg":{"channel":"bbo-tbt"},"data":[]}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var message okxMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			return
+		}
+
+		if b, err := parseOKXBook(message.Data, ""); err == nil {
+			var books []okxBook
+			json.Unmarshal(message.Data, &books)
+			requireLevels(t, data, b.Bids(0), books[0].Bids)
+			requireLevels(t, data, b.Asks(0), books[0].Asks)
+		}
+
+		if trades, err := parseOKXTrades(message.Data); err == nil {
+			var sent []okxTrade
+			json.Unmarshal(message.Data, &sent)
+			if len(trades) != len(sent) {
+				t.Fatalf("parsed %d trades from %d in %s", len(trades), len(sent), data)
+			}
+			for i, trade := range trades {
+				if trade.ID != sent[i].TradeId || trade.Side != sent[i].Side {
+					t.Errorf("trade %d parsed as %+v from %s", i, trade, data)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,193 @@
+// Aggregate top of book, mark price and funding for a perpetual swap listed on OKX
+
+package exchange
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ws"
+)
+
+type OKXSwap struct {
+	updates     chan MarketUpdate
+	perp        perpState
+	contract    symbol.Contract
+	url         string
+	name        string
+	symbol      string
+	valid       bool
+	parseErrors *parseReporter
+	logger      *logger.Logger
+}
+
+// Create new OKXSwap struct
+func NewOKXSwap(perps symbol.Perpetuals) *OKXSwap {
+	c := make(chan MarketUpdate, updateBufSize)
+	name := fmt.Sprintf("OKX Swap: %s", perps.OKXSwap.Symbol)
+	logger := logger.Named(name)
+
+	return &OKXSwap{
+		updates:     c,
+		contract:    perps.OKXSwap,
+		url:         "wss://ws.okx.com:8443/ws/v5/public",
+		name:        name,
+		symbol:      perps.OKXSwap.Symbol,
+		valid:       perps.OKXSwap.Symbol != "",
+		parseErrors: newParseReporter(name, logger),
+		logger:      logger,
+	}
+}
+
+// Receive book data from OKX, send any top of book updates
+// over the updates channel as a MarketUpdate struct
+func (e *OKXSwap) Recv() {
+	e.logger.Debug("connecting to socket")
+	conn := ws.New(e.url)
+	conn.SetCompression(true)
+	conn.SetAppPing(okxPingInterval, func(c *ws.Client) error {
+		return c.WriteMessage(websocket.TextMessage, []byte("ping"))
+	})
+	conn.SetReadTimeout(2 * okxPingInterval)
+
+	args := []okxArg{{Channel: "bbo-tbt", InstId: e.symbol}}
+	if e.perp.perps != nil {
+		// the index is published for the underlying, e.g. BTC-USDT for BTC-USDT-SWAP
+		args = append(args,
+			okxArg{Channel: "mark-price", InstId: e.symbol},
+			okxArg{Channel: "funding-rate", InstId: e.symbol},
+			okxArg{Channel: "index-tickers", InstId: strings.TrimSuffix(e.symbol, "-SWAP")},
+		)
+	}
+
+	conn.SetOnConnect(func(c *ws.Client) error {
+		// acks are handled with the data, which may arrive before them
+		return c.WriteJSON(okxRequest{
+			Op:   "subscribe",
+			Args: args,
+		})
+	})
+
+	if err := conn.Connect(); err != nil {
+		e.logger.Warn("could not connect to socket, RETURNING")
+		return
+	}
+	e.logger.Debug("connected to socket")
+
+	lastUpdate := MarketUpdate{}
+	conn.OnDisconnect(func(error) {
+		// withdraw the stale quote while reconnecting
+		e.updates <- MarketUpdate{Name: e.name}
+		lastUpdate = MarketUpdate{}
+	})
+	for {
+		_, rawMessage, err := conn.ReadMessage()
+		if err != nil {
+			e.logger.Warn(err, " RETURNING")
+			return
+		}
+
+		if string(rawMessage) == "pong" {
+			e.logger.Debug("pong received")
+			continue
+		}
+
+		var message okxMessage
+		if err := json.Unmarshal(rawMessage, &message); err != nil {
+			e.parseErrors.report("message", rawMessage, err)
+			continue
+		}
+
+		if message.Event == "subscribe" {
+			e.logger.Debug("subscribed to ", message.Arg.Channel)
+			continue
+		} else if message.Event == "error" {
+			e.logger.Warn("error message ", string(rawMessage))
+			continue
+		}
+
+		var data []okxSwapData
+		if err := json.Unmarshal(message.Data, &data); err != nil {
+			e.parseErrors.report(message.Arg.Channel, rawMessage, err)
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		switch message.Arg.Channel {
+		case "mark-price":
+			e.perp.latest.MarkPrice = data[0].MarkPx
+		case "index-tickers":
+			e.perp.latest.IndexPrice = data[0].IdxPx
+		case "funding-rate":
+			ms, err := strconv.ParseInt(data[0].FundingTime, 10, 64)
+			if err != nil {
+				e.parseErrors.report("funding-rate", rawMessage, err)
+				continue
+			}
+			e.perp.latest.FundingRate = data[0].FundingRate
+			e.perp.latest.NextFunding = time.UnixMilli(ms)
+		case "bbo-tbt":
+			// sizes are in contracts, quote them in the base currency
+			// like every other venue
+			b, err := parseOKXBook(message.Data, e.contract.ContractSize)
+			if errors.Is(err, errNoBookData) {
+				continue
+			} else if err != nil {
+				e.parseErrors.report("book", rawMessage, err)
+				continue
+			}
+
+			update := bookUpdate(b, e.name)
+			if update != lastUpdate {
+				e.updates <- update
+			}
+			lastUpdate = update
+			e.perp.latest.MarketUpdate = update
+		}
+
+		e.perp.send()
+	}
+}
+
+// Name of data source
+func (e *OKXSwap) Name() string {
+	return e.name
+}
+
+// Access to update channel
+func (e *OKXSwap) Updates() chan MarketUpdate {
+	return e.updates
+}
+
+func (e *OKXSwap) Valid() bool {
+	return e.valid
+}
+
+// Contract specification of the perpetual
+func (e *OKXSwap) Contract() symbol.Contract {
+	return e.contract
+}
+
+// Access to perpetual channel, subscribes to mark price, index and funding if called before Recv
+func (e *OKXSwap) Perpetual() chan PerpUpdate {
+	return e.perp.channel()
+}
+
+// fields of the mark-price, index-tickers and funding-rate channels
+type okxSwapData struct {
+	InstId      string `json:"instId"`
+	MarkPx      string `json:"markPx"`
+	IdxPx       string `json:"idxPx"`
+	FundingRate string `json:"fundingRate"`
+	FundingTime string `json:"fundingTime"`
+	Ts          string `json:"ts"`
+}
@@ -0,0 +1,205 @@
+// Reporting for venue messages that cannot be parsed. Malformed messages are
+// counted, sampled to the log and quarantined for inspection rather than
+// crashing the adapter or being published as zero valued updates
+
+package exchange
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+)
+
+// most recent malformed messages kept per venue
+const quarantineSize = 20
+
+// log the first parse error of a venue and then one in every parseLogEvery
+const parseLogEvery = 100
+
+// longest raw message kept with a parse error
+const maxQuarantinedBytes = 1024
+
+// a quote without a bid or ask, which would withdraw the venue from the aggregate
+var errEmptyQuote = errors.New("no best bid or ask")
+
+// a book message without levels, e.g. a subscription response
+var errNoBookData = errors.New("no book data")
+
+// a finite number parsed from a venue's price, size or rate
+func parseNumber(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%q is not finite", s)
+	}
+	return f, nil
+}
+
+// check a parsed quote: at least one side, positive prices and sizes that
+// are not negative. A side may omit its size but not its price
+func checkQuote(update MarketUpdate) error {
+	if update.Bid == "" && update.Ask == "" {
+		return errEmptyQuote
+	}
+
+	sides := []struct{ price, size string }{
+		{update.Bid, update.BidSize},
+		{update.Ask, update.AskSize},
+	}
+	for _, side := range sides {
+		if side.price == "" {
+			if side.size != "" {
+				return fmt.Errorf("size %q without a price", side.size)
+			}
+			continue
+		}
+		if p, err := parseNumber(side.price); err != nil || p <= 0 {
+			return fmt.Errorf("invalid price %q", side.price)
+		}
+		if side.size == "" {
+			continue
+		}
+		if q, err := parseNumber(side.size); err != nil || q < 0 {
+			return fmt.Errorf("invalid size %q", side.size)
+		}
+	}
+
+	return nil
+}
+
+// check a parsed trade: a buy or sell of a positive size at a positive price
+func checkTrade(trade Trade) error {
+	if trade.Side != Buy && trade.Side != Sell {
+		return fmt.Errorf("invalid side %q", trade.Side)
+	}
+	if p, err := parseNumber(trade.Price); err != nil || p <= 0 {
+		return fmt.Errorf("invalid price %q", trade.Price)
+	}
+	if q, err := parseNumber(trade.Size); err != nil || q <= 0 {
+		return fmt.Errorf("invalid size %q", trade.Size)
+	}
+	return nil
+}
+
+// A venue message that could not be parsed
+type ParseError struct {
+	// name of the exchange that received the message
+	Name string
+	// what was being parsed, e.g. "book" or "trade"
+	Kind string
+	// raw message, truncated to maxQuarantinedBytes
+	Message []byte
+	Err     error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: could not parse %s: %v", e.Name, e.Kind, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parse errors of one exchange
+type ParseStats struct {
+	Name   string
+	Errors int64
+	// most recent malformed messages, oldest first
+	Quarantined []ParseError
+}
+
+// counts, samples and quarantines the parse errors of one exchange
+type parseReporter struct {
+	name   string
+	errors *atomic.Int64
+	logger *logger.Logger
+
+	mux        *sync.Mutex
+	quarantine []ParseError
+}
+
+var (
+	reportersMux = &sync.Mutex{}
+	reporters    = make(map[string]*parseReporter)
+)
+
+// Reporter for an exchange, shared by every adapter with the same name
+func newParseReporter(name string, logger *logger.Logger) *parseReporter {
+	reportersMux.Lock()
+	defer reportersMux.Unlock()
+
+	if r, ok := reporters[name]; ok {
+		return r
+	}
+
+	r := &parseReporter{
+		name:   name,
+		errors: &atomic.Int64{},
+		logger: logger,
+		mux:    &sync.Mutex{},
+	}
+	reporters[name] = r
+	return r
+}
+
+// Parse errors of every exchange, sorted by name
+func ParseErrors() []ParseStats {
+	reportersMux.Lock()
+	defer reportersMux.Unlock()
+
+	stats := make([]ParseStats, 0, len(reporters))
+	for _, r := range reporters {
+		stats = append(stats, r.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+
+	return stats
+}
+
+// record that message could not be parsed as kind, returning the ParseError
+func (r *parseReporter) report(kind string, message []byte, err error) *ParseError {
+	if len(message) > maxQuarantinedBytes {
+		message = message[:maxQuarantinedBytes]
+	}
+	parseErr := &ParseError{
+		Name:    r.name,
+		Kind:    kind,
+		Message: append([]byte(nil), message...),
+		Err:     err,
+	}
+
+	n := r.errors.Add(1)
+	if n%parseLogEvery == 1 {
+		r.logger.Warn(fmt.Sprintf("%v, message quarantined (%d parse errors): %s", parseErr, n, parseErr.Message))
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.quarantine) == quarantineSize {
+		r.quarantine = r.quarantine[1:]
+	}
+	r.quarantine = append(r.quarantine, *parseErr)
+
+	return parseErr
+}
+
+func (r *parseReporter) stats() ParseStats {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return ParseStats{
+		Name:        r.name,
+		Errors:      r.errors.Load(),
+		Quarantined: append([]ParseError(nil), r.quarantine...),
+	}
+}
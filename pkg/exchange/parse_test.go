@@ -0,0 +1,187 @@
+package exchange
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/book"
+)
+
+// value at a dotted path of a json message, empty if there is none
+func jsonField(data []byte, path string) string {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return ""
+	}
+
+	value, err := lookup(v, path)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// every value a struct decoding of a json message may read from a dotted
+// path. encoding/json matches keys case-insensitively and the last duplicate
+// wins, so every matching key is a candidate. a null reads as empty.
+func jsonFields(data []byte, path string) []string {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	v, err := decodeOrdered(d)
+	if err != nil {
+		return nil
+	}
+	return collectFields(v, strings.Split(path, "."))
+}
+
+type jsonMember struct {
+	key   string
+	value interface{}
+}
+
+// decode a json value keeping the order and duplicates of object keys
+func decodeOrdered(d *json.Decoder) (interface{}, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		var members []jsonMember
+		for d.More() {
+			key, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(d)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, jsonMember{key.(string), value})
+		}
+		_, err := d.Token()
+		return members, err
+	case json.Delim('['):
+		var values []interface{}
+		for d.More() {
+			value, err := decodeOrdered(d)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		_, err := d.Token()
+		return values, err
+	}
+	return tok, nil
+}
+
+func collectFields(v interface{}, keys []string) []string {
+	if len(keys) == 0 {
+		switch value := v.(type) {
+		case string:
+			return []string{value}
+		case json.Number:
+			return []string{value.String()}
+		case nil:
+			return []string{""}
+		}
+		return nil
+	}
+
+	var fields []string
+	switch node := v.(type) {
+	case []jsonMember:
+		for _, m := range node {
+			if strings.EqualFold(m.key, keys[0]) {
+				fields = append(fields, collectFields(m.value, keys[1:])...)
+			}
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(keys[0])
+		if err == nil && i >= 0 && i < len(node) {
+			fields = collectFields(node[i], keys[1:])
+		}
+	}
+	return fields
+}
+
+// fail unless a parsed value was sent at a path, or is empty when nothing was
+func requireSent(t *testing.T, data []byte, path, value string) {
+	t.Helper()
+
+	fields := jsonFields(data, path)
+	if len(fields) == 0 && value == "" {
+		return
+	}
+	for _, f := range fields {
+		if f == value {
+			return
+		}
+	}
+	t.Errorf("parsed %q, not a %s of %s", value, path, data)
+}
+
+// fail unless every value is empty or a finite number
+func requireNumbers(t *testing.T, data []byte, values ...string) {
+	t.Helper()
+
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		if _, err := parseNumber(v); err != nil {
+			t.Errorf("parsed %q from %s: %v", v, data, err)
+		}
+	}
+}
+
+// fail unless every level of a book side was sent as a [price, size, ...]
+// level of that side
+func requireLevels(t *testing.T, data []byte, levels []book.Level, sent [][]string) {
+	t.Helper()
+
+	for _, l := range levels {
+		found := false
+		for _, s := range sent {
+			if len(s) >= 2 && s[0] == l.Price && s[1] == l.Size {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("level %+v was not sent on its side in %s", l, data)
+		}
+	}
+}
+
+func TestCheckQuote(t *testing.T) {
+	tests := []struct {
+		update MarketUpdate
+		valid  bool
+	}{
+		{MarketUpdate{Bid: "10", BidSize: "1", Ask: "11", AskSize: "2"}, true},
+		{MarketUpdate{Bid: "10"}, true},
+		{MarketUpdate{Ask: "11", AskSize: "0"}, true},
+		{MarketUpdate{}, false},
+		{MarketUpdate{BidSize: "1", Ask: "11"}, false},
+		{MarketUpdate{Bid: "0", Ask: "11"}, false},
+		{MarketUpdate{Bid: "-10", Ask: "11"}, false},
+		{MarketUpdate{Bid: "10", BidSize: "-1"}, false},
+		{MarketUpdate{Bid: "NaN"}, false},
+		{MarketUpdate{Bid: "10", BidSize: "Inf"}, false},
+		{MarketUpdate{Bid: "10", Ask: "x"}, false},
+	}
+
+	for _, test := range tests {
+		if err := checkQuote(test.update); (err == nil) != test.valid {
+			t.Errorf("%+v: %v", test.update, err)
+		}
+	}
+}
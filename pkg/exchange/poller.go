@@ -0,0 +1,315 @@
+// Poll a REST ticker endpoint for venues without a usable websocket feed.
+// Venues are described declaratively so they can be added without writing Go
+
+package exchange
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ratelimit"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/transport"
+)
+
+// Mapping from a json ticker response to a MarketUpdate. Each field is a
+// dotted path into the response: array elements are selected by index and
+// * selects the only value of an object, e.g. "data.0.bidPx" or "result.*.b.0"
+type FieldMapping struct {
+	Bid     string `json:"bid"`
+	Ask     string `json:"ask"`
+	BidSize string `json:"bidSize"`
+	AskSize string `json:"askSize"`
+}
+
+type PollerConfig struct {
+	Name string `json:"name"`
+	// ticker endpoint, {symbol} is replaced with the venue's symbol
+	URL      string   `json:"url"`
+	Interval Duration `json:"interval"`
+	// random fraction of the interval added or removed from each wait
+	Jitter float64 `json:"jitter"`
+	// maximum requests per second to the venue, shared by all of its pollers.
+	// Zero for no limit, ignored for venues with a REST limit in the rate limit config
+	RateLimit float64      `json:"rateLimit"`
+	Fields    FieldMapping `json:"fields"`
+	// venue symbols by base currency then quote currency
+	Symbols map[string]map[string]string `json:"symbols"`
+}
+
+// A time.Duration that unmarshals from json strings such as "1s" or "500ms"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+// Load poller configs from a json file containing a list of venues
+func LoadPollerConfigs(path string) ([]PollerConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []PollerConfig
+	if err := json.Unmarshal(bytes, &configs); err != nil {
+		return nil, err
+	}
+
+	return configs, nil
+}
+
+// Venue symbol for a currency pair, empty if the venue does not list it
+func (c PollerConfig) Symbol(baseCurrency string, quoteCurrency string) string {
+	return c.Symbols[baseCurrency][quoteCurrency]
+}
+
+// consecutive failed polls after which the last quote is withdrawn
+const maxFailedPolls = 3
+
+type Poller struct {
+	updates chan MarketUpdate
+	config  PollerConfig
+	url     string
+	name    string
+	valid   bool
+	limiter *ratelimit.Limiter
+	logger  *logger.Logger
+
+	// validators from the last response, for conditional requests
+	etag         string
+	lastModified string
+}
+
+// Create new Poller for a venue symbol
+func NewPoller(config PollerConfig, symbol string) *Poller {
+	c := make(chan MarketUpdate, updateBufSize)
+	name := fmt.Sprintf("%s: %s", config.Name, symbol)
+	if config.Interval.Duration <= 0 {
+		config.Interval.Duration = time.Second
+	}
+
+	return &Poller{
+		updates: c,
+		config:  config,
+		url:     strings.ReplaceAll(config.URL, "{symbol}", symbol),
+		name:    name,
+		valid:   symbol != "" && config.URL != "",
+		limiter: restLimiter(config.Name, config.RateLimit),
+		logger:  logger.Named(name),
+	}
+}
+
+// Poll the ticker endpoint, send any top of book updates
+// over the updates channel as a MarketUpdate struct
+func (e *Poller) Recv() {
+	e.run(nil, false)
+}
+
+// Name of data source
+func (e *Poller) Name() string {
+	return e.name
+}
+
+// Access to update channel
+func (e *Poller) Updates() chan MarketUpdate {
+	return e.updates
+}
+
+func (e *Poller) Valid() bool {
+	return e.valid
+}
+
+// poll until stop is closed, marking updates as degraded if they stand in
+// for a websocket feed
+func (e *Poller) run(stop chan struct{}, degraded bool) {
+	lastUpdate := MarketUpdate{}
+	failures := 0
+	for {
+		update, changed, wait, err := e.poll()
+		if err != nil {
+			e.logger.Warn("poll failed ", err)
+			failures++
+			if failures >= maxFailedPolls && lastUpdate != (MarketUpdate{}) {
+				// the last quote is too old to keep publishing
+				e.logger.Warn(failures, " polls failed, withdrawing quote")
+				e.updates <- MarketUpdate{Name: e.name}
+				lastUpdate = MarketUpdate{}
+			}
+		} else {
+			failures = 0
+			if changed && update != lastUpdate {
+				update.Degraded = degraded
+				e.updates <- update
+				lastUpdate = update
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(e.nextWait(wait)):
+		}
+	}
+}
+
+// make a single conditional request. Returns false if the ticker has not been
+// modified, and a minimum wait if the venue asked us to slow down
+func (e *Poller) poll() (MarketUpdate, bool, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, e.url, nil)
+	if err != nil {
+		return MarketUpdate{}, false, 0, err
+	}
+	if e.etag != "" {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	if e.lastModified != "" {
+		req.Header.Set("If-Modified-Since", e.lastModified)
+	}
+
+	if err := e.limiter.Wait(); err != nil {
+		return MarketUpdate{}, false, 0, err
+	}
+	resp, err := transport.HTTPClient().Do(req)
+	if err != nil {
+		return MarketUpdate{}, false, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return MarketUpdate{}, false, 0, nil
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		retry, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return MarketUpdate{}, false, time.Duration(retry) * time.Second, errors.New(resp.Status)
+	default:
+		return MarketUpdate{}, false, 0, errors.New(resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return MarketUpdate{}, false, 0, err
+	}
+
+	update, err := e.config.Fields.parse(body)
+	if err != nil {
+		return MarketUpdate{}, false, 0, err
+	}
+	update.Name = e.name
+
+	e.etag = resp.Header.Get("ETag")
+	e.lastModified = resp.Header.Get("Last-Modified")
+
+	return update, true, 0, nil
+}
+
+// time until the next request, respecting the interval and jitter. The rate
+// limit is applied when the request is made
+func (e *Poller) nextWait(minimum time.Duration) time.Duration {
+	wait := e.config.Interval.Duration
+	if e.config.Jitter > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * e.config.Jitter * float64(wait))
+	}
+
+	if wait < minimum {
+		wait = minimum
+	}
+
+	return wait
+}
+
+// parse a json ticker response into a MarketUpdate
+func (m FieldMapping) parse(body []byte) (MarketUpdate, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return MarketUpdate{}, err
+	}
+
+	var update MarketUpdate
+	fields := []struct {
+		path  string
+		value *string
+	}{
+		{m.Bid, &update.Bid},
+		{m.Ask, &update.Ask},
+		{m.BidSize, &update.BidSize},
+		{m.AskSize, &update.AskSize},
+	}
+
+	for _, f := range fields {
+		if f.path == "" {
+			continue
+		}
+
+		value, err := lookup(v, f.path)
+		if err != nil {
+			return MarketUpdate{}, err
+		}
+		*f.value = value
+	}
+
+	return update, checkQuote(update)
+}
+
+// follow a dotted path through decoded json, returning the value as a string
+func lookup(v interface{}, path string) (string, error) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			if key == "*" && len(node) == 1 {
+				for _, child := range node {
+					v = child
+				}
+				continue
+			}
+
+			child, ok := node[key]
+			if !ok {
+				return "", fmt.Errorf("%s: missing key %q", path, key)
+			}
+			v = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("%s: invalid index %q", path, key)
+			}
+			v = node[i]
+		default:
+			return "", fmt.Errorf("%s: cannot select %q from a value", path, key)
+		}
+	}
+
+	switch value := v.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	}
+
+	return "", fmt.Errorf("%s: not a string or number", path)
+}
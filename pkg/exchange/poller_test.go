@@ -0,0 +1,105 @@
+package exchange
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollerWithdrawsAfterFailedPolls(t *testing.T) {
+	// one quote, then the venue fails until the last few requests
+	requests := &atomic.Int64{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		if n == 1 || n > 1+maxFailedPolls+2 {
+			w.Write([]byte(`{"bid":"27012.34","ask":"27013.87"}`))
+			return
+		}
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	p := NewPoller(PollerConfig{
+		Name:     "Test",
+		URL:      srv.URL + "/{symbol}",
+		Interval: Duration{10 * time.Millisecond},
+		Fields:   FieldMapping{Bid: "bid", Ask: "ask"},
+	}, "BTC-USD")
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		p.run(stop, true)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	if update := receive(t, p.Updates()); update.Bid != "27012.34" || !update.Degraded {
+		t.Fatalf("received %+v, expected a degraded quote", update)
+	}
+	if update := receive(t, p.Updates()); update != (MarketUpdate{Name: "Test: BTC-USD"}) {
+		t.Fatalf("received %+v, expected the quote to be withdrawn", update)
+	}
+	if n := requests.Load(); n < 1+maxFailedPolls {
+		t.Errorf("withdrawn after %d failed polls, expected %d", n-1, maxFailedPolls)
+	}
+
+	// the same quote is published again once polls succeed
+	if update := receive(t, p.Updates()); update.Bid != "27012.34" {
+		t.Errorf("received %+v, expected the quote to be republished", update)
+	}
+}
+
+func TestBitstampFallbackSizes(t *testing.T) {
+	update, err := bitstampFallback.Fields.parse(fixture(t, "bitstamp/order_book_rest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := MarketUpdate{Bid: "27012.34", BidSize: "0.05000000", Ask: "27013.87", AskSize: "0.41200000"}
+	if update != expected {
+		t.Errorf("parsed %+v, expected %+v", update, expected)
+	}
+}
+
+func FuzzFieldMapping(f *testing.F) {
+	f.Add([]byte(`{"symbol":"BTCUSD","bidPrice":"27010.55","bidQty":"0.044","askPrice":"27012.16","askQty":"0.11"}`))
+	f.Add([]byte(`[27010,5.7,27011,3.9,-120,-0.0044,27012,812.4,27400,26800]`))
+	f.Add([]byte(`{"bid":"27010","ask":"27012","last":"27011","volume":"1520.3"}`))
+	f.Add([]byte(`{"result":{"list":[{"bid1Price":"27011.92","bid1Size":"0.743","ask1Price":"27011.93","ask1Size":"1.512"}]}}`))
+	f.Add([]byte(`{"bids":[["27013.01","0.12",3]],"asks":[]}`))
+	f.Add([]byte(`{"bid":27010,"ask":null}`))
+
+	mappings := []FieldMapping{
+		binanceUSFallback.Fields,
+		bitfinexFallback.Fields,
+		bitstampFallback.Fields,
+		bybitFallback.Fields,
+		coinbaseFallback.Fields,
+		// prices only
+		{Bid: "bid", Ask: "ask"},
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, m := range mappings {
+			update, err := m.parse(data)
+			if err != nil {
+				continue
+			}
+			requireNumbers(t, data, update.Bid, update.BidSize, update.Ask, update.AskSize)
+
+			// fields without a path are never filled
+			if m.BidSize == "" && update.BidSize != "" || m.AskSize == "" && update.AskSize != "" {
+				t.Errorf("%+v parsed unmapped sizes %+v from %s", m, update, data)
+			}
+			if update.Bid == "" && update.Ask == "" {
+				t.Errorf("%+v parsed an empty quote from %s", m, data)
+			}
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package exchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ratelimit"
+)
+
+// A token bucket allowing Limit requests per Per
+type RateLimit struct {
+	Limit int      `json:"limit"`
+	Per   Duration `json:"per"`
+	// "queue" waits for a token, "reject" fails immediately. Defaults to queue
+	Mode string `json:"mode"`
+	// longest a queued request waits before being rejected, zero waits forever
+	MaxWait Duration `json:"maxWait"`
+}
+
+// Limits of a venue, nil for no limit
+type VenueLimits struct {
+	// REST requests, shared by snapshots, token requests and pollers
+	REST *RateLimit `json:"rest"`
+	// messages written on each websocket connection
+	Websocket *RateLimit `json:"websocket"`
+	// application pings on each websocket connection, counted against
+	// Websocket if nil
+	Pings *RateLimit `json:"pings"`
+}
+
+var (
+	rateLimitMux = &sync.Mutex{}
+	rateLimits   = make(map[string]VenueLimits)
+)
+
+// Load rate limits from a json file mapping venue names to their limits
+func LoadRateLimits(path string) (map[string]VenueLimits, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var limits map[string]VenueLimits
+	if err := json.Unmarshal(bytes, &limits); err != nil {
+		return nil, err
+	}
+
+	return limits, nil
+}
+
+// Apply limits to every connection and REST limiter created after the call.
+// Venues without limits are not throttled
+func SetRateLimits(limits map[string]VenueLimits) error {
+	for venue, l := range limits {
+		for _, limit := range []*RateLimit{l.REST, l.Websocket, l.Pings} {
+			if limit == nil {
+				continue
+			}
+			if limit.Limit < 1 || limit.Per.Duration <= 0 {
+				return fmt.Errorf("%s: limit and period must be positive", venue)
+			}
+			if _, err := limit.mode(); err != nil {
+				return fmt.Errorf("%s: %w", venue, err)
+			}
+		}
+	}
+
+	rateLimitMux.Lock()
+	defer rateLimitMux.Unlock()
+	rateLimits = limits
+	return nil
+}
+
+// Limiter for the messages written on one websocket connection to a venue,
+// nil if the venue has no limit
+func websocketLimiter(venue string) *ratelimit.Limiter {
+	return venueLimits(venue).Websocket.limiter(venue + " websocket")
+}
+
+// Limiter for the application pings on one websocket connection to a venue,
+// nil if pings have no limit of their own
+func pingLimiter(venue string) *ratelimit.Limiter {
+	return venueLimits(venue).Pings.limiter(venue + " pings")
+}
+
+func venueLimits(venue string) VenueLimits {
+	rateLimitMux.Lock()
+	defer rateLimitMux.Unlock()
+	return rateLimits[venue]
+}
+
+// create a limiter, nil for a nil limit
+func (l *RateLimit) limiter(name string) *ratelimit.Limiter {
+	if l == nil {
+		return nil
+	}
+
+	// validated by SetRateLimits
+	mode, _ := l.mode()
+	limiter := ratelimit.New(name, l.Limit, l.Per.Duration, mode)
+	limiter.SetMaxWait(l.MaxWait.Duration)
+	return limiter
+}
+
+func (l *RateLimit) mode() (ratelimit.Mode, error) {
+	switch l.Mode {
+	case "", "queue":
+		return ratelimit.Queue, nil
+	case "reject":
+		return ratelimit.Reject, nil
+	default:
+		return 0, fmt.Errorf("unknown rate limit mode %q", l.Mode)
+	}
+}
@@ -0,0 +1,54 @@
+package exchange
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ratelimit"
+)
+
+func TestRateLimits(t *testing.T) {
+	limits, err := LoadRateLimits("ratelimits.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetRateLimits(limits); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetRateLimits(nil) })
+
+	if l := websocketLimiter("Binance.US"); l == nil || l.String() != "Binance.US websocket: 5 per 1s" {
+		t.Errorf("Binance.US websocket limited by %v", l)
+	}
+	if l := websocketLimiter("Bitstamp"); l != nil {
+		t.Errorf("Bitstamp websocket limited by %v", l)
+	}
+
+	// Kucoin pings have their own budget, and are rejected once it is used up
+	pings := pingLimiter("Kucoin")
+	for i := 0; i < 10; i++ {
+		if err := pings.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pings.Wait(); !errors.Is(err, ratelimit.ErrLimited) {
+		t.Errorf("ping over the limit returned %v, expected %v", err, ratelimit.ErrLimited)
+	}
+	if !websocketLimiter("Kucoin").Allow() {
+		t.Error("pings used up the Kucoin websocket budget")
+	}
+}
+
+func TestInvalidRateLimits(t *testing.T) {
+	invalid := []map[string]VenueLimits{
+		{"Test": {REST: &RateLimit{Limit: 0, Per: Duration{time.Second}}}},
+		{"Test": {Websocket: &RateLimit{Limit: 5}}},
+		{"Test": {Pings: &RateLimit{Limit: 5, Per: Duration{time.Second}, Mode: "drop"}}},
+	}
+	for _, limits := range invalid {
+		if err := SetRateLimits(limits); err == nil {
+			t.Errorf("%+v accepted", limits["Test"])
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package exchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ratelimit"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/transport"
+)
+
+// most diffs buffered while a local book waits for a usable snapshot, the
+// oldest are dropped beyond it
+const maxBufferedDiffs = 1000
+
+var (
+	restMux      = &sync.Mutex{}
+	restLimiters = make(map[string]*ratelimit.Limiter)
+)
+
+// Limiter shared by every REST request to a venue. perSecond is used if the
+// venue has no REST limit configured, nil is returned if neither sets a limit
+func restLimiter(venue string, perSecond float64) *ratelimit.Limiter {
+	restMux.Lock()
+	defer restMux.Unlock()
+
+	if l, ok := restLimiters[venue]; ok {
+		return l
+	}
+
+	l := venueLimits(venue).REST.limiter(venue + " REST")
+	if l == nil && perSecond > 0 {
+		// one request at a time, spaced evenly
+		l = ratelimit.New(venue+" REST", 1, time.Duration(float64(time.Second)/perSecond), ratelimit.Queue)
+	}
+	restLimiters[venue] = l
+	return l
+}
+
+// GET a REST endpoint and decode its json response into v
+func getJSON(limiter *ratelimit.Limiter, url string, v interface{}) error {
+	if err := limiter.Wait(); err != nil {
+		return err
+	}
+
+	resp, err := transport.HTTPClient().Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Paces the REST snapshots of a local book that lost sync, so a resync
+// fetches one snapshot instead of one per incremental message
+type snapshotSchedule struct {
+	backoff *backoff.ExponentialBackOff
+	next    time.Time
+}
+
+func newSnapshotSchedule() *snapshotSchedule {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = time.Second
+	b.MaxInterval = 30 * time.Second
+	b.MaxElapsedTime = 0
+	return &snapshotSchedule{backoff: b}
+}
+
+// whether a snapshot may be requested
+func (s *snapshotSchedule) due() bool {
+	return !time.Now().Before(s.next)
+}
+
+// delay the next snapshot after a failed or outdated one
+func (s *snapshotSchedule) failed() {
+	s.next = time.Now().Add(s.backoff.NextBackOff())
+}
+
+// allow the next resync to request a snapshot immediately
+func (s *snapshotSchedule) reset() {
+	s.backoff.Reset()
+	s.next = time.Time{}
+}
@@ -0,0 +1,104 @@
+package exchange
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// how long a test waits for an adapter before failing
+const testTimeout = 5 * time.Second
+
+// Serve a fake venue websocket. The nth connection is passed to the nth handler
+// and closed once it returns, connections beyond the handlers are refused.
+// Returns the websocket URL of the server
+func newVenueServer(t *testing.T, handlers ...func(conn *websocket.Conn)) string {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	mux := &sync.Mutex{}
+	connections := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		n := connections
+		connections++
+		mux.Unlock()
+
+		if n >= len(handlers) {
+			http.Error(w, "no more connections", http.StatusServiceUnavailable)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("could not upgrade connection %d: %v", n, err)
+			return
+		}
+		defer conn.Close()
+
+		handlers[n](conn)
+	}))
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// canned venue message from testdata
+func fixture(t testing.TB, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// write canned messages to a fake venue connection
+func send(t *testing.T, conn *websocket.Conn, messages ...[]byte) {
+	t.Helper()
+
+	for _, m := range messages {
+		if err := conn.WriteMessage(websocket.TextMessage, m); err != nil {
+			t.Errorf("could not send %s: %v", m, err)
+		}
+	}
+}
+
+// read the next request sent to a fake venue into v
+func readRequest(t *testing.T, conn *websocket.Conn, v interface{}) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Errorf("no request received: %v", err)
+		return
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Errorf("could not decode request %s: %v", data, err)
+	}
+}
+
+// next value sent on c, failing the test if none arrives in time
+func receive[T any](t *testing.T, c chan T) T {
+	t.Helper()
+
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(testTimeout):
+		var zero T
+		t.Fatalf("nothing received in %s", testTimeout)
+		return zero
+	}
+}
@@ -0,0 +1,234 @@
+// Build synthetic top of book quotes by chaining the quotes of other exchanges,
+// e.g. BTC/USDT on one venue and USDT/USD on another to price BTC/USD
+
+package exchange
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+)
+
+// A single hop of a synthetic route. Set Inverted when the venue lists the
+// pair the other way around, e.g. USD/USDT when the route needs USDT/USD
+type Leg struct {
+	Exchange Exchange
+	Inverted bool
+}
+
+type Synthetic struct {
+	updates chan MarketUpdate
+	legs    []Leg
+	name    string
+	path    string
+	valid   bool
+	logger  *logger.Logger
+}
+
+// Create a synthetic exchange from an ordered route of legs, the quote currency
+// of each leg must be the base currency of the next
+func NewSynthetic(legs ...Leg) *Synthetic {
+	c := make(chan MarketUpdate, updateBufSize)
+
+	names := make([]string, len(legs))
+	valid := len(legs) > 1
+	for i, leg := range legs {
+		names[i] = leg.Exchange.Name()
+		if leg.Inverted {
+			names[i] += " (inverted)"
+		}
+		valid = valid && leg.Exchange.Valid()
+	}
+	path := strings.Join(names, " -> ")
+	name := "Synthetic: " + path
+
+	return &Synthetic{
+		updates: c,
+		legs:    legs,
+		name:    name,
+		path:    path,
+		valid:   valid,
+		logger:  logger.Named(name),
+	}
+}
+
+// Build one synthetic exchange for every route from baseCurrency to quoteCurrency
+// known to the symbol manager. Each leg uses the first of venues listing its pair,
+// routes with a leg that no venue lists are skipped
+func NewSynthetics(symbols symbol.SymbolManager, baseCurrency string, quoteCurrency string, venues ...func(symbol.CurrencyPair) Exchange) []*Synthetic {
+	var synthetics []*Synthetic
+	for _, route := range symbols.GetRoutes(baseCurrency, quoteCurrency) {
+		first := listedOn(route.First, venues)
+		second := listedOn(route.Second, venues)
+		if first == nil || second == nil {
+			continue
+		}
+
+		synthetics = append(synthetics, NewSynthetic(
+			Leg{Exchange: first},
+			Leg{Exchange: second, Inverted: route.Inverted},
+		))
+	}
+
+	return synthetics
+}
+
+// exchange of the first venue listing pair, nil if none do
+func listedOn(pair symbol.CurrencyPair, venues []func(symbol.CurrencyPair) Exchange) Exchange {
+	for _, venue := range venues {
+		if e := venue(pair); e.Valid() {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Receive updates from every leg and send the chained quote over the updates
+// channel whenever it changes
+func (e *Synthetic) Recv() {
+	type legUpdate struct {
+		leg    int
+		update MarketUpdate
+	}
+
+	agg := make(chan legUpdate, updateBufSize)
+	for i, leg := range e.legs {
+		go leg.Exchange.Recv()
+		go func(i int, c chan MarketUpdate) {
+			for msg := range c {
+				agg <- legUpdate{leg: i, update: msg}
+			}
+		}(i, leg.Exchange.Updates())
+	}
+
+	quotes := make([]MarketUpdate, len(e.legs))
+	received := make([]bool, len(e.legs))
+	lastUpdate := MarketUpdate{}
+	for msg := range agg {
+		if e.legs[msg.leg].Inverted {
+			msg.update = Invert(msg.update)
+		}
+		quotes[msg.leg] = msg.update
+		received[msg.leg] = true
+
+		ready := true
+		for _, r := range received {
+			ready = ready && r
+		}
+		if !ready {
+			continue
+		}
+
+		update := Chain(quotes...)
+		update.Name = e.name
+		update.Synthetic = true
+		update.Path = e.path
+
+		if update != lastUpdate {
+			e.updates <- update
+		}
+		lastUpdate = update
+	}
+}
+
+// Name of data source
+func (e *Synthetic) Name() string {
+	return e.name
+}
+
+// Access to update channel
+func (e *Synthetic) Updates() chan MarketUpdate {
+	return e.updates
+}
+
+func (e *Synthetic) Valid() bool {
+	return e.valid
+}
+
+// Invert a quote for A/B into a quote for B/A, sizes are converted into
+// units of the new base currency
+func Invert(u MarketUpdate) MarketUpdate {
+	inverted := MarketUpdate{Name: u.Name, Synthetic: u.Synthetic, Path: u.Path}
+
+	if ask, askSize, ok := parseLevel(u.Ask, u.AskSize); ok {
+		inverted.Bid = formatFloat(1 / ask)
+		inverted.BidSize = formatFloat(askSize * ask)
+	}
+
+	if bid, bidSize, ok := parseLevel(u.Bid, u.BidSize); ok {
+		inverted.Ask = formatFloat(1 / bid)
+		inverted.AskSize = formatFloat(bidSize * bid)
+	}
+
+	return inverted
+}
+
+// Chain an ordered list of quotes (A/B, B/C, ...) into a single quote for the
+// base of the first and the quote currency of the last. Sizes are expressed in
+// the base currency and limited by the liquidity available on every leg.
+// A side is left empty if any leg is missing that side.
+func Chain(quotes ...MarketUpdate) MarketUpdate {
+	chained := MarketUpdate{}
+	if len(quotes) == 0 {
+		return chained
+	}
+
+	if bid, bidSize, ok := chainSide(quotes, func(u MarketUpdate) (string, string) { return u.Bid, u.BidSize }); ok {
+		chained.Bid = formatFloat(bid)
+		chained.BidSize = formatFloat(bidSize)
+	}
+
+	if ask, askSize, ok := chainSide(quotes, func(u MarketUpdate) (string, string) { return u.Ask, u.AskSize }); ok {
+		chained.Ask = formatFloat(ask)
+		chained.AskSize = formatFloat(askSize)
+	}
+
+	return chained
+}
+
+// multiply prices along the route, tracking the most base currency that can
+// be pushed through every leg at the quoted price
+func chainSide(quotes []MarketUpdate, side func(MarketUpdate) (string, string)) (float64, float64, bool) {
+	price := 1.0
+	size := math.Inf(1)
+	for _, q := range quotes {
+		p, s, ok := parseLevel(side(q))
+		if !ok {
+			return 0, 0, false
+		}
+
+		// size of this leg is in units of its base, which is worth price units
+		// of the route's base currency
+		size = math.Min(size, s/price)
+		price *= p
+	}
+
+	return price, size, true
+}
+
+// parse a price and size, a missing or unparseable size is treated as unknown
+// and does not limit the chained size
+func parseLevel(price string, size string) (float64, float64, bool) {
+	p, err := strconv.ParseFloat(price, 64)
+	if err != nil || p <= 0 {
+		return 0, 0, false
+	}
+
+	s, err := strconv.ParseFloat(size, 64)
+	if err != nil || s <= 0 {
+		s = math.Inf(1)
+	}
+
+	return p, s, true
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 0) {
+		return ""
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
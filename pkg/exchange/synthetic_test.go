@@ -0,0 +1,159 @@
+package exchange
+
+import (
+	"testing"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/symbol"
+)
+
+// exchange that lists the pairs it has a Coinbase symbol for
+type fakeExchange struct {
+	name    string
+	updates chan MarketUpdate
+}
+
+func (e *fakeExchange) Recv()                      {}
+func (e *fakeExchange) Updates() chan MarketUpdate { return e.updates }
+func (e *fakeExchange) Valid() bool                { return e.name != "" }
+func (e *fakeExchange) Name() string               { return e.name }
+
+func fakeVenue(p symbol.CurrencyPair) Exchange {
+	return &fakeExchange{name: p.Coinbase, updates: make(chan MarketUpdate)}
+}
+
+type fakeSymbols struct {
+	routes []symbol.Route
+}
+
+func (s fakeSymbols) GetCurrencyPair(string, string) symbol.CurrencyPair {
+	return symbol.CurrencyPair{}
+}
+func (s fakeSymbols) GetRoutes(string, string) []symbol.Route        { return s.routes }
+func (s fakeSymbols) GetPerpetuals(string, string) symbol.Perpetuals { return symbol.Perpetuals{} }
+
+func TestNewSynthetics(t *testing.T) {
+	symbols := fakeSymbols{routes: []symbol.Route{
+		{
+			Intermediate: "USDT",
+			First:        symbol.CurrencyPair{Coinbase: "BTC-USDT"},
+			Second:       symbol.CurrencyPair{Coinbase: "USDT-USD"},
+		},
+		{
+			Intermediate: "EUR",
+			First:        symbol.CurrencyPair{Coinbase: "BTC-EUR"},
+			Second:       symbol.CurrencyPair{Coinbase: "USD-EUR"},
+			Inverted:     true,
+		},
+		{
+			// second leg is not listed anywhere
+			Intermediate: "GBP",
+			First:        symbol.CurrencyPair{Coinbase: "BTC-GBP"},
+		},
+	}}
+
+	synthetics := NewSynthetics(symbols, "BTC", "USD", fakeVenue)
+	if len(synthetics) != 2 {
+		t.Fatalf("built %d synthetics, expected 2", len(synthetics))
+	}
+
+	if name := synthetics[0].Name(); name != "Synthetic: BTC-USDT -> USDT-USD" {
+		t.Errorf("first synthetic named %q", name)
+	}
+	if name := synthetics[1].Name(); name != "Synthetic: BTC-EUR -> USD-EUR (inverted)" {
+		t.Errorf("second synthetic named %q", name)
+	}
+	for _, s := range synthetics {
+		if !s.Valid() {
+			t.Errorf("%s not valid", s.Name())
+		}
+	}
+}
+
+func TestInvert(t *testing.T) {
+	// USD/EUR into EUR/USD, sizes in euros
+	u := MarketUpdate{
+		Bid: "0.5", BidSize: "200",
+		Ask: "1.25", AskSize: "100",
+		Name: "Test: USD-EUR",
+	}
+
+	want := MarketUpdate{
+		Bid: "0.8", BidSize: "125",
+		Ask: "2", AskSize: "100",
+		Name: "Test: USD-EUR",
+	}
+	if inverted := Invert(u); inverted != want {
+		t.Errorf("inverted %+v into %+v, expected %+v", u, inverted, want)
+	}
+}
+
+func TestChain(t *testing.T) {
+	btcUSDT := MarketUpdate{
+		Bid: "20000", BidSize: "2",
+		Ask: "20000", AskSize: "1",
+	}
+	usdtUSD := MarketUpdate{
+		Bid: "0.5", BidSize: "30000",
+		Ask: "2", AskSize: "5000",
+	}
+	btcEUR := MarketUpdate{
+		Bid: "25000", BidSize: "1",
+		Ask: "25000", AskSize: "0.5",
+	}
+	usdEUR := MarketUpdate{
+		Bid: "0.5", BidSize: "200",
+		Ask: "1.25", AskSize: "100",
+	}
+
+	tests := []struct {
+		name   string
+		quotes []MarketUpdate
+		want   MarketUpdate
+	}{
+		{
+			// bid size is limited by the first leg, ask size by the 5000 USDT
+			// of the second, worth 0.25 BTC
+			name:   "BTC/USDT x USDT/USD",
+			quotes: []MarketUpdate{btcUSDT, usdtUSD},
+			want: MarketUpdate{
+				Bid: "10000", BidSize: "1.5",
+				Ask: "40000", AskSize: "0.25",
+			},
+		},
+		{
+			name:   "BTC/EUR x inverted USD/EUR",
+			quotes: []MarketUpdate{btcEUR, Invert(usdEUR)},
+			want: MarketUpdate{
+				Bid: "20000", BidSize: "0.005",
+				Ask: "50000", AskSize: "0.004",
+			},
+		},
+		{
+			name:   "leg without a bid",
+			quotes: []MarketUpdate{btcUSDT, {Ask: "2", AskSize: "5000"}},
+			want:   MarketUpdate{Ask: "40000", AskSize: "0.25"},
+		},
+		{
+			// unknown sizes do not limit the chained size
+			name:   "leg without sizes",
+			quotes: []MarketUpdate{btcUSDT, {Bid: "0.5", Ask: "2"}},
+			want: MarketUpdate{
+				Bid: "10000", BidSize: "2",
+				Ask: "40000", AskSize: "1",
+			},
+		},
+		{
+			name:   "no sizes at all",
+			quotes: []MarketUpdate{{Bid: "20000", Ask: "20000"}, {Bid: "0.5", Ask: "2"}},
+			want:   MarketUpdate{Bid: "10000", Ask: "40000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if chained := Chain(tt.quotes...); chained != tt.want {
+				t.Errorf("chained %+v, expected %+v", chained, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// Compute a composite index price from the top of book of every live venue.
+// Unlike the best bid and ask, the index resists a single venue printing a bad quote
+
+package index
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/exchange"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+)
+
+type Config struct {
+	// minimum number of live venues required to publish a price
+	Quorum int
+	// venues that have not updated within this window are excluded, zero
+	// disables. Venues are also removed when the aggregator withdraws their
+	// quote, this covers venues that go quiet without being withdrawn
+	Staleness time.Duration
+	// fraction of venues dropped from each end for the trimmed mean, in [0, 0.5)
+	Trim float64
+}
+
+type Price struct {
+	Median      string
+	Weighted    string
+	TrimmedMean string
+	Venues      int
+	Time        time.Time
+}
+
+type Index struct {
+	updates chan Price
+	config  Config
+	logger  *logger.Logger
+}
+
+type venueMid struct {
+	mid    float64
+	weight float64
+	time   time.Time
+}
+
+// Create a new index calculator
+func New(config Config) *Index {
+	if config.Quorum < 1 {
+		config.Quorum = 1
+	}
+
+	return &Index{
+		updates: make(chan Price, 100),
+		config:  config,
+		logger:  logger.Named("Index"),
+	}
+}
+
+// Receive venue top of book updates, typically from Aggregator.Tap, and send
+// a Price over the updates channel whenever the index changes
+func (i *Index) Recv(venues chan exchange.MarketUpdate) {
+	mids := make(map[string]venueMid)
+	last := Price{}
+
+	// re-evaluate periodically so that stale venues drop out without an update
+	var expire <-chan time.Time
+	if i.config.Staleness > 0 {
+		ticker := time.NewTicker(i.config.Staleness / 2)
+		defer ticker.Stop()
+		expire = ticker.C
+	}
+
+	for {
+		select {
+		case msg, ok := <-venues:
+			if !ok {
+				close(i.updates)
+				return
+			}
+
+			mid, weight, ok := parseMid(msg)
+			if !ok {
+				delete(mids, msg.Name)
+				break
+			}
+			mids[msg.Name] = venueMid{mid: mid, weight: weight, time: time.Now()}
+		case <-expire:
+		}
+
+		price, ok := i.compute(mids, time.Now())
+		if !ok {
+			continue
+		}
+
+		if price.Median != last.Median || price.Weighted != last.Weighted ||
+			price.TrimmedMean != last.TrimmedMean || price.Venues != last.Venues {
+			i.updates <- price
+			last = price
+		}
+	}
+}
+
+// Access the updates channel
+func (i *Index) Updates() chan Price {
+	return i.updates
+}
+
+func (i *Index) compute(mids map[string]venueMid, now time.Time) (Price, bool) {
+	var values []float64
+	var weighted, totalWeight float64
+	for name, v := range mids {
+		if i.config.Staleness > 0 && now.Sub(v.time) > i.config.Staleness {
+			i.logger.Debug("excluding stale venue ", name)
+			continue
+		}
+
+		values = append(values, v.mid)
+		weighted += v.mid * v.weight
+		totalWeight += v.weight
+	}
+
+	if len(values) < i.config.Quorum {
+		return Price{}, false
+	}
+
+	sort.Float64s(values)
+	price := Price{
+		Median:      formatFloat(median(values)),
+		TrimmedMean: formatFloat(trimmedMean(values, i.config.Trim)),
+		Venues:      len(values),
+		Time:        now,
+	}
+	if totalWeight > 0 {
+		price.Weighted = formatFloat(weighted / totalWeight)
+	}
+
+	return price, true
+}
+
+// mid price of a venue, weighted by the size available at the top of its book
+func parseMid(u exchange.MarketUpdate) (float64, float64, bool) {
+	bid, err := strconv.ParseFloat(u.Bid, 64)
+	if err != nil || bid <= 0 {
+		return 0, 0, false
+	}
+
+	ask, err := strconv.ParseFloat(u.Ask, 64)
+	if err != nil || ask <= 0 {
+		return 0, 0, false
+	}
+
+	bidSize, _ := strconv.ParseFloat(u.BidSize, 64)
+	askSize, _ := strconv.ParseFloat(u.AskSize, 64)
+
+	return (bid + ask) / 2, math.Max(bidSize, 0) + math.Max(askSize, 0), true
+}
+
+// values must be sorted
+func median(values []float64) float64 {
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// values must be sorted
+func trimmedMean(values []float64, trim float64) float64 {
+	k := int(float64(len(values)) * trim)
+	if 2*k >= len(values) {
+		k = (len(values) - 1) / 2
+	}
+
+	sum := 0.0
+	kept := values[k : len(values)-k]
+	for _, v := range kept {
+		sum += v
+	}
+
+	return sum / float64(len(kept))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,130 @@
+package index
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompute(t *testing.T) {
+	now := time.Now()
+	fresh := now.Add(-time.Second)
+	stale := now.Add(-time.Minute)
+
+	tests := []struct {
+		name   string
+		config Config
+		mids   map[string]venueMid
+		want   Price
+		ok     bool
+	}{
+		{
+			name:   "odd number of venues",
+			config: Config{Quorum: 1},
+			mids: map[string]venueMid{
+				"a": {mid: 100, weight: 1, time: fresh},
+				"b": {mid: 102, weight: 1, time: fresh},
+				"c": {mid: 110, weight: 2, time: fresh},
+			},
+			want: Price{Median: "102", Weighted: "105.5", TrimmedMean: "104", Venues: 3},
+			ok:   true,
+		},
+		{
+			name:   "even number of venues",
+			config: Config{Quorum: 1},
+			mids: map[string]venueMid{
+				"a": {mid: 100, weight: 1, time: fresh},
+				"b": {mid: 101, weight: 1, time: fresh},
+				"c": {mid: 103, weight: 1, time: fresh},
+				"d": {mid: 200, weight: 1, time: fresh},
+			},
+			want: Price{Median: "102", Weighted: "126", TrimmedMean: "126", Venues: 4},
+			ok:   true,
+		},
+		{
+			// a quarter of four venues is dropped from each end
+			name:   "trimmed mean",
+			config: Config{Quorum: 1, Trim: 0.25},
+			mids: map[string]venueMid{
+				"a": {mid: 100, weight: 1, time: fresh},
+				"b": {mid: 101, weight: 1, time: fresh},
+				"c": {mid: 103, weight: 1, time: fresh},
+				"d": {mid: 200, weight: 1, time: fresh},
+			},
+			want: Price{Median: "102", Weighted: "126", TrimmedMean: "102", Venues: 4},
+			ok:   true,
+		},
+		{
+			// trimming never drops every venue
+			name:   "trim of a single venue",
+			config: Config{Quorum: 1, Trim: 0.49},
+			mids: map[string]venueMid{
+				"a": {mid: 100, weight: 1, time: fresh},
+			},
+			want: Price{Median: "100", Weighted: "100", TrimmedMean: "100", Venues: 1},
+			ok:   true,
+		},
+		{
+			name:   "no sizes",
+			config: Config{Quorum: 1},
+			mids: map[string]venueMid{
+				"a": {mid: 100, time: fresh},
+				"b": {mid: 102, time: fresh},
+			},
+			want: Price{Median: "101", TrimmedMean: "101", Venues: 2},
+			ok:   true,
+		},
+		{
+			name:   "below quorum",
+			config: Config{Quorum: 3},
+			mids: map[string]venueMid{
+				"a": {mid: 100, weight: 1, time: fresh},
+				"b": {mid: 102, weight: 1, time: fresh},
+			},
+		},
+		{
+			name:   "stale venue excluded",
+			config: Config{Quorum: 1, Staleness: 10 * time.Second},
+			mids: map[string]venueMid{
+				"a": {mid: 100, weight: 1, time: fresh},
+				"b": {mid: 200, weight: 1, time: stale},
+			},
+			want: Price{Median: "100", Weighted: "100", TrimmedMean: "100", Venues: 1},
+			ok:   true,
+		},
+		{
+			name:   "stale venues below quorum",
+			config: Config{Quorum: 2, Staleness: 10 * time.Second},
+			mids: map[string]venueMid{
+				"a": {mid: 100, weight: 1, time: fresh},
+				"b": {mid: 200, weight: 1, time: stale},
+			},
+		},
+		{
+			name:   "stale venues kept without a staleness window",
+			config: Config{Quorum: 2},
+			mids: map[string]venueMid{
+				"a": {mid: 100, weight: 1, time: fresh},
+				"b": {mid: 200, weight: 1, time: stale},
+			},
+			want: Price{Median: "150", Weighted: "150", TrimmedMean: "150", Venues: 2},
+			ok:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, ok := New(tt.config).compute(tt.mids, now)
+			if ok != tt.ok {
+				t.Fatalf("computed %v, expected %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+
+			tt.want.Time = now
+			if price != tt.want {
+				t.Errorf("computed %+v, expected %+v", price, tt.want)
+			}
+		})
+	}
+}
@@ -53,7 +53,16 @@ func CreateLogger() error {
 	return nil
 }
 
+// Create a named logger. Logs are discarded if CreateLogger has not been called,
+// e.g. in tests
 func Named(name string) *Logger {
+	if l == nil {
+		return &Logger{
+			logger: zap.NewNop().Sugar(),
+			mux:    &sync.Mutex{},
+		}
+	}
+
 	return &Logger{
 		logger: l.logger.Named(name),
 		mux:    &sync.Mutex{},
@@ -0,0 +1,146 @@
+// Token bucket rate limiting for messages and requests sent to venues, so
+// bursts such as subscribing to many pairs at once stay within venue limits
+
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// What happens to a request made while the bucket is empty
+type Mode int
+
+const (
+	// wait for a token
+	Queue Mode = iota
+	// fail immediately with ErrLimited
+	Reject
+)
+
+// Returned, wrapped with the limit that was exceeded, when a request is rejected
+var ErrLimited = errors.New("rate limit exceeded")
+
+// A token bucket holding up to limit tokens, refilled at limit tokens per
+// period. A nil Limiter allows everything
+type Limiter struct {
+	name  string
+	limit int
+	per   time.Duration
+	mode  Mode
+	// longest a queued request waits before being rejected, zero waits forever
+	maxWait time.Duration
+
+	mux *sync.Mutex
+	// may be negative while requests are queued
+	tokens float64
+	last   time.Time
+}
+
+// Create a limiter allowing limit requests per period, named for errors
+func New(name string, limit int, per time.Duration, mode Mode) *Limiter {
+	if limit < 1 {
+		limit = 1
+	}
+
+	return &Limiter{
+		name:   name,
+		limit:  limit,
+		per:    per,
+		mode:   mode,
+		mux:    &sync.Mutex{},
+		tokens: float64(limit),
+		last:   time.Now(),
+	}
+}
+
+// Reject queued requests that would wait longer than d
+func (l *Limiter) SetMaxWait(d time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.maxWait = d
+}
+
+// Take a token, waiting for one in Queue mode. Returns an error wrapping
+// ErrLimited if the request is rejected
+func (l *Limiter) Wait() error {
+	if l == nil {
+		return nil
+	}
+
+	wait, err := l.reserve()
+	if err != nil {
+		return err
+	}
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+// Take a token if one is available without waiting
+func (l *Limiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.refill()
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
+
+func (l *Limiter) String() string {
+	return fmt.Sprintf("%s: %d per %s", l.name, l.limit, l.per)
+}
+
+// take a token now or in the future, returning how long to wait for it
+func (l *Limiter) reserve() (time.Duration, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.refill()
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, nil
+	}
+
+	if l.mode == Reject {
+		return 0, fmt.Errorf("%w, %s", ErrLimited, l)
+	}
+
+	wait := time.Duration((1 - l.tokens) / l.rate() * float64(time.Second))
+	if l.maxWait > 0 && wait > l.maxWait {
+		return 0, fmt.Errorf("%w, %s, would wait %s", ErrLimited, l, wait.Round(time.Millisecond))
+	}
+
+	l.tokens--
+	return wait, nil
+}
+
+// add the tokens earned since the last refill, only called with mux held
+func (l *Limiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate()
+	if l.tokens > float64(l.limit) {
+		l.tokens = float64(l.limit)
+	}
+	l.last = now
+}
+
+// tokens per second
+func (l *Limiter) rate() float64 {
+	if l.per <= 0 {
+		return float64(l.limit)
+	}
+	return float64(l.limit) / l.per.Seconds()
+}
@@ -8,24 +8,57 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"sort"
 )
 
 type SymbolManager interface {
 	GetCurrencyPair(baseCurrency string, quoteCurrency string) CurrencyPair
+	GetRoutes(baseCurrency string, quoteCurrency string) []Route
+	GetPerpetuals(baseCurrency string, quoteCurrency string) Perpetuals
 }
 
 type CurrencyPair struct {
 	BinanceUS string `json:"Binance.US"`
+	Bitfinex  string `json:"Bitfinex"`
 	Bitstamp  string `json:"Bitstamp"`
+	Bybit     string `json:"Bybit"`
 	Coinbase  string `json:"Coinbase"`
 	CryptoCom string `json:"Crypto.com"`
 	Gemini    string `json:"Gemini"`
 	Kraken    string `json:"Kraken"`
 	Kucoin    string `json:"Kucoin"`
+	OKX       string `json:"OKX"`
+}
+
+// A two legged route from a base currency to a quote currency through an
+// intermediate currency, used to build synthetic quotes.
+// Second is listed as quote/intermediate rather than intermediate/quote if Inverted
+type Route struct {
+	Intermediate string
+	First        CurrencyPair
+	Second       CurrencyPair
+	Inverted     bool
+}
+
+// Specification of a linear perpetual contract. ContractSize is the amount of
+// the base currency represented by one contract
+type Contract struct {
+	Symbol       string `json:"symbol"`
+	ContractSize string `json:"contractSize"`
+	TickSize     string `json:"tickSize"`
+	Settle       string `json:"settle"`
+}
+
+// Perpetual contracts on a currency pair across derivatives venues
+type Perpetuals struct {
+	BinanceUSDM Contract `json:"Binance USD-M"`
+	BybitLinear Contract `json:"Bybit Linear"`
+	OKXSwap     Contract `json:"OKX Swap"`
 }
 
 type JsonManager struct {
-	data map[string]map[string]CurrencyPair
+	data      map[string]map[string]CurrencyPair
+	contracts map[string]map[string]Perpetuals
 }
 
 // Load symbol data from the local json file
@@ -43,12 +76,71 @@ func LoadJsonSymbolData() (*JsonManager, error) {
 	var data map[string]map[string]CurrencyPair
 	json.Unmarshal(bytes, &data)
 
+	contracts, err := loadJsonContractData()
+	if err != nil {
+		return nil, err
+	}
+
 	return &JsonManager{
-		data: data,
+		data:      data,
+		contracts: contracts,
 	}, nil
 }
 
+// Load perpetual contract specs from the local json file, which is optional
+func loadJsonContractData() (map[string]map[string]Perpetuals, error) {
+	bytes, err := os.ReadFile("./pkg/symbol/contract_database.json")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var contracts map[string]map[string]Perpetuals
+	if err := json.Unmarshal(bytes, &contracts); err != nil {
+		return nil, err
+	}
+
+	return contracts, nil
+}
+
 // Get a currency pair from the json SymbolManager implementation
 func (j *JsonManager) GetCurrencyPair(baseCurrency string, quoteCurrency string) CurrencyPair {
 	return j.data[baseCurrency][quoteCurrency]
 }
+
+// Get the perpetual contracts on a currency pair from the json SymbolManager implementation
+func (j *JsonManager) GetPerpetuals(baseCurrency string, quoteCurrency string) Perpetuals {
+	return j.contracts[baseCurrency][quoteCurrency]
+}
+
+// Get every route from baseCurrency to quoteCurrency through one intermediate currency
+func (j *JsonManager) GetRoutes(baseCurrency string, quoteCurrency string) []Route {
+	var routes []Route
+	for intermediate, first := range j.data[baseCurrency] {
+		if intermediate == quoteCurrency {
+			continue
+		}
+
+		if second, ok := j.data[intermediate][quoteCurrency]; ok {
+			routes = append(routes, Route{
+				Intermediate: intermediate,
+				First:        first,
+				Second:       second,
+			})
+		} else if second, ok := j.data[quoteCurrency][intermediate]; ok {
+			routes = append(routes, Route{
+				Intermediate: intermediate,
+				First:        first,
+				Second:       second,
+				Inverted:     true,
+			})
+		}
+	}
+
+	sort.Slice(routes, func(i, k int) bool {
+		return routes[i].Intermediate < routes[k].Intermediate
+	})
+
+	return routes
+}
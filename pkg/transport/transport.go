@@ -0,0 +1,186 @@
+// Network settings shared by every websocket and REST connection: proxies,
+// trusted certificate authorities and extra handshake headers.
+// Configure is called once at startup, before any exchange connects
+
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type Config struct {
+	// http, https or socks5 proxy URL, e.g. "socks5://127.0.0.1:1080".
+	// The HTTPS_PROXY and NO_PROXY environment variables are used if empty
+	Proxy string `json:"proxy"`
+	// PEM bundle of certificate authorities to trust instead of the system pool
+	CAFile string `json:"caFile"`
+	// headers added to every websocket handshake and REST request
+	Headers map[string]string `json:"headers"`
+	// timeout for dialing and handshakes, and for whole REST requests
+	Timeout Duration `json:"timeout"`
+}
+
+// A time.Duration that unmarshals from json strings such as "10s"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+const defaultTimeout = 10 * time.Second
+
+var (
+	mux    = &sync.Mutex{}
+	header http.Header
+	dialer = newDialer(nil, http.ProxyFromEnvironment, defaultTimeout)
+	client = newHTTPClient(nil, http.ProxyFromEnvironment, nil, defaultTimeout)
+)
+
+// Load a config from a json file
+func LoadConfig(path string) (Config, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(bytes, &config); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+// Apply config to every connection made after the call
+func Configure(config Config) error {
+	proxy := http.ProxyFromEnvironment
+	if config.Proxy != "" {
+		u, err := url.Parse(config.Proxy)
+		if err != nil {
+			return err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	var tlsConfig *tls.Config
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + config.CAFile)
+		}
+		tlsConfig = &tls.Config{RootCAs: pool}
+	}
+
+	var h http.Header
+	for key, value := range config.Headers {
+		if h == nil {
+			h = make(http.Header)
+		}
+		h.Set(key, value)
+	}
+
+	timeout := config.Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	header = h
+	dialer = newDialer(tlsConfig, proxy, timeout)
+	client = newHTTPClient(tlsConfig, proxy, h, timeout)
+	return nil
+}
+
+// Websocket dialer with the configured proxy and TLS settings
+func Dialer() *websocket.Dialer {
+	mux.Lock()
+	defer mux.Unlock()
+	return dialer
+}
+
+// Headers to send with websocket handshakes, nil if there are none
+func Header() http.Header {
+	mux.Lock()
+	defer mux.Unlock()
+	return header.Clone()
+}
+
+// HTTP client with the configured proxy, TLS settings and headers
+func HTTPClient() *http.Client {
+	mux.Lock()
+	defer mux.Unlock()
+	return client
+}
+
+func newDialer(tlsConfig *tls.Config, proxy func(*http.Request) (*url.URL, error), timeout time.Duration) *websocket.Dialer {
+	return &websocket.Dialer{
+		Proxy:            proxy,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: timeout,
+		NetDialContext:   (&net.Dialer{Timeout: timeout}).DialContext,
+	}
+}
+
+func newHTTPClient(tlsConfig *tls.Config, proxy func(*http.Request) (*url.URL, error), h http.Header, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+
+	var rt http.RoundTripper = transport
+	if len(h) != 0 {
+		rt = headerTransport{header: h, next: transport}
+	}
+
+	return &http.Client{
+		Transport: rt,
+		Timeout:   timeout,
+	}
+}
+
+// adds headers to every request
+type headerTransport struct {
+	header http.Header
+	next   http.RoundTripper
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, values := range t.header {
+		if req.Header.Get(key) == "" {
+			req.Header[key] = values
+		}
+	}
+
+	return t.next.RoundTrip(req)
+}
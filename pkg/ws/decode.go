@@ -0,0 +1,71 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Bandwidth counters of a client. WireBytes are read from the network,
+// including framing, TLS and compression, DecodedBytes are the bytes of the
+// messages handed to readers after any decompression
+type Stats struct {
+	Messages     int64
+	WireBytes    int64
+	DecodedBytes int64
+}
+
+type counters struct {
+	messages     atomic.Int64
+	wireBytes    atomic.Int64
+	decodedBytes atomic.Int64
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		Messages:     c.messages.Load(),
+		WireBytes:    c.wireBytes.Load(),
+		DecodedBytes: c.decodedBytes.Load(),
+	}
+}
+
+// counts bytes read from the network
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// decompress a gzip or raw deflate binary frame of text, returns false if the
+// frame is not compressed with either. Raw deflate has no header, so a frame
+// only counts as deflated if it decodes to text using every byte of the frame
+func decompress(data []byte) ([]byte, bool) {
+	src := bytes.NewReader(data)
+
+	var r io.Reader
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, false
+		}
+		r = gz
+	} else {
+		r = flate.NewReader(src)
+	}
+
+	decoded, err := io.ReadAll(r)
+	if err != nil || src.Len() != 0 || !utf8.Valid(decoded) {
+		return nil, false
+	}
+
+	return decoded, true
+}
@@ -0,0 +1,78 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDecompress(t *testing.T) {
+	message := []byte(`{"arg":{"channel":"bbo-tbt","instId":"BTC-USDT"},"data":[{"asks":[["27013.8","0.4"]]}]}`)
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(message)
+	gz.Close()
+
+	var deflated bytes.Buffer
+	fl, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fl.Write(message)
+	fl.Close()
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		decoded []byte
+	}{
+		{"gzip", gzipped.Bytes(), message},
+		{"raw deflate", deflated.Bytes(), message},
+		// starts with the bits of a fixed huffman deflate block
+		{"uncompressed text", message, nil},
+		{"uncompressed binary", []byte{0x08, 0x96, 0x01, 0x12, 0x07, 0x74, 0x65, 0x73, 0x74, 0x69, 0x6e, 0x67}, nil},
+		{"truncated gzip", gzipped.Bytes()[:gzipped.Len()/2], nil},
+		{"deflate with trailing bytes", append(append([]byte{}, deflated.Bytes()...), 0x00, 0x01), nil},
+		{"empty", []byte{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, ok := decompress(tt.frame)
+			if ok != (tt.decoded != nil) || !bytes.Equal(decoded, tt.decoded) {
+				t.Errorf("decompressed %q, %v", decoded, ok)
+			}
+		})
+	}
+}
+
+func TestUncompressedBinaryFrames(t *testing.T) {
+	frames := [][]byte{
+		{0x08, 0x96, 0x01, 0x12, 0x07, 0x74, 0x65, 0x73, 0x74},
+		[]byte(`{"event":"subscribe"}`),
+	}
+
+	url, _ := newServer(t, func(n int, conn *websocket.Conn) {
+		for _, f := range frames {
+			conn.WriteMessage(websocket.BinaryMessage, f)
+		}
+		conn.ReadMessage()
+	})
+
+	c := New(url)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, f := range frames {
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.BinaryMessage || !bytes.Equal(data, f) {
+			t.Errorf("read %d %q, expected the binary frame %q unchanged", messageType, data, f)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// How a client retries a lost connection. Waits between attempts grow
+// exponentially from InitialInterval up to MaxInterval
+type Policy struct {
+	// give up after this many failed attempts, zero retries forever
+	MaxAttempts int
+	// give up once retrying has taken this long, zero retries forever
+	MaxElapsed time.Duration
+
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// random fraction of each wait added or removed
+	Jitter float64
+
+	// a connection that stays up this long resets the wait to InitialInterval,
+	// shorter lived connections continue the previous backoff
+	ResetAfter time.Duration
+}
+
+// Retry forever, backing off to a minute between attempts
+var DefaultPolicy = Policy{
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     time.Minute,
+	Jitter:          0.5,
+	ResetAfter:      time.Minute,
+}
+
+// exponential backoff of the policy. Elapsed time is limited by retry
+func (p Policy) backoff() *backoff.ExponentialBackOff {
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = DefaultPolicy.InitialInterval
+	}
+	if p.MaxInterval < p.InitialInterval {
+		p.MaxInterval = p.InitialInterval
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = p.InitialInterval
+	b.MaxInterval = p.MaxInterval
+	b.RandomizationFactor = p.Jitter
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	return b
+}
@@ -0,0 +1,301 @@
+// Multiplex topic subscriptions for one venue over as few connections as the
+// venue's topic limit allows. Subscriptions are replayed after reconnects, and
+// a topic subscribed to more than once is fanned out to every subscriber
+
+package ws
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+)
+
+// Venue specific parts of a Pool
+type Protocol interface {
+	// websocket URL for a new connection, called before every connection attempt
+	URL() (string, error)
+	// set pings, timeouts and other options on a new client before it connects
+	Configure(c *Client)
+	// run on every connection before subscriptions are replayed, e.g. to read
+	// a welcome message
+	Connected(c *Client) error
+	// send requests to subscribe to or unsubscribe from topics. Responses are
+	// received by the pool and dropped, so they must not be read here
+	Subscribe(c *Client, topics []string) error
+	Unsubscribe(c *Client, topics []string) error
+	// topic a message belongs to, empty for responses, pongs and other
+	// messages without a topic
+	Topic(message []byte) string
+	// maximum topics per connection, zero for no limit
+	MaxTopics() int
+}
+
+type Pool struct {
+	protocol     Protocol
+	name         string
+	mux          *sync.Mutex
+	conns        []*poolConn
+	topics       map[string][]chan []byte
+	onDisconnect []func(topic string)
+	closed       bool
+	dropped      *atomic.Int64
+	logger       *logger.Logger
+}
+
+type poolConn struct {
+	client *Client
+	topics map[string]bool
+}
+
+var ErrPoolClosed = errors.New("pool closed")
+
+// Create a pool for a venue, named for logging
+func NewPool(name string, protocol Protocol) *Pool {
+	return &Pool{
+		protocol: protocol,
+		name:     name,
+		mux:      &sync.Mutex{},
+		topics:   make(map[string][]chan []byte),
+		dropped:  &atomic.Int64{},
+		logger:   logger.Named(name + " Pool"),
+	}
+}
+
+// Subscribe to a topic, returning the channel its messages are sent over.
+// Every subscription to a topic receives its own channel, messages are
+// dropped while it is full
+func (p *Pool) Subscribe(topic string) (chan []byte, error) {
+	c := make(chan []byte, 100)
+
+	var url string
+	for {
+		p.mux.Lock()
+		if p.closed {
+			p.mux.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		if subscribers, ok := p.topics[topic]; ok {
+			// already subscribed at the venue
+			p.topics[topic] = append(subscribers, c)
+			p.mux.Unlock()
+			return c, nil
+		}
+
+		if conn := p.available(); conn != nil {
+			p.topics[topic] = []chan []byte{c}
+			conn.topics[topic] = true
+			p.mux.Unlock()
+
+			// writes wait for a connection that is connecting, which may also
+			// replay the topic. A duplicate subscription is harmless
+			if err := p.protocol.Subscribe(conn.client, []string{topic}); err != nil && !errors.Is(err, ErrNotConnected) {
+				p.logger.Warn("could not subscribe to ", topic, " ", err)
+			}
+			return c, nil
+		}
+
+		if url != "" {
+			break
+		}
+
+		// every connection is full. The URL of a new one may take a REST
+		// request, so it is resolved without holding the lock and the pool
+		// is checked again
+		p.mux.Unlock()
+		u, err := p.protocol.URL()
+		if err != nil {
+			return nil, err
+		}
+		url = u
+	}
+
+	// the new connection subscribes to its topics once connected
+	conn := p.newConn(url, topic)
+	p.topics[topic] = []chan []byte{c}
+	p.conns = append(p.conns, conn)
+	p.mux.Unlock()
+
+	if err := conn.client.Connect(); err != nil {
+		p.logger.Warn("could not connect, retrying in the background ", err)
+	}
+	go p.read(conn)
+
+	return c, nil
+}
+
+// Unsubscribe the channel returned by Subscribe from a topic. The channel is
+// not closed, but receives no further messages. The venue is unsubscribed from
+// once a topic has no subscribers left
+func (p *Pool) Unsubscribe(topic string, c chan []byte) error {
+	p.mux.Lock()
+	subscribers := p.topics[topic]
+	for i, subscriber := range subscribers {
+		if subscriber == c {
+			subscribers = append(subscribers[:i:i], subscribers[i+1:]...)
+			break
+		}
+	}
+	if len(subscribers) != 0 {
+		p.topics[topic] = subscribers
+		p.mux.Unlock()
+		return nil
+	}
+	delete(p.topics, topic)
+
+	var client *Client
+	for _, conn := range p.conns {
+		if conn.topics[topic] {
+			delete(conn.topics, topic)
+			client = conn.client
+			break
+		}
+	}
+	p.mux.Unlock()
+
+	if client == nil {
+		return nil
+	}
+
+	return p.protocol.Unsubscribe(client, []string{topic})
+}
+
+// Register a function to run for every topic of a connection that is lost,
+// before it reconnects, e.g. to withdraw quotes. It runs on the goroutine
+// reading the connection and must not call the pool
+func (p *Pool) OnDisconnect(f func(topic string)) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.onDisconnect = append(p.onDisconnect, f)
+}
+
+// Number of open connections
+func (p *Pool) Connections() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return len(p.conns)
+}
+
+// Number of messages dropped because a subscriber's channel was full
+func (p *Pool) Dropped() int64 {
+	return p.dropped.Load()
+}
+
+// Close every connection
+func (p *Pool) Close() {
+	p.mux.Lock()
+	p.closed = true
+	conns := p.conns
+	p.mux.Unlock()
+
+	for _, conn := range conns {
+		conn.client.Close()
+	}
+}
+
+// a connection with room for another topic, only called with mux held
+func (p *Pool) available() *poolConn {
+	limit := p.protocol.MaxTopics()
+	for _, conn := range p.conns {
+		if limit == 0 || len(conn.topics) < limit {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// create a client for a new connection to url, only called with mux held
+func (p *Pool) newConn(url string, topic string) *poolConn {
+	conn := &poolConn{
+		client: New(url),
+		topics: map[string]bool{topic: true},
+	}
+
+	// the first attempt uses url, later attempts resolve a new one. Only
+	// called while connecting, which the client serializes
+	resolved := true
+	conn.client.SetURLFunc(func() (string, error) {
+		if resolved {
+			resolved = false
+			return url, nil
+		}
+		return p.protocol.URL()
+	})
+	p.protocol.Configure(conn.client)
+	conn.client.SetOnConnect(func(c *Client) error {
+		if err := p.protocol.Connected(c); err != nil {
+			return err
+		}
+
+		// replay the connection's current subscriptions
+		p.mux.Lock()
+		topics := make([]string, 0, len(conn.topics))
+		for topic := range conn.topics {
+			topics = append(topics, topic)
+		}
+		p.mux.Unlock()
+
+		if len(topics) == 0 {
+			return nil
+		}
+		return p.protocol.Subscribe(c, topics)
+	})
+	conn.client.OnDisconnect(func(error) {
+		p.mux.Lock()
+		topics := make([]string, 0, len(conn.topics))
+		for topic := range conn.topics {
+			topics = append(topics, topic)
+		}
+		hooks := p.onDisconnect
+		p.mux.Unlock()
+
+		for _, topic := range topics {
+			for _, f := range hooks {
+				f(topic)
+			}
+		}
+	})
+
+	return conn
+}
+
+// route messages from a connection to their topic's channel. A subscriber
+// that falls behind loses messages instead of stalling the connection's other
+// topics
+func (p *Pool) read(conn *poolConn) {
+	for {
+		_, message, err := conn.client.ReadMessage()
+		if err != nil {
+			p.mux.Lock()
+			closed := p.closed
+			p.mux.Unlock()
+			if closed {
+				return
+			}
+
+			p.logger.Warn(err, " reconnecting")
+			conn.client.Connect()
+			continue
+		}
+
+		topic := p.protocol.Topic(message)
+		if topic == "" {
+			continue
+		}
+
+		p.mux.Lock()
+		subscribers := p.topics[topic]
+		p.mux.Unlock()
+		for _, c := range subscribers {
+			select {
+			case c <- message:
+			default:
+				p.dropped.Add(1)
+				p.logger.Debug("subscriber of ", topic, " is full, message dropped")
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package ws
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocol of the test server: requests are {"op":"subscribe","topics":[...]},
+// messages are {"topic":"..."}
+type testProtocol struct {
+	url       string
+	urls      *atomic.Int64
+	maxTopics int
+}
+
+type testRequest struct {
+	Op     string   `json:"op"`
+	Topics []string `json:"topics"`
+}
+
+type testMessage struct {
+	Topic string `json:"topic"`
+}
+
+func (p *testProtocol) URL() (string, error) {
+	p.urls.Add(1)
+	return p.url, nil
+}
+
+func (p *testProtocol) Configure(c *Client) {
+	c.SetReconnectPolicy(testPolicy)
+}
+
+func (p *testProtocol) Connected(c *Client) error {
+	return nil
+}
+
+func (p *testProtocol) Subscribe(c *Client, topics []string) error {
+	return c.WriteJSON(testRequest{Op: "subscribe", Topics: topics})
+}
+
+func (p *testProtocol) Unsubscribe(c *Client, topics []string) error {
+	return c.WriteJSON(testRequest{Op: "unsubscribe", Topics: topics})
+}
+
+func (p *testProtocol) Topic(message []byte) string {
+	var m testMessage
+	if err := json.Unmarshal(message, &m); err != nil {
+		return ""
+	}
+	return m.Topic
+}
+
+func (p *testProtocol) MaxTopics() int {
+	return p.maxTopics
+}
+
+// answer every subscription with a message on the topic. Connections after the
+// first n are held open, the first n are dropped after answering a request
+func subscriptionServer(t *testing.T, drop int) (string, *atomic.Int64) {
+	return newServer(t, func(n int, conn *websocket.Conn) {
+		for {
+			var request testRequest
+			if err := conn.ReadJSON(&request); err != nil {
+				return
+			}
+			if request.Op != "subscribe" {
+				continue
+			}
+
+			for _, topic := range request.Topics {
+				if err := conn.WriteJSON(testMessage{Topic: topic}); err != nil {
+					return
+				}
+			}
+			if n <= drop {
+				return
+			}
+		}
+	})
+}
+
+func receiveMessage(t *testing.T, c chan []byte) string {
+	t.Helper()
+
+	select {
+	case message := <-c:
+		var m testMessage
+		json.Unmarshal(message, &m)
+		return m.Topic
+	case <-time.After(testTimeout):
+		t.Fatal("no message received")
+		return ""
+	}
+}
+
+func TestPoolFansOutTopics(t *testing.T) {
+	url, connections := subscriptionServer(t, 0)
+	protocol := &testProtocol{url: url, urls: &atomic.Int64{}, maxTopics: 2}
+	p := NewPool("Test", protocol)
+	defer p.Close()
+
+	first, err := p.Subscribe("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.Subscribe("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("subscribers share a channel")
+	}
+
+	// the venue is only subscribed once, the message reaches both subscribers
+	if topic := receiveMessage(t, first); topic != "a" {
+		t.Errorf("first subscriber received %q", topic)
+	}
+	if topic := receiveMessage(t, second); topic != "a" {
+		t.Errorf("second subscriber received %q", topic)
+	}
+
+	// a third topic does not fit on the first connection
+	for _, topic := range []string{"b", "c"} {
+		c, err := p.Subscribe(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received := receiveMessage(t, c); received != topic {
+			t.Errorf("%s subscriber received %q", topic, received)
+		}
+	}
+
+	if n := p.Connections(); n != 2 {
+		t.Errorf("%d pool connections, expected 2", n)
+	}
+	if n := connections.Load(); n != 2 {
+		t.Errorf("%d server connections, expected 2", n)
+	}
+	if n := protocol.urls.Load(); n != 2 {
+		t.Errorf("URL resolved %d times for 2 connections", n)
+	}
+
+	// unsubscribing one subscriber keeps the topic for the other
+	if err := p.Unsubscribe("a", first); err != nil {
+		t.Fatal(err)
+	}
+	p.mux.Lock()
+	subscribers := len(p.topics["a"])
+	p.mux.Unlock()
+	if subscribers != 1 {
+		t.Errorf("%d subscribers left, expected 1", subscribers)
+	}
+}
+
+func TestPoolReportsDisconnectedTopics(t *testing.T) {
+	url, _ := subscriptionServer(t, 1)
+	protocol := &testProtocol{url: url, urls: &atomic.Int64{}}
+	p := NewPool("Test", protocol)
+	defer p.Close()
+
+	disconnected := make(chan string, 10)
+	p.OnDisconnect(func(topic string) {
+		disconnected <- topic
+	})
+
+	c, err := p.Subscribe("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveMessage(t, c)
+
+	select {
+	case topic := <-disconnected:
+		if topic != "a" {
+			t.Errorf("disconnect reported for %q", topic)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("disconnect not reported")
+	}
+
+	// the topic is replayed on the new connection
+	if topic := receiveMessage(t, c); topic != "a" {
+		t.Errorf("received %q after reconnecting", topic)
+	}
+	if n := protocol.urls.Load(); n != 2 {
+		t.Errorf("URL resolved %d times for 2 connections", n)
+	}
+}
+
+func TestPoolDropsForFullSubscriber(t *testing.T) {
+	// a subscription to "a" is answered with more messages than a subscriber
+	// buffers, any other topic with a single message
+	url, _ := newServer(t, func(n int, conn *websocket.Conn) {
+		for {
+			var request testRequest
+			if err := conn.ReadJSON(&request); err != nil {
+				return
+			}
+			for _, topic := range request.Topics {
+				count := 1
+				if topic == "a" {
+					count = 150
+				}
+				for i := 0; i < count; i++ {
+					if err := conn.WriteJSON(testMessage{Topic: topic}); err != nil {
+						return
+					}
+				}
+			}
+		}
+	})
+	p := NewPool("Test", &testProtocol{url: url, urls: &atomic.Int64{}})
+	defer p.Close()
+
+	// never read
+	if _, err := p.Subscribe("a"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Subscribe("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection is not stalled by the full subscriber
+	if topic := receiveMessage(t, b); topic != "b" {
+		t.Errorf("received %q", topic)
+	}
+	if n := p.Dropped(); n != 50 {
+		t.Errorf("%d messages dropped, expected 50", n)
+	}
+}
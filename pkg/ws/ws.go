@@ -1,104 +1,598 @@
+// A reconnecting websocket client that is safe for concurrent use. Each
+// connection has a single reader goroutine publishing frames and a single
+// writer goroutine draining a write queue, so callers never touch the
+// underlying connection, and reconnects are performed once for all callers
+
 package ws
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
 	"github.com/cenkalti/backoff/v4"
 	"github.com/gorilla/websocket"
 	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/logger"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ratelimit"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/transport"
 )
 
+var ErrNotConnected = errors.New("websocket not connected")
+
 type Client struct {
 	url           string
-	conn          *websocket.Conn
-	backoff       backoff.BackOff
+	urlFunc       func() (string, error)
+	policy        Policy
+	backoff       *backoff.ExponentialBackOff
 	onConnectFunc func(c *Client) error
+	onDisconnect  []func(err error)
+	onReconnect   []func()
+	onConnectFail []func(err error)
 	logger        *logger.Logger
+
+	// liveness settings, applied to each new connection
+	keepalive       time.Duration
+	appPingInterval time.Duration
+	appPingFunc     func(c *Client) error
+	readTimeout     time.Duration
+
+	compression bool
+	stats       *counters
+
+	// throttles messages written by callers, nil for no limit. Application
+	// pings use pingLimiter if it is set
+	limiter     *ratelimit.Limiter
+	pingLimiter *ratelimit.Limiter
+
+	// session is the current connection, nil while disconnected. connMux
+	// serializes connecting so concurrent callers share one reconnect
+	mux     *sync.Mutex
+	connMux *sync.Mutex
+	session *session
+
+	// when the current or last connection was established, zero if the
+	// client has never connected
+	connectedAt time.Time
+
+	// set on clients bound to a single connection, such as the one passed to
+	// the on connect function. Their reads and writes never reconnect
+	handshake bool
+}
+
+// a single websocket connection and its reader and writer goroutines
+type session struct {
+	conn      *websocket.Conn
+	frames    chan frame
+	writes    chan write
+	done      chan struct{}
+	closeOnce *sync.Once
+
+	// zero if reads never time out
+	readTimeout time.Duration
+	stats       *counters
+
+	// reason the session closed, set before done is closed
+	err error
+}
+
+type frame struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+type write struct {
+	messageType int
+	data        []byte
+	result      chan error
 }
 
 func New(url string) *Client {
 	return &Client{
 		url:     url,
-		backoff: backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 10),
+		policy:  DefaultPolicy,
+		backoff: DefaultPolicy.backoff(),
 		logger:  logger.Named("Websocket Client"),
+		mux:     &sync.Mutex{},
+		connMux: &sync.Mutex{},
+		stats:   &counters{},
 	}
 }
 
+// Connect to the websocket if not already connected, retrying with backoff
 func (c *Client) Connect() error {
-	if c.conn != nil {
+	c.connMux.Lock()
+	defer c.connMux.Unlock()
+
+	if c.current() != nil {
 		return nil
 	}
 
-	return backoff.RetryNotify(c.connect(), c.backoff, nil)
+	return c.retry()
+}
+
+// Close the current connection. Reads and writes fail with ErrNotConnected
+// until Connect is called again
+func (c *Client) Close() {
+	c.connMux.Lock()
+	defer c.connMux.Unlock()
+
+	if s := c.current(); s != nil {
+		c.setSession(nil)
+		s.close()
+	}
 }
 
-func (c *Client) connect() func() error {
-	return func() error {
-		c.logger.Info("attempting connection to ", c.url)
-		conn, _, err := websocket.DefaultDialer.Dial(c.url, nil)
+func (c *Client) connect() error {
+	url := c.url
+	if c.urlFunc != nil {
+		u, err := c.urlFunc()
 		if err != nil {
 			return err
 		}
+		url = u
+	}
+
+	c.logger.Info("attempting connection to ", url)
+	conn, _, err := c.dialer().Dial(url, transport.Header())
+	if err != nil {
+		return err
+	}
+
+	s := newSession(conn, c.readTimeout, c.stats)
+	if c.onConnectFunc != nil {
+		c.logger.Info("sending startup messages ", c.url)
+		handshake := &Client{
+			url:       c.url,
+			logger:    c.logger,
+			mux:       &sync.Mutex{},
+			connMux:   &sync.Mutex{},
+			limiter:   c.limiter,
+			session:   s,
+			handshake: true,
+		}
+		if err := c.onConnectFunc(handshake); err != nil {
+			s.close()
+			return err
+		}
+	}
+
+	c.setSession(s)
+	if c.keepalive > 0 || c.appPingInterval > 0 {
+		go c.ping(s)
+	}
+
+	c.logger.Info("connection established: ", c.url)
+	return nil
+}
+
+// send protocol and application pings over s until it closes
+func (c *Client) ping(s *session) {
+	var keepalive, appPing <-chan time.Time
+	if c.keepalive > 0 {
+		ticker := time.NewTicker(c.keepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	if c.appPingInterval > 0 {
+		ticker := time.NewTicker(c.appPingInterval)
+		defer ticker.Stop()
+		appPing = ticker.C
+	}
+
+	// pings are written to s with their own limit, if one is set
+	limiter := c.limiter
+	if c.pingLimiter != nil {
+		limiter = c.pingLimiter
+	}
+	pinger := &Client{
+		url:       c.url,
+		logger:    c.logger,
+		mux:       &sync.Mutex{},
+		connMux:   &sync.Mutex{},
+		limiter:   limiter,
+		session:   s,
+		handshake: true,
+	}
 
-		c.conn = conn
-		if c.onConnectFunc != nil {
-			c.logger.Info("sending startup messages ", c.url)
-			if err := c.onConnectFunc(c); err != nil {
-				return err
+	for {
+		select {
+		case <-keepalive:
+			if err := s.write(websocket.PingMessage, nil); err != nil {
+				return
 			}
+		case <-appPing:
+			c.logger.Debug("sending ping ", c.url)
+			if err := c.appPingFunc(pinger); err != nil {
+				c.logger.Info("ping failed ", err, c.url)
+			}
+		case <-s.done:
+			return
 		}
+	}
+}
 
-		c.logger.Info("connection established: ", c.url)
-		return nil
+// shared dialer with compression set and wire bytes counted
+func (c *Client) dialer() *websocket.Dialer {
+	d := *transport.Dialer()
+	d.EnableCompression = c.compression
+
+	dial := d.NetDialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
 	}
+	d.NetDialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, n: &c.stats.wireBytes}, nil
+	}
+
+	return &d
 }
 
-func (c *Client) reconnect() error {
-	c.conn.Close()
-	c.conn = nil
+// replace the failed session with a new connection, unless another caller
+// has already done so
+func (c *Client) reconnect(failed *session) error {
+	c.connMux.Lock()
+	defer c.connMux.Unlock()
+
+	if s := c.current(); s != failed {
+		if s == nil {
+			return ErrNotConnected
+		}
+		return nil
+	}
+
+	c.setSession(nil)
+	failed.close()
+	for _, f := range c.onDisconnect {
+		f(failed.err)
+	}
+
 	c.logger.Warn("reconnecting to ", c.url)
-	return backoff.RetryNotify(c.connect(), c.backoff, nil)
+	return c.retry()
+}
+
+// connect following the reconnect policy, only called with connMux held
+func (c *Client) retry() error {
+	reconnect := !c.connectedAt.IsZero()
+	if !reconnect || time.Since(c.connectedAt) >= c.policy.ResetAfter {
+		c.backoff.Reset()
+	}
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := c.connect()
+		if err == nil {
+			c.connectedAt = time.Now()
+			if reconnect {
+				for _, f := range c.onReconnect {
+					f()
+				}
+			}
+			return nil
+		}
+		for _, f := range c.onConnectFail {
+			f(err)
+		}
+
+		wait := c.backoff.NextBackOff()
+		if c.policy.MaxAttempts > 0 && attempt >= c.policy.MaxAttempts {
+			return err
+		}
+		if c.policy.MaxElapsed > 0 && time.Since(start)+wait > c.policy.MaxElapsed {
+			return err
+		}
+
+		c.logger.Info("connection failed, retrying in ", wait, " ", err)
+		time.Sleep(wait)
+	}
+}
+
+// current connection, waiting for a reconnect in progress. Nil if the client
+// is closed or the reconnect policy has given up
+func (c *Client) await() *session {
+	if s := c.current(); s != nil {
+		return s
+	}
+
+	c.connMux.Lock()
+	defer c.connMux.Unlock()
+	return c.current()
+}
+
+func (c *Client) current() *session {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.session
+}
+
+func (c *Client) setSession(s *session) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.session = s
+}
+
+// Whether the client has a connection. A failed connection counts until it is
+// replaced by the next read, false once the reconnect policy has given up
+func (c *Client) Connected() bool {
+	return c.current() != nil
+}
+
+// Resolve the URL before every connection attempt, for venues that issue
+// short lived connection tokens
+func (c *Client) SetURLFunc(url func() (string, error)) {
+	c.urlFunc = url
 }
 
-// specify a function to run on websocket connection and reconnection
+// specify a function to run on websocket connection and reconnection. The
+// function is passed a client bound to the new connection, which must be used
+// for any reads and writes made while connecting
 func (c *Client) SetOnConnect(onConnect func(c *Client) error) {
 	c.onConnectFunc = onConnect
 }
 
+// Set how lost connections are retried, must be called before Connect
+func (c *Client) SetReconnectPolicy(p Policy) {
+	c.policy = p
+	c.backoff = p.backoff()
+}
+
+// Register a function to run when an established connection is lost, before
+// reconnecting. It runs on the goroutine that detected the failure and must
+// not read from the client
+func (c *Client) OnDisconnect(f func(err error)) {
+	c.onDisconnect = append(c.onDisconnect, f)
+}
+
+// Register a function to run after every failed connection attempt, including
+// attempts to connect for the first time. It runs before waiting to retry and
+// must not read from or write to the client
+func (c *Client) OnConnectFailed(f func(err error)) {
+	c.onConnectFail = append(c.onConnectFail, f)
+}
+
+// Register a function to run once a lost connection has been reestablished
+func (c *Client) OnReconnect(f func()) {
+	c.onReconnect = append(c.onReconnect, f)
+}
+
+// Send a websocket ping frame every interval. Pongs count as activity
+// for the read timeout
+func (c *Client) SetKeepalive(interval time.Duration) {
+	c.keepalive = interval
+}
+
+// Call ping every interval while connected, for venues that expect
+// application level ping messages rather than ping frames. ping is passed a
+// client bound to the current connection. Zero disables it
+func (c *Client) SetAppPing(interval time.Duration, ping func(c *Client) error) {
+	c.appPingInterval = interval
+	c.appPingFunc = ping
+}
+
+// Treat the connection as dead and reconnect if nothing is received within
+// timeout. Zero disables the timeout
+func (c *Client) SetReadTimeout(timeout time.Duration) {
+	c.readTimeout = timeout
+}
+
+// Negotiate permessage-deflate compression on future connections
+func (c *Client) SetCompression(enabled bool) {
+	c.compression = enabled
+}
+
+// Throttle messages written with WriteMessage and WriteJSON, including
+// startup messages and application pings without their own limit. Ping
+// frames are not limited
+func (c *Client) SetRateLimit(l *ratelimit.Limiter) {
+	c.limiter = l
+}
+
+// Throttle application pings with their own limiter, so they neither queue
+// behind other messages nor use up their budget. A ping rejected by a limiter
+// in Reject mode is skipped until the next interval
+func (c *Client) SetPingRateLimit(l *ratelimit.Limiter) {
+	c.pingLimiter = l
+}
+
+// Bandwidth used by the client across all of its connections
+func (c *Client) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// Read the next message and decode it as json into v. Messages that cannot
+// be decoded into v are skipped
 func (c *Client) ReadJSON(v interface{}) error {
-	if err := c.conn.ReadJSON(v); err != nil {
-		c.logger.Info(err, c.url)
-		if err := c.reconnect(); err != nil {
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
 			return err
 		}
 
-		return c.conn.ReadJSON(v)
-	}
+		if err := json.Unmarshal(data, v); err != nil {
+			c.logger.Warn("could not decode message, skipping ", err)
+			continue
+		}
 
-	return nil
+		return nil
+	}
 }
 
 func (c *Client) WriteJSON(v interface{}) error {
-	if err := c.conn.WriteJSON(v); err != nil {
-		c.logger.Info(err, c.url)
-		if err := c.reconnect(); err != nil {
-			return err
-		}
-
-		return c.conn.WriteJSON(v)
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return c.WriteMessage(websocket.TextMessage, data)
 }
 
+// Read the next message, reconnecting once if the connection has failed
 func (c *Client) ReadMessage() (int, []byte, error) {
-	messageType, p, err := c.conn.ReadMessage()
+	s := c.await()
+	if s == nil {
+		return 0, nil, ErrNotConnected
+	}
+
+	f := s.read()
+	if f.err == nil || c.handshake {
+		return f.messageType, f.data, f.err
+	}
+
+	c.logger.Info(f.err, c.url)
+	if err := c.reconnect(s); err != nil {
+		return 0, nil, err
+	}
+
+	if s = c.current(); s == nil {
+		return 0, nil, ErrNotConnected
+	}
+	f = s.read()
+	return f.messageType, f.data, f.err
+}
+
+// Queue a message to be written and wait for the result. A failed write closes
+// the connection, which is reestablished by the next read. Messages over the
+// rate limit wait or fail with ratelimit.ErrLimited
+func (c *Client) WriteMessage(messageType int, data []byte) error {
+	if c.await() == nil {
+		return ErrNotConnected
+	}
+	if err := c.limiter.Wait(); err != nil {
+		c.logger.Warn(err, c.url)
+		return err
+	}
+
+	// the connection may have been replaced while waiting
+	s := c.await()
+	if s == nil {
+		return ErrNotConnected
+	}
+
+	err := s.write(messageType, data)
 	if err != nil {
 		c.logger.Info(err, c.url)
-		if err := c.reconnect(); err != nil {
-			return 0, nil, err
+	}
+
+	return err
+}
+
+func newSession(conn *websocket.Conn, readTimeout time.Duration, stats *counters) *session {
+	s := &session{
+		conn:        conn,
+		frames:      make(chan frame),
+		writes:      make(chan write),
+		done:        make(chan struct{}),
+		closeOnce:   &sync.Once{},
+		readTimeout: readTimeout,
+		stats:       stats,
+	}
+
+	if readTimeout > 0 {
+		conn.SetPongHandler(func(string) error {
+			s.extendDeadline()
+			return nil
+		})
+
+		ping := conn.PingHandler()
+		conn.SetPingHandler(func(data string) error {
+			s.extendDeadline()
+			return ping(data)
+		})
+	}
+
+	go s.readLoop()
+	go s.writeLoop()
+
+	return s
+}
+
+// the only goroutine reading from the connection
+func (s *session) readLoop() {
+	for {
+		s.extendDeadline()
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		if messageType == websocket.BinaryMessage {
+			if decoded, ok := decompress(data); ok {
+				messageType, data = websocket.TextMessage, decoded
+			}
+		}
+		s.stats.messages.Add(1)
+		s.stats.decodedBytes.Add(int64(len(data)))
+
+		select {
+		case s.frames <- frame{messageType: messageType, data: data}:
+		case <-s.done:
+			return
 		}
+	}
+}
+
+// the only goroutine writing to the connection
+func (s *session) writeLoop() {
+	for {
+		select {
+		case w := <-s.writes:
+			err := s.conn.WriteMessage(w.messageType, w.data)
+			w.result <- err
+			if err != nil {
+				s.fail(err)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
 
-		return c.conn.ReadMessage()
+// push back the read deadline, only called from the reader goroutine
+func (s *session) extendDeadline() {
+	if s.readTimeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.readTimeout))
 	}
+}
+
+func (s *session) read() frame {
+	select {
+	case f := <-s.frames:
+		return f
+	case <-s.done:
+		return frame{err: s.err}
+	}
+}
+
+func (s *session) write(messageType int, data []byte) error {
+	result := make(chan error, 1)
+	select {
+	case s.writes <- write{messageType: messageType, data: data, result: result}:
+	case <-s.done:
+		return s.err
+	}
+
+	// the writer always reports the result of a write it has taken
+	return <-result
+}
+
+// close the session, reads and writes then fail with err
+func (s *session) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.conn.Close()
+	})
+}
 
-	return messageType, p, err
+func (s *session) close() {
+	s.fail(ErrNotConnected)
 }
@@ -0,0 +1,296 @@
+package ws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/johnwashburne/Crypto-Price-Aggregator/pkg/ratelimit"
+)
+
+const testTimeout = 5 * time.Second
+
+// reconnect quickly in tests
+var testPolicy = Policy{
+	InitialInterval: 10 * time.Millisecond,
+	MaxInterval:     50 * time.Millisecond,
+}
+
+// Serve websocket connections with handle, closing each once handle returns.
+// Returns the websocket URL and the number of connections accepted so far
+func newServer(t *testing.T, handle func(n int, conn *websocket.Conn)) (string, *atomic.Int64) {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	connections := &atomic.Int64{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		handle(int(connections.Add(1)), conn)
+	}))
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), connections
+}
+
+// echo every message until the connection closes
+func echo(conn *websocket.Conn) {
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			return
+		}
+	}
+}
+
+// wait for wg, failing the test if it takes too long
+func wait(t *testing.T, wg *sync.WaitGroup) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("goroutines did not finish")
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	url, _ := newServer(t, func(n int, conn *websocket.Conn) {
+		echo(conn)
+	})
+
+	c := New(url)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const writers, writes = 8, 50
+	wg := &sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("%d-%d", w, i))); err != nil {
+					t.Errorf("write %d-%d: %v", w, i, err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	received := make(map[string]bool)
+	for len(received) < writers*writes {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received[string(data)] {
+			t.Errorf("received %s twice", data)
+		}
+		received[string(data)] = true
+	}
+	wait(t, wg)
+
+	if stats := c.Stats(); stats.Messages != writers*writes {
+		t.Errorf("counted %d messages, expected %d", stats.Messages, writers*writes)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	url, connections := newServer(t, func(n int, conn *websocket.Conn) {
+		// greet every connection, drop the first after its greeting
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprint("connection ", n))); err != nil {
+			return
+		}
+		if n == 1 {
+			return
+		}
+		echo(conn)
+	})
+
+	c := New(url)
+	c.SetReconnectPolicy(testPolicy)
+
+	handshakes := &atomic.Int64{}
+	c.SetOnConnect(func(c *Client) error {
+		handshakes.Add(1)
+		_, _, err := c.ReadMessage()
+		return err
+	})
+	disconnects, reconnects := &atomic.Int64{}, &atomic.Int64{}
+	c.OnDisconnect(func(error) { disconnects.Add(1) })
+	c.OnReconnect(func() { reconnects.Add(1) })
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// readers and writers racing the reconnect, all of them are served by
+	// the second connection. Writes made before it is replaced may fail
+	const readers = 4
+	wg := &sync.WaitGroup{}
+	for r := 0; r < readers; r++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				c.WriteMessage(websocket.TextMessage, []byte("echo"))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, _, err := c.ReadMessage(); err != nil {
+				t.Errorf("read: %v", err)
+			}
+		}()
+	}
+
+	// keep the readers fed once the second connection is up
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				c.WriteMessage(websocket.TextMessage, []byte("echo"))
+			}
+		}
+	}()
+	wait(t, wg)
+
+	if n := connections.Load(); n != 2 {
+		t.Errorf("%d connections, expected 2", n)
+	}
+	if n := handshakes.Load(); n != 2 {
+		t.Errorf("%d handshakes, expected 2", n)
+	}
+	if n := disconnects.Load(); n != 1 {
+		t.Errorf("%d disconnects, expected 1", n)
+	}
+	if n := reconnects.Load(); n != 1 {
+		t.Errorf("%d reconnects, expected 1", n)
+	}
+}
+
+func TestCloseUnblocksReadersAndWriters(t *testing.T) {
+	url, _ := newServer(t, func(n int, conn *websocket.Conn) {
+		// read without replying, so readers block
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+
+	c := New(url)
+	c.SetReconnectPolicy(testPolicy)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.ReadMessage()
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				if err := c.WriteMessage(websocket.TextMessage, []byte("ignored")); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	wait(t, wg)
+
+	if _, _, err := c.ReadMessage(); err != ErrNotConnected {
+		t.Errorf("read after close returned %v, expected %v", err, ErrNotConnected)
+	}
+	if err := c.WriteMessage(websocket.TextMessage, nil); err != ErrNotConnected {
+		t.Errorf("write after close returned %v, expected %v", err, ErrNotConnected)
+	}
+
+	// a closed client can connect again
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestPingRateLimit(t *testing.T) {
+	pings := &atomic.Int64{}
+	messages := make(chan string, 10)
+	url, _ := newServer(t, func(n int, conn *websocket.Conn) {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(data) == "ping" {
+				pings.Add(1)
+				continue
+			}
+			messages <- string(data)
+		}
+	})
+
+	c := New(url)
+	c.SetAppPing(5*time.Millisecond, func(c *Client) error {
+		return c.WriteMessage(websocket.TextMessage, []byte("ping"))
+	})
+	// pings over their budget are skipped rather than queued, and do not
+	// use up the budget of other messages
+	c.SetRateLimit(ratelimit.New("Test", 1, time.Hour, ratelimit.Queue))
+	c.SetPingRateLimit(ratelimit.New("Test pings", 2, time.Hour, ratelimit.Reject))
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := c.WriteMessage(websocket.TextMessage, []byte("subscribe")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-messages:
+		if message != "subscribe" {
+			t.Errorf("received %s, expected the subscription", message)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("message not received")
+	}
+
+	if n := pings.Load(); n != 2 {
+		t.Errorf("%d pings received, expected 2", n)
+	}
+}
@@ -3,8 +3,13 @@
 import requests
 from typing import List
 import json
+import os
 from tqdm import tqdm
 
+# databases are written next to the symbol package regardless of the
+# directory the script is run from
+SYMBOL_DIR = os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "pkg", "symbol")
+
 
 class Symbol:
 
@@ -14,6 +19,22 @@ class Symbol:
         self.quote_currency = quote_currency
 
 
+class Contract(Symbol):
+
+    def __init__(
+            self,
+            symbol: str,
+            base_currency: str,
+            quote_currency: str,
+            contract_size: str,
+            tick_size: str,
+            settle: str):
+        super().__init__(symbol, base_currency, quote_currency)
+        self.contract_size = contract_size
+        self.tick_size = tick_size
+        self.settle = settle
+
+
 def get_gemini_symbols() -> List[Symbol]:
     response = requests.get("https://api.gemini.com/v1/symbols")
     instruments = response.json()
@@ -116,6 +137,126 @@ def get_binance_us_symbols() -> List[Symbol]:
 
     return res
 
+def get_okx_symbols() -> List[Symbol]:
+    response = requests.get(
+        "https://www.okx.com/api/v5/public/instruments?instType=SPOT"
+    )
+    res = []
+
+    for instrument in tqdm(response.json()['data']):
+        res.append(Symbol(
+            instrument['instId'],
+            instrument['baseCcy'],
+            instrument['quoteCcy']
+        ))
+
+    return res
+
+def get_bitfinex_symbols() -> List[Symbol]:
+    pairs = requests.get(
+        "https://api-pub.bitfinex.com/v2/conf/pub:list:pair:exchange"
+    ).json()[0]
+    # Bitfinex uses its own codes for some currencies, e.g. UST for USDT
+    codes = dict(requests.get(
+        "https://api-pub.bitfinex.com/v2/conf/pub:map:currency:sym"
+    ).json()[0])
+    res = []
+
+    for pair in tqdm(pairs):
+        if ":" in pair:
+            base, quote = pair.split(":")
+        else:
+            base, quote = pair[:3], pair[3:]
+
+        res.append(Symbol(
+            "t" + pair,
+            codes.get(base, base),
+            codes.get(quote, quote)
+        ))
+
+    return res
+
+def get_bybit_symbols() -> List[Symbol]:
+    response = requests.get(
+        "https://api.bybit.com/v5/market/instruments-info?category=spot"
+    )
+    res = []
+
+    for instrument in tqdm(response.json()['result']['list']):
+        res.append(Symbol(
+            instrument['symbol'],
+            instrument['baseCoin'],
+            instrument['quoteCoin']
+        ))
+
+    return res
+
+def get_binance_usdm_contracts() -> List[Contract]:
+    response = requests.get("https://fapi.binance.com/fapi/v1/exchangeInfo")
+    res = []
+
+    for instrument in tqdm(response.json()['symbols']):
+        if instrument['contractType'] != "PERPETUAL":
+            continue
+
+        tick_size = next(
+            f['tickSize'] for f in instrument['filters']
+            if f['filterType'] == "PRICE_FILTER"
+        )
+        res.append(Contract(
+            instrument['symbol'],
+            instrument['baseAsset'],
+            instrument['quoteAsset'],
+            "1",
+            tick_size,
+            instrument['marginAsset']
+        ))
+
+    return res
+
+def get_bybit_linear_contracts() -> List[Contract]:
+    response = requests.get(
+        "https://api.bybit.com/v5/market/instruments-info?category=linear&limit=1000"
+    )
+    res = []
+
+    for instrument in tqdm(response.json()['result']['list']):
+        if instrument['contractType'] != "LinearPerpetual":
+            continue
+
+        res.append(Contract(
+            instrument['symbol'],
+            instrument['baseCoin'],
+            instrument['quoteCoin'],
+            "1",
+            instrument['priceFilter']['tickSize'],
+            instrument['settleCoin']
+        ))
+
+    return res
+
+def get_okx_swap_contracts() -> List[Contract]:
+    response = requests.get(
+        "https://www.okx.com/api/v5/public/instruments?instType=SWAP"
+    )
+    res = []
+
+    for instrument in tqdm(response.json()['data']):
+        if instrument['ctType'] != "linear":
+            continue
+
+        base, quote = instrument['uly'].split("-")
+        res.append(Contract(
+            instrument['instId'],
+            base,
+            quote,
+            instrument['ctVal'],
+            instrument['tickSz'],
+            instrument['settleCcy']
+        ))
+
+    return res
+
 
 def add_symbols(
         curr_symbols: dict, 
@@ -133,6 +274,23 @@ def add_symbols(
 
     return curr_symbols
 
+def add_contracts(
+        curr_contracts: dict,
+        new_contracts: List[Contract],
+        name: str) -> dict:
+
+    for c in new_contracts:
+        pairs = curr_contracts.setdefault(c.base_currency, {})
+        venues = pairs.setdefault(c.quote_currency, {})
+        venues[name] = {
+            "symbol": c.symbol,
+            "contractSize": c.contract_size,
+            "tickSize": c.tick_size,
+            "settle": c.settle,
+        }
+
+    return curr_contracts
+
 
 if __name__ == "__main__":
     
@@ -144,6 +302,18 @@ if __name__ == "__main__":
     add_symbols(symbols, get_coinbase_symbols(), "Coinbase")
     add_symbols(symbols, get_kucoin_symbols(), "Kucoin")
     add_symbols(symbols, get_binance_us_symbols(), "Binance.US")
+    add_symbols(symbols, get_okx_symbols(), "OKX")
+    add_symbols(symbols, get_bitfinex_symbols(), "Bitfinex")
+    add_symbols(symbols, get_bybit_symbols(), "Bybit")
 
-    with open("../pkg/symbol/symbol_database.json", 'w') as f:
+    with open(os.path.join(SYMBOL_DIR, "symbol_database.json"), 'w') as f:
         json.dump(symbols, f)
+
+    contracts = {}
+
+    add_contracts(contracts, get_binance_usdm_contracts(), "Binance USD-M")
+    add_contracts(contracts, get_bybit_linear_contracts(), "Bybit Linear")
+    add_contracts(contracts, get_okx_swap_contracts(), "OKX Swap")
+
+    with open(os.path.join(SYMBOL_DIR, "contract_database.json"), 'w') as f:
+        json.dump(contracts, f)